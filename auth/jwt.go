@@ -13,6 +13,14 @@ const (
 type JwtClaims struct {
 	UserId  string `json:"user_id"`
 	IsSuper bool   `json:"is_super"`
+	// Set when the request was authenticated with a service account's API key
+	ApiKeyId string `json:"api_key_id,omitempty"`
+	// Permission keys the API key is limited to, empty when it is not
+	Scope []string `json:"scope,omitempty"`
+	// Only lets the user change their password, see model.PasswordChangeGuard
+	MustChangePassword bool `json:"must_change_password,omitempty"`
+	// The super user acting as UserId, only set on impersonation tokens
+	ImpersonatorId string `json:"impersonator_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
 	"github.com/DavidTan0527/EC-admin-dashboard/model"
 	"github.com/joho/godotenv"
 )
@@ -8,9 +13,55 @@ import (
 func main() {
     godotenv.Load()
 
-    initRoutes(&model.HandlerConns{
+    conns := &model.HandlerConns{
         Db: initDb(),
         Redis: initRedis(),
-    })
+        Mailer: model.NewMailerFromEnv(),
+    }
+
+    if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+        rotateKeys(conns, os.Args[2:])
+        return
+    }
+
+    if err := model.InitSigningKeys(conns); err != nil {
+        panic(err)
+    }
+    if err := model.InitPermissionRegistry(conns); err != nil {
+        panic(err)
+    }
+    if err := model.InitLegacyPermGrants(conns); err != nil {
+        panic(err)
+    }
+    if err := model.InitTableSearchIndex(conns); err != nil {
+        panic(err)
+    }
+    if err := model.InitDisabledUsers(conns); err != nil {
+        panic(err)
+    }
+
+    go model.NewWebhookDispatcher(conns).Run(context.Background())
+    go model.NewPermissionExpirer(conns).Run(context.Background())
+
+    initRoutes(conns)
 }
 
+// Meant to be run on a schedule, e.g. `server rotate-keys` daily from cron.
+// Running servers pick up the new key within a minute.
+func rotateKeys(conns *model.HandlerConns, args []string) {
+    flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+    force := flags.Bool("force", false, "rotate even if the newest key is not due yet")
+    flags.Parse(args)
+
+    key, err := model.RotateSigningKeys(conns, *force)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    if key == nil {
+        fmt.Println("Signing key is not due for rotation")
+        return
+    }
+    fmt.Printf("Created signing key %s (%s), signing from %s\n", key.Id, key.Algorithm, key.ActiveAt.Format("2006-01-02 15:04:05 MST"))
+}
@@ -0,0 +1,336 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// One check made when deciding whether a user gets a resource
+type AccessCheck struct {
+    Check  string `json:"check"`
+    Result string `json:"result"`
+    Detail string `json:"detail"`
+    Key    string `json:"key,omitempty"`
+    // Active grants behind a membership check
+    Grants []PermissionGrant `json:"grants,omitempty"`
+}
+
+type AccessExplanation struct {
+    UserId       string        `json:"userId"`
+    ResourceType string        `json:"resourceType"`
+    ResourceId   string        `json:"resourceId"`
+    ResourceName string        `json:"resourceName"`
+    Allowed      bool          `json:"allowed"`
+    Verdict      string        `json:"verdict"`
+    Checks       []AccessCheck `json:"checks"`
+    // For chart views, which of their charts the user sees
+    Charts []AccessExplanation `json:"charts,omitempty"`
+}
+
+const (
+    ACCESS_CHECK_ACCOUNT = "account_active"
+    ACCESS_CHECK_SUPER = "super_user"
+    ACCESS_CHECK_PERM_KEY = "permission_key"
+    ACCESS_CHECK_MEMBERSHIP = "membership"
+    ACCESS_CHECK_OWNER = "owner"
+    ACCESS_CHECK_VISIBILITY = "visibility"
+)
+
+const (
+    ACCESS_RESULT_PASS = "pass"
+    ACCESS_RESULT_FAIL = "fail"
+    // Recorded for context, does not decide anything
+    ACCESS_RESULT_INFO = "info"
+)
+
+// Why a user can or cannot see a table, chart or chart view. Users can ask
+// about themselves.
+func (handler *PermissionHandler) ExplainAccess(c echo.Context) error {
+    userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+    resourceId, err := primitive.ObjectIDFromHex(c.Param("resource_id"))
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+    if !claims.IsSuper && claims.UserId != userId.Hex() {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Non-super users cannot explain other users' access" })
+    }
+
+    var user User
+    if err := handler.HandlerConns.Db.Collection(COLL_NAME_USER).FindOne(context.Background(), bson.M{ "_id": userId }).Decode(&user); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    var explanation *AccessExplanation
+    switch c.Param("type") {
+    case AUDIT_TARGET_TABLE:
+        explanation, err = explainTableAccess(handler.HandlerConns, &user, resourceId)
+    case AUDIT_TARGET_CHART:
+        explanation, err = explainChartAccess(handler.HandlerConns, &user, resourceId)
+    case AUDIT_TARGET_CHART_VIEW:
+        explanation, err = explainChartViewAccess(handler.HandlerConns, &user, resourceId)
+    default:
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Resource type must be table, chart or chart_view" })
+    }
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: explanation.Verdict, Data: explanation })
+}
+
+func explainTableAccess(conns *HandlerConns, user *User, id primitive.ObjectID) (*AccessExplanation, error) {
+    var table Table
+    if err := conns.Db.Collection(COLL_NAME_TABLE).FindOne(context.Background(), bson.M{ "_id": id }).Decode(&table); err != nil {
+        return nil, err
+    }
+
+    explanation := &AccessExplanation{ ResourceType: AUDIT_TARGET_TABLE, ResourceId: table.Id.Hex(), ResourceName: table.Name }
+    return explanation, explainPermKeyAccess(conns, user, table.PermKey, explanation)
+}
+
+func explainChartAccess(conns *HandlerConns, user *User, id primitive.ObjectID) (*AccessExplanation, error) {
+    var chart Chart
+    if err := conns.Db.Collection(COLL_NAME_CHART).FindOne(context.Background(), bson.M{ "_id": id }).Decode(&chart); err != nil {
+        return nil, err
+    }
+
+    explanation := &AccessExplanation{ ResourceType: AUDIT_TARGET_CHART, ResourceId: chart.Id.Hex(), ResourceName: chart.Title }
+    return explanation, explainPermKeyAccess(conns, user, chart.PermKey, explanation)
+}
+
+// Owners always get their views; everyone else needs the view's key and
+// then its visibility or a share. The charts in the view are filtered on top.
+func explainChartViewAccess(conns *HandlerConns, user *User, id primitive.ObjectID) (*AccessExplanation, error) {
+    var view ChartView
+    if err := conns.Db.Collection(COLL_NAME_CHART_VIEW).FindOne(context.Background(), bson.M{ "_id": id }).Decode(&view); err != nil {
+        return nil, err
+    }
+
+    explanation := &AccessExplanation{ ResourceType: AUDIT_TARGET_CHART_VIEW, ResourceId: view.Id.Hex(), ResourceName: view.Name }
+    isOwner := view.OwnerId != "" && view.OwnerId == user.Id.Hex()
+
+    key := view.PermKey
+    if isOwner {
+        key = ""
+    }
+    if err := explainPermKeyAccess(conns, user, key, explanation); err != nil {
+        return nil, err
+    }
+
+    if isOwner {
+        explanation.Checks = append(explanation.Checks, AccessCheck{ Check: ACCESS_CHECK_OWNER, Result: ACCESS_RESULT_PASS, Detail: "Owns the view, which skips its permission key and visibility" })
+        if explanation.Allowed {
+            explanation.Verdict = "Allowed: the user owns the view"
+        }
+    } else {
+        owner := AccessCheck{ Check: ACCESS_CHECK_OWNER, Result: ACCESS_RESULT_INFO, Detail: "Owned by " + view.OwnerId }
+        if view.OwnerId == "" {
+            owner.Detail = "No owner, the view is from before owners were recorded"
+        }
+        explanation.Checks = append(explanation.Checks, owner)
+
+        visibility, err := explainChartViewVisibility(conns, user, view)
+        if err != nil {
+            return nil, err
+        }
+        explanation.Checks = append(explanation.Checks, visibility)
+        if explanation.Allowed && visibility.Result == ACCESS_RESULT_FAIL {
+            explanation.Allowed = false
+            explanation.Verdict = "Denied: " + visibility.Detail
+        }
+    }
+
+    explanation.Charts = make([]AccessExplanation, 0, len(view.ChartIds))
+    visible := 0
+    for _, chartId := range view.ChartIds {
+        chart, err := explainChartAccess(conns, user, chartId)
+        if err == mongo.ErrNoDocuments {
+            explanation.Charts = append(explanation.Charts, AccessExplanation{
+                UserId: explanation.UserId,
+                ResourceType: AUDIT_TARGET_CHART,
+                ResourceId: chartId.Hex(),
+                Verdict: "Denied: the chart no longer exists",
+                Checks: make([]AccessCheck, 0),
+            })
+            continue
+        } else if err != nil {
+            return nil, err
+        }
+        if chart.Allowed {
+            visible++
+        }
+        explanation.Charts = append(explanation.Charts, *chart)
+    }
+
+    if explanation.Allowed {
+        explanation.Verdict += ", seeing " + strconv.Itoa(visible) + " of its " + strconv.Itoa(len(view.ChartIds)) + " charts"
+    }
+    return explanation, nil
+}
+
+func explainChartViewVisibility(conns *HandlerConns, user *User, view ChartView) (AccessCheck, error) {
+    check := AccessCheck{ Check: ACCESS_CHECK_VISIBILITY, Result: ACCESS_RESULT_PASS }
+
+    switch view.Visibility {
+    case "":
+        check.Detail = "Public, as views without an owner are"
+    case CHART_VIEW_PUBLIC:
+        check.Detail = "Public"
+    case CHART_VIEW_PRIVATE:
+        check.Result = ACCESS_RESULT_FAIL
+        check.Detail = "the view is private to its owner"
+    case CHART_VIEW_SHARED:
+        share, err := chartViewShare(newPermChecker(conns, user.Id.Hex(), nil), view)
+        if err != nil {
+            return check, err
+        }
+        switch {
+        case share == nil:
+            check.Result = ACCESS_RESULT_FAIL
+            check.Detail = "the view is not shared with the user"
+        case share.UserId == user.Id.Hex():
+            check.Detail = "Shared with the user"
+        default:
+            check.Detail = "Shared with everyone holding " + share.Key
+            check.Key = share.Key
+        }
+    }
+    return check, nil
+}
+
+// Fills in the checks and verdict for a resource guarded by key, the way
+// ActiveUserGuard and checkPerm decide
+func explainPermKeyAccess(conns *HandlerConns, user *User, key string, explanation *AccessExplanation) error {
+    ctx := context.Background()
+    userId := user.Id.Hex()
+    explanation.UserId = userId
+    explanation.Checks = make([]AccessCheck, 0)
+
+    disabled, err := conns.Redis.SIsMember(ctx, DISABLED_USERS_KEY, userId).Result()
+    if err != nil {
+        return err
+    }
+    if disabled {
+        explanation.Checks = append(explanation.Checks, AccessCheck{ Check: ACCESS_CHECK_ACCOUNT, Result: ACCESS_RESULT_FAIL, Detail: "Account is disabled" })
+    } else {
+        explanation.Checks = append(explanation.Checks, AccessCheck{ Check: ACCESS_CHECK_ACCOUNT, Result: ACCESS_RESULT_PASS, Detail: "Account is active" })
+    }
+
+    super := AccessCheck{ Check: ACCESS_CHECK_SUPER, Result: ACCESS_RESULT_INFO, Detail: "Not a super user" }
+    if user.IsSuper {
+        super.Detail = "Super user, which does not bypass permission keys"
+    }
+    explanation.Checks = append(explanation.Checks, super)
+
+    if key == "" {
+        explanation.Checks = append(explanation.Checks, AccessCheck{ Check: ACCESS_CHECK_PERM_KEY, Result: ACCESS_RESULT_PASS, Detail: "No permission key, open to every user" })
+        explanation.Allowed = !disabled
+        explanation.Verdict = accessVerdict(explanation, disabled, "")
+        return nil
+    }
+
+    explanation.Checks = append(explanation.Checks, AccessCheck{ Check: ACCESS_CHECK_PERM_KEY, Result: ACCESS_RESULT_INFO, Detail: "Requires " + key, Key: key })
+
+    memberships, heldBy, err := explainPermMembership(conns, userId, key)
+    if err != nil {
+        return err
+    }
+    explanation.Checks = append(explanation.Checks, memberships...)
+
+    explanation.Allowed = !disabled && heldBy != ""
+    explanation.Verdict = accessVerdict(explanation, disabled, heldBy)
+    return nil
+}
+
+// One membership check per key that would grant key, see
+// permKeyCandidates. Returns the first one the user holds.
+func explainPermMembership(conns *HandlerConns, userId string, key string) ([]AccessCheck, string, error) {
+    ctx := context.Background()
+    candidates := permKeyCandidates(key)
+
+    pipe := conns.Redis.Pipeline()
+    memberships := make([]permMembershipCmds, len(candidates))
+    for i, candidate := range candidates {
+        memberships[i] = queuePermMembership(ctx, pipe, userId, candidate)
+    }
+    if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+        return nil, "", err
+    }
+
+    filter := activeGrantFilter(time.Now())
+    filter["user_id"] = userId
+    filter["key"] = bson.M{ "$in": candidates }
+    cur, err := conns.Db.Collection(COLL_NAME_PERMISSION_GRANT).Find(ctx, filter)
+    if err != nil {
+        return nil, "", err
+    }
+    grants := make([]PermissionGrant, 0)
+    if err := cur.All(ctx, &grants); err != nil {
+        return nil, "", err
+    }
+    byKey := make(map[string][]PermissionGrant)
+    for _, grant := range grants {
+        byKey[grant.Key] = append(byKey[grant.Key], grant)
+    }
+
+    now := time.Now()
+    heldBy := ""
+    checks := make([]AccessCheck, len(candidates))
+    for i, candidate := range candidates {
+        how := "directly"
+        if candidate != key {
+            how = "through the wildcard"
+        }
+
+        check := AccessCheck{ Check: ACCESS_CHECK_MEMBERSHIP, Key: candidate, Grants: byKey[candidate] }
+        held, expiredAt := memberships[i].held(now)
+        switch {
+        case expiredAt != nil:
+            check.Result = ACCESS_RESULT_FAIL
+            check.Detail = "Held " + candidate + " until " + expiredAt.Format(time.RFC3339)
+        case !held:
+            check.Result = ACCESS_RESULT_FAIL
+            check.Detail = "Does not hold " + candidate
+        default:
+            check.Result = ACCESS_RESULT_PASS
+            check.Detail = "Holds " + candidate + " " + how
+            if len(check.Grants) == 0 {
+                check.Detail += ", from before grants were recorded"
+            }
+            if heldBy == "" {
+                heldBy = candidate
+            }
+        }
+        checks[i] = check
+    }
+    return checks, heldBy, nil
+}
+
+func accessVerdict(explanation *AccessExplanation, disabled bool, heldBy string) string {
+    subject := explanation.ResourceType + " " + explanation.ResourceName
+    subject = strings.Replace(subject, "_", " ", 1)
+    switch {
+    case disabled:
+        return "Denied: the account is disabled"
+    case explanation.Allowed && heldBy == "":
+        return "Allowed: " + subject + " has no permission key"
+    case explanation.Allowed:
+        return "Allowed: the user holds " + heldBy
+    default:
+        return "Denied: the user does not hold the permission key of " + subject
+    }
+}
@@ -0,0 +1,358 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/DavidTan0527/EC-admin-dashboard/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ApiKeyHandler struct {
+    *HandlerConns
+}
+
+// Only the hash of the key is stored, Prefix is kept so keys can be told apart
+type ApiKey struct {
+    Id         primitive.ObjectID `bson:"_id"                    json:"id"`
+    UserId     primitive.ObjectID `bson:"user_id"                json:"userId"`
+    Name       string             `bson:"name"                   json:"name"`
+    Prefix     string             `bson:"prefix"                 json:"prefix"`
+    Hash       string             `bson:"hash"                   json:"-" redact:"true"`
+    CreatedBy  string             `bson:"created_by"             json:"createdBy"`
+    CreatedAt  time.Time          `bson:"created_at"             json:"createdAt"`
+    ExpiresAt  *time.Time         `bson:"expires_at,omitempty"   json:"expiresAt,omitempty"`
+    RevokedAt  *time.Time         `bson:"revoked_at,omitempty"   json:"revokedAt,omitempty"`
+    LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"lastUsedAt,omitempty"`
+    // Permission keys, wildcards included, the key is limited to on top of
+    // what the service account holds. Unrestricted when empty.
+    Scope      []string           `bson:"scope,omitempty"        json:"scope,omitempty"`
+}
+
+type CreateServiceAccountBody struct {
+    Name string `json:"name" validate:"required"`
+}
+
+type CreateApiKeyBody struct {
+    Name      string     `json:"name"       validate:"required"`
+    ExpiresAt *time.Time `json:"expires_at"`
+    Scope     []string   `json:"scope"      validate:"omitempty,dive,required"`
+}
+
+type CreateApiKeyResponse struct {
+    ApiKey
+    Key string `json:"key"`
+}
+
+const (
+    API_KEY_PREFIX = "eck_"
+    API_KEY_SIZE = 32
+    API_KEY_HEADER = "X-API-Key"
+    API_KEY_AUTH_SCHEME = "ApiKey "
+    // Avoids a write on every request for busy keys
+    API_KEY_LAST_USED_INTERVAL = time.Minute
+)
+
+func (handler *ApiKeyHandler) GetServiceAccountList(c echo.Context) error {
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+
+    cur, err := coll.Find(ctx, bson.M{ "is_service": true })
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    result := make([]User, 0)
+    if err := cur.All(ctx, &result); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: publicUsers(result),
+    })
+}
+
+// Service accounts are users without a password, so permission keys are
+// granted to them through /permission like to anyone else
+func (handler *ApiKeyHandler) CreateServiceAccount(c echo.Context) error {
+    body := new(CreateServiceAccountBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+
+    if err := coll.FindOne(ctx, bson.M{ "username": body.Name }).Decode(new(User)); err == nil {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Username exists" })
+    } else if err != mongo.ErrNoDocuments {
+        return handleMongoErr(c, err)
+    }
+
+    user := User{
+        Id: primitive.NewObjectID(),
+        Username: body.Name,
+        IsService: true,
+        CreatedAt: time.Now(),
+    }
+
+    if res, err := coll.InsertOne(ctx, user); err != nil {
+        c.Logger().Info(res)
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Cannot save service account into DB" })
+    }
+
+    c.Logger().Infof("Service account %s created", user.Username)
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_USER, user.Id.Hex(), nil, user)
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_CREATE, Id: user.Id, UserId: claims.UserId })
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Service account " + user.Username + " created",
+        Data: user.Public(),
+    })
+}
+
+// Also revokes its keys and permission keys
+func (handler *ApiKeyHandler) DeleteServiceAccount(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+
+    var before User
+    if err := coll.FindOneAndDelete(ctx, bson.M{ "_id": id, "is_service": true }).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    if err := revokeUserApiKeys(handler.HandlerConns, id); err != nil {
+        c.Logger().Error(err)
+    }
+    if err := removeUserPerms(handler.HandlerConns, id.Hex(), claims.UserId); err != nil {
+        c.Logger().Error(err)
+    }
+
+    c.Logger().Infof("Service account %s deleted", before.Username)
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_DELETE, AUDIT_TARGET_USER, id.Hex(), before, nil)
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_DELETE, Id: id, UserId: claims.UserId })
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Successfully deleted service account" })
+}
+
+func (handler *ApiKeyHandler) GetApiKeyList(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_API_KEY)
+
+    cur, err := coll.Find(ctx, bson.M{ "user_id": id })
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    result := make([]ApiKey, 0)
+    if err := cur.All(ctx, &result); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: result,
+    })
+}
+
+func (handler *ApiKeyHandler) CreateApiKey(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    body := new(CreateApiKeyBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+    if body.ExpiresAt != nil && body.ExpiresAt.Before(time.Now()) {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Expiry must be in the future" })
+    }
+    for _, key := range body.Scope {
+        if !PERM_KEY_PATTERN.MatchString(key) {
+            return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Invalid permission key " + key + " in scope" })
+        }
+    }
+
+    ctx := context.Background()
+    userColl := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    if err := userColl.FindOne(ctx, bson.M{ "_id": id, "is_service": true }).Err(); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    keyBytes := make([]byte, API_KEY_SIZE)
+    if _, err := rand.Read(keyBytes); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error generating key" })
+    }
+    key := API_KEY_PREFIX + hex.EncodeToString(keyBytes)
+
+    claims := GetJwtClaims(c)
+    apiKey := ApiKey{
+        Id: primitive.NewObjectID(),
+        UserId: id,
+        Name: body.Name,
+        Prefix: key[:len(API_KEY_PREFIX) + 8],
+        Hash: hashApiKey(key),
+        CreatedBy: claims.UserId,
+        CreatedAt: time.Now(),
+        ExpiresAt: body.ExpiresAt,
+        Scope: body.Scope,
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_API_KEY)
+    if res, err := coll.InsertOne(ctx, apiKey); err != nil {
+        c.Logger().Info(res)
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Cannot save API key into DB" })
+    }
+
+    c.Logger().Infof("API key %s created for service account %s", apiKey.Prefix, id.Hex())
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_API_KEY, apiKey.Id.Hex(), nil, apiKey)
+
+    // The key is only ever returned here
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "API key created",
+        Data: CreateApiKeyResponse{ ApiKey: apiKey, Key: key },
+    })
+}
+
+func (handler *ApiKeyHandler) RevokeApiKey(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_API_KEY)
+
+    var before ApiKey
+    update := bson.M{ "$set": bson.M{ "revoked_at": time.Now() } }
+    if err := coll.FindOneAndUpdate(context.Background(), bson.M{ "_id": id, "revoked_at": nil }, update).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    c.Logger().Infof("API key %s revoked", before.Prefix)
+
+    after := before
+    now := time.Now()
+    after.RevokedAt = &now
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_API_KEY, id.Hex(), before, after)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "API key revoked" })
+}
+
+// Authenticates requests carrying an API key, in the X-API-Key header or as
+// "Authorization: ApiKey <key>", and hands the rest to the JWT middleware.
+// Handlers see the service account through GetJwtClaims either way.
+func ApiKeyAuth(conns *HandlerConns, fallback echo.MiddlewareFunc) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        withJwt := fallback(next)
+
+        return func(c echo.Context) error {
+            key := c.Request().Header.Get(API_KEY_HEADER)
+            if authHeader := c.Request().Header.Get(echo.HeaderAuthorization); key == "" && strings.HasPrefix(authHeader, API_KEY_AUTH_SCHEME) {
+                key = strings.TrimPrefix(authHeader, API_KEY_AUTH_SCHEME)
+            }
+            if key == "" {
+                return withJwt(c)
+            }
+
+            apiKey, err := findApiKey(conns, strings.TrimSpace(key))
+            if err == mongo.ErrNoDocuments {
+                return echo.NewHTTPError(http.StatusUnauthorized, "Invalid or expired API key")
+            } else if err != nil {
+                c.Logger().Error(err)
+                return echo.NewHTTPError(http.StatusInternalServerError, "Server error")
+            }
+
+            claims := &auth.JwtClaims{
+                UserId: apiKey.UserId.Hex(),
+                ApiKeyId: apiKey.Id.Hex(),
+                Scope: apiKey.Scope,
+            }
+            c.Set("user", &jwt.Token{ Claims: claims, Valid: true })
+
+            return next(c)
+        }
+    }
+}
+
+// Finds a usable key and bumps its last used time
+func findApiKey(conns *HandlerConns, key string) (*ApiKey, error) {
+    ctx := context.Background()
+    coll := conns.Db.Collection(COLL_NAME_API_KEY)
+
+    now := time.Now()
+    filter := bson.M{
+        "hash": hashApiKey(key),
+        "revoked_at": nil,
+        "$or": bson.A{
+            bson.M{ "expires_at": nil },
+            bson.M{ "expires_at": bson.M{ "$gt": now } },
+        },
+    }
+
+    apiKey := new(ApiKey)
+    if err := coll.FindOne(ctx, filter).Decode(apiKey); err != nil {
+        return nil, err
+    }
+
+    // Keys outlive their service account if it was deleted as a user
+    owner := bson.M{ "_id": apiKey.UserId, "is_service": true }
+    if err := conns.Db.Collection(COLL_NAME_USER).FindOne(ctx, owner).Err(); err != nil {
+        return nil, err
+    }
+
+    if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > API_KEY_LAST_USED_INTERVAL {
+        coll.UpdateByID(ctx, apiKey.Id, bson.M{ "$set": bson.M{ "last_used_at": now } })
+    }
+
+    return apiKey, nil
+}
+
+func revokeUserApiKeys(conns *HandlerConns, userId primitive.ObjectID) error {
+    coll := conns.Db.Collection(COLL_NAME_API_KEY)
+    _, err := coll.UpdateMany(context.Background(), bson.M{ "user_id": userId, "revoked_at": nil }, bson.M{ "$set": bson.M{ "revoked_at": time.Now() } })
+    return err
+}
+
+// Keys are random, so an unsalted hash is enough and keeps them searchable
+func hashApiKey(key string) string {
+    hash, _ := sha256Hash([]byte(key))
+    return hex.EncodeToString(hash)
+}
@@ -0,0 +1,343 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AttachmentHandler struct {
+    *HandlerConns
+}
+
+// GridFS file document; the link to the table lives in Metadata
+type Attachment struct {
+    Id         primitive.ObjectID `bson:"_id"        json:"id"`
+    Filename   string             `bson:"filename"   json:"filename"`
+    Length     int64              `bson:"length"     json:"length"`
+    UploadDate time.Time          `bson:"uploadDate" json:"uploadDate"`
+    Metadata   AttachmentMetadata `bson:"metadata"   json:"metadata"`
+}
+
+type AttachmentMetadata struct {
+    TableId     primitive.ObjectID `bson:"table_id"         json:"tableId"`
+    Year        string             `bson:"year"             json:"year"`
+    Month       string             `bson:"month"            json:"month"`
+    RowId       string             `bson:"row_id,omitempty" json:"rowId,omitempty"`
+    ContentType string             `bson:"content_type"     json:"contentType"`
+    UploadedBy  string             `bson:"uploaded_by"      json:"uploadedBy"`
+}
+
+const DEFAULT_ATTACHMENT_MAX_SIZE = 10 << 20
+
+var DEFAULT_ATTACHMENT_MIME_TYPES = []string{
+    "application/pdf",
+    "image/png",
+    "image/jpeg",
+    "text/plain",
+    "text/csv",
+    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+    "application/vnd.ms-excel",
+    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+    "application/msword",
+}
+
+func (handler *AttachmentHandler) UploadAttachment(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    year := c.Param("year")
+    month := c.Param("month")
+    rowId := c.FormValue("row_id")
+
+    if perm, err := handler.fetchCheckTablePerm(id, userId, claims.Scope); err != nil {
+        return handleMongoErr(c, err)
+    } else if !perm {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission" })
+    }
+
+    fileHeader, err := c.FormFile("file")
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "File is required" })
+    }
+
+    maxSize := attachmentMaxSize()
+    if fileHeader.Size > maxSize {
+        return c.JSON(http.StatusRequestEntityTooLarge, HttpResponseBody{
+            Success: false,
+            Message: fmt.Sprintf("File exceeds maximum size of %d bytes", maxSize),
+        })
+    }
+
+    file, err := fileHeader.Open()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    defer file.Close()
+
+    // Sniff the content instead of trusting the client's Content-Type
+    mime, err := mimetype.DetectReader(file)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    if !mimetype.EqualsAny(mime.String(), attachmentMimeTypes()...) {
+        return c.JSON(http.StatusUnsupportedMediaType, HttpResponseBody{ Success: false, Message: "File type " + mime.String() + " is not allowed" })
+    }
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    bucket, err := handler.bucket()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    metadata := AttachmentMetadata{
+        TableId: id,
+        Year: year,
+        Month: month,
+        RowId: rowId,
+        ContentType: mime.String(),
+        UploadedBy: userId,
+    }
+    opts := options.GridFSUpload().SetMetadata(metadata)
+
+    fileId, err := bucket.UploadFromStream(fileHeader.Filename, io.LimitReader(file, maxSize), opts)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Cannot save attachment into DB" })
+    }
+
+    c.Logger().Infof("Attachment %s uploaded to table %s (%s/%s)", fileId.Hex(), id.Hex(), year, month)
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_ATTACHMENT, fileId.Hex(), nil, Attachment{
+        Id: fileId,
+        Filename: fileHeader.Filename,
+        Length: fileHeader.Size,
+        Metadata: metadata,
+    })
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Attachment uploaded",
+        Data: fileId,
+    })
+}
+
+func (handler *AttachmentHandler) GetAttachmentList(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    if perm, err := handler.fetchCheckTablePerm(id, userId, claims.Scope); err != nil {
+        return handleMongoErr(c, err)
+    } else if !perm {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission" })
+    }
+
+    filter := bson.M{
+        "metadata.table_id": id,
+        "metadata.year": c.Param("year"),
+        "metadata.month": c.Param("month"),
+    }
+    if rowId := c.QueryParam("row_id"); rowId != "" {
+        filter["metadata.row_id"] = rowId
+    }
+
+    bucket, err := handler.bucket()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    ctx := context.Background()
+    cur, err := bucket.FindContext(ctx, filter)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    result := make([]Attachment, 0)
+    if err := cur.All(ctx, &result); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: result,
+    })
+}
+
+func (handler *AttachmentHandler) DownloadAttachment(c echo.Context) error {
+    attachment, err := handler.fetchCheckAttachment(c)
+    if err != nil || attachment == nil {
+        return err
+    }
+
+    bucket, err := handler.bucket()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    stream, err := bucket.OpenDownloadStream(attachment.Id)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    defer stream.Close()
+
+    c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", attachment.Filename))
+    c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(attachment.Length, 10))
+
+    return c.Stream(http.StatusOK, attachment.Metadata.ContentType, stream)
+}
+
+func (handler *AttachmentHandler) DeleteAttachment(c echo.Context) error {
+    attachment, err := handler.fetchCheckAttachment(c)
+    if err != nil || attachment == nil {
+        return err
+    }
+
+    bucket, err := handler.bucket()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    if err := bucket.DeleteContext(context.Background(), attachment.Id); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    c.Logger().Infof("Attachment %s deleted", attachment.Id.Hex())
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_DELETE, AUDIT_TARGET_ATTACHMENT, attachment.Id.Hex(), attachment, nil)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Successfully deleted attachment",
+    })
+}
+
+// Looks up the attachment in the path and checks the owning table's permission.
+// A nil attachment with nil error means a response has already been written.
+func (handler *AttachmentHandler) fetchCheckAttachment(c echo.Context) (*Attachment, error) {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return nil, c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    bucket, err := handler.bucket()
+    if err != nil {
+        c.Logger().Error(err)
+        return nil, c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    attachment := new(Attachment)
+    ctx := context.Background()
+    if err := bucket.GetFilesCollection().FindOne(ctx, bson.M{ "_id": id }).Decode(attachment); err != nil {
+        return nil, handleMongoErr(c, err)
+    }
+
+    if perm, err := handler.fetchCheckTablePerm(attachment.Metadata.TableId, userId, claims.Scope); err != nil {
+        return nil, handleMongoErr(c, err)
+    } else if !perm {
+        return nil, c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission" })
+    }
+
+    return attachment, nil
+}
+
+func (handler *AttachmentHandler) fetchCheckTablePerm(tableId primitive.ObjectID, userId string, scope []string) (bool, error) {
+    tableHandler := TableHandler{ HandlerConns: handler.HandlerConns }
+    return tableHandler.fetchCheckTablePerm(tableId, userId, scope)
+}
+
+func (handler *AttachmentHandler) bucket() (*gridfs.Bucket, error) {
+    return newAttachmentBucket(handler.HandlerConns.Db)
+}
+
+func newAttachmentBucket(db *mongo.Database) (*gridfs.Bucket, error) {
+    return gridfs.NewBucket(db, options.GridFSBucket().SetName(COLL_NAME_ATTACHMENT))
+}
+
+// Removes every attachment linked to a table, used when the table is deleted
+func deleteTableAttachments(db *mongo.Database, tableId primitive.ObjectID) error {
+    bucket, err := newAttachmentBucket(db)
+    if err != nil {
+        return err
+    }
+
+    ctx := context.Background()
+    cur, err := bucket.FindContext(ctx, bson.M{ "metadata.table_id": tableId })
+    if err != nil {
+        return err
+    }
+
+    files := make([]Attachment, 0)
+    if err := cur.All(ctx, &files); err != nil {
+        return err
+    }
+
+    for _, file := range files {
+        if err := bucket.DeleteContext(ctx, file.Id); err != nil && err != gridfs.ErrFileNotFound {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func attachmentMaxSize() int64 {
+    if size, err := strconv.ParseInt(os.Getenv("ATTACHMENT_MAX_SIZE"), 10, 64); err == nil && size > 0 {
+        return size
+    }
+    return DEFAULT_ATTACHMENT_MAX_SIZE
+}
+
+func attachmentMimeTypes() []string {
+    env := os.Getenv("ATTACHMENT_MIME_TYPES")
+    if env == "" {
+        return DEFAULT_ATTACHMENT_MIME_TYPES
+    }
+
+    types := make([]string, 0)
+    for _, t := range strings.Split(env, ",") {
+        if t = strings.TrimSpace(t); t != "" {
+            types = append(types, t)
+        }
+    }
+    return types
+}
@@ -0,0 +1,269 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AuditHandler struct {
+    *HandlerConns
+}
+
+const (
+    AUDIT_ACTION_CREATE = "create"
+    AUDIT_ACTION_UPDATE = "update"
+    AUDIT_ACTION_DELETE = "delete"
+    AUDIT_ACTION_GRANT = "grant"
+    AUDIT_ACTION_REVOKE = "revoke"
+    AUDIT_ACTION_EXPIRE = "expire"
+    AUDIT_ACTION_IMPERSONATE = "impersonate"
+    // Any request made while impersonating, see ImpersonationAudit
+    AUDIT_ACTION_REQUEST = "request"
+)
+
+const (
+    AUDIT_TARGET_TABLE = "table"
+    AUDIT_TARGET_TABLE_DATA = "table_data"
+    AUDIT_TARGET_CHART = "chart"
+    AUDIT_TARGET_CHART_VIEW = "chart_view"
+    AUDIT_TARGET_USER = "user"
+    AUDIT_TARGET_PERMISSION = "permission"
+    AUDIT_TARGET_PERMISSION_KEY = "permission_key"
+    AUDIT_TARGET_ATTACHMENT = "attachment"
+    AUDIT_TARGET_COMMENT = "comment"
+    AUDIT_TARGET_WEBHOOK = "webhook"
+    AUDIT_TARGET_API_KEY = "api_key"
+    AUDIT_TARGET_REQUEST = "request"
+)
+
+const AUDIT_REDACTED = "[REDACTED]"
+const AUDIT_DEFAULT_LIMIT = 100
+const AUDIT_MAX_LIMIT = 1000
+
+// Changes to these fields are recorded without their values
+var AUDIT_REDACTED_FIELDS = map[string]bool{
+    "password": true,
+    "salt": true,
+    "secret": true,
+}
+
+// Entries are only ever inserted; there is no endpoint to edit or remove them
+type AuditEntry struct {
+    Id           primitive.ObjectID     `bson:"_id"               json:"id"`
+    ActorId      string                 `bson:"actor_id"          json:"actorId"`
+    ActorIsSuper bool                   `bson:"actor_is_super"    json:"actorIsSuper"`
+    // The super user who really acted when impersonating the actor
+    ImpersonatorId string               `bson:"impersonator_id,omitempty" json:"impersonatorId,omitempty"`
+    Action       string                 `bson:"action"            json:"action"`
+    TargetType   string                 `bson:"target_type"       json:"targetType"`
+    TargetId     string                 `bson:"target_id"         json:"targetId"`
+    Changes      map[string]AuditChange `bson:"changes,omitempty" json:"changes,omitempty"`
+    Ip           string                 `bson:"ip"                json:"ip"`
+    UserAgent    string                 `bson:"user_agent"        json:"userAgent"`
+    Time         time.Time              `bson:"time"              json:"time"`
+}
+
+type AuditChange struct {
+    Before interface{} `bson:"before" json:"before"`
+    After  interface{} `bson:"after"  json:"after"`
+}
+
+// Who did something and from where, captured from the request so it can be
+// passed on to code running outside of the handler (e.g. socket messages)
+type AuditActor struct {
+    UserId    string
+    IsSuper   bool
+    ImpersonatorId string
+    Ip        string
+    UserAgent string
+}
+
+func (handler *AuditHandler) GetAuditLog(c echo.Context) error {
+    filter := bson.M{}
+    for param, field := range map[string]string{
+        "actor": "actor_id",
+        "impersonator": "impersonator_id",
+        "action": "action",
+        "target_type": "target_type",
+    } {
+        if value := c.QueryParam(param); value != "" {
+            filter[field] = value
+        }
+    }
+    // Table data entries are keyed by table:year:month, so a table ID also
+    // matches the changes made to its months
+    if targetId := c.QueryParam("target_id"); targetId != "" {
+        filter["target_id"] = bson.M{ "$regex": "^" + regexp.QuoteMeta(targetId) + "(:|$)" }
+    }
+
+    timeRange := bson.M{}
+    if from := c.QueryParam("from"); from != "" {
+        t, err := time.Parse(time.RFC3339, from)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Invalid from time, expected RFC3339" })
+        }
+        timeRange["$gte"] = t
+    }
+    if to := c.QueryParam("to"); to != "" {
+        t, err := time.Parse(time.RFC3339, to)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Invalid to time, expected RFC3339" })
+        }
+        timeRange["$lt"] = t
+    }
+    if len(timeRange) > 0 {
+        filter["time"] = timeRange
+    }
+
+    limit := int64(AUDIT_DEFAULT_LIMIT)
+    if l, err := strconv.ParseInt(c.QueryParam("limit"), 10, 64); err == nil && l > 0 {
+        if l < AUDIT_MAX_LIMIT {
+            limit = l
+        } else {
+            limit = AUDIT_MAX_LIMIT
+        }
+    }
+    var skip int64
+    if s, err := strconv.ParseInt(c.QueryParam("skip"), 10, 64); err == nil && s > 0 {
+        skip = s
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_AUDIT)
+
+    opts := options.Find().SetSort(bson.M{ "time": -1 }).SetLimit(limit).SetSkip(skip)
+    cur, err := coll.Find(ctx, filter, opts)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    result := make([]AuditEntry, 0)
+    if err := cur.All(ctx, &result); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: result,
+    })
+}
+
+func newAuditActor(c echo.Context) AuditActor {
+    actor := AuditActor{
+        Ip: c.RealIP(),
+        UserAgent: c.Request().UserAgent(),
+    }
+    if _, ok := c.Get("user").(*jwt.Token); ok {
+        claims := GetJwtClaims(c)
+        actor.UserId = claims.UserId
+        actor.IsSuper = claims.IsSuper
+        actor.ImpersonatorId = claims.ImpersonatorId
+    }
+    return actor
+}
+
+// Records a mutation done in a handler. Before and after are the target's
+// state as the API shows it (nil when created or deleted); only the fields
+// that differ are kept. Failures are logged and never fail the request.
+func recordAudit(c echo.Context, conns *HandlerConns, action string, targetType string, targetId string, before interface{}, after interface{}) {
+    if err := insertAudit(conns, newAuditActor(c), action, targetType, targetId, before, after); err != nil {
+        c.Logger().Error(err)
+    }
+}
+
+func insertAudit(conns *HandlerConns, actor AuditActor, action string, targetType string, targetId string, before interface{}, after interface{}) error {
+    changes, err := auditDiff(before, after)
+    if err != nil {
+        return err
+    }
+
+    entry := AuditEntry{
+        Id: primitive.NewObjectID(),
+        ActorId: actor.UserId,
+        ActorIsSuper: actor.IsSuper,
+        ImpersonatorId: actor.ImpersonatorId,
+        Action: action,
+        TargetType: targetType,
+        TargetId: targetId,
+        Changes: changes,
+        Ip: actor.Ip,
+        UserAgent: actor.UserAgent,
+        Time: time.Now(),
+    }
+
+    _, err = conns.Db.Collection(COLL_NAME_AUDIT).InsertOne(context.Background(), entry)
+    return err
+}
+
+func auditDiff(before interface{}, after interface{}) (map[string]AuditChange, error) {
+    beforeDoc, err := toAuditDoc(before)
+    if err != nil {
+        return nil, err
+    }
+    afterDoc, err := toAuditDoc(after)
+    if err != nil {
+        return nil, err
+    }
+
+    changes := make(map[string]AuditChange)
+    for key, value := range beforeDoc {
+        if other, ok := afterDoc[key]; !ok || !reflect.DeepEqual(value, other) {
+            changes[key] = AuditChange{ Before: value, After: other }
+        }
+    }
+    for key, value := range afterDoc {
+        if _, ok := beforeDoc[key]; !ok {
+            changes[key] = AuditChange{ Before: nil, After: value }
+        }
+    }
+
+    for key := range changes {
+        if AUDIT_REDACTED_FIELDS[key] {
+            changes[key] = AuditChange{ Before: AUDIT_REDACTED, After: AUDIT_REDACTED }
+        }
+    }
+
+    return changes, nil
+}
+
+// Goes through JSON so field names match what the API returns
+func toAuditDoc(value interface{}) (map[string]interface{}, error) {
+    doc := make(map[string]interface{})
+    if value == nil {
+        return doc, nil
+    }
+
+    payload, err := json.Marshal(value)
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(payload, &doc); err != nil {
+        return nil, err
+    }
+
+    // Secrets are left out of JSON, but a change to them is still worth
+    // recording, e.g. a new password. auditDiff hides their values.
+    v := reflect.Indirect(reflect.ValueOf(value))
+    if v.Kind() == reflect.Struct {
+        for i := 0; i < v.NumField(); i++ {
+            field := v.Type().Field(i)
+            if name := strings.Split(field.Tag.Get("bson"), ",")[0]; AUDIT_REDACTED_FIELDS[name] && field.Tag.Get(REDACT_TAG) == "true" {
+                doc[name] = v.Field(i).Interface()
+            }
+        }
+    }
+    return doc, nil
+}
@@ -46,7 +46,7 @@ func (handler *ChartHandler) GetChart(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
-    isAllowed, err := handler.checkChartPerm(chart, userId)
+    isAllowed, err := handler.checkChartPerm(chart, userId, claims.Scope)
     if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
@@ -83,9 +83,9 @@ func (handler *ChartHandler) GetAllChart(c echo.Context) error {
             return handleMongoErr(c, err)
         }
 
-        c.Logger().Debug("Looking at chart: ", chart)
+        c.Logger().Debug("Looking at chart: ", Redact(chart))
 
-        isAllowed, err := handler.checkChartPerm(chart, userId)
+        isAllowed, err := handler.checkChartPerm(chart, userId, claims.Scope)
         if err != nil {
             c.Logger().Error(err)
             return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
@@ -110,6 +110,12 @@ func (handler *ChartHandler) CreateChart(c echo.Context) error {
         return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
     }
 
+    if message, err := validateResourcePermKey(handler.HandlerConns, body.PermKey); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+
     body.Id = primitive.NewObjectID()
 
     ctx := context.Background()
@@ -124,6 +130,11 @@ func (handler *ChartHandler) CreateChart(c echo.Context) error {
     message := fmt.Sprintf("Chart '%s' created", body.Title)
     c.Logger().Info(message)
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_CHART, body.Id.Hex(), nil, body)
+
+    claims := GetJwtClaims(c)
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_CHART, Action: EVENT_ACTION_CREATE, Id: body.Id, UserId: claims.UserId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: message,
@@ -143,7 +154,12 @@ func (handler *ChartHandler) EditChart(c echo.Context) error {
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART)
 
-    isAllowed, err := handler.fetchCheckChartPerm(body.Id, userId)
+    var before Chart
+    if err := coll.FindOne(ctx, bson.M{ "_id": body.Id }).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    isAllowed, err := handler.checkChartPerm(before, userId, claims.Scope)
     if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
@@ -153,6 +169,12 @@ func (handler *ChartHandler) EditChart(c echo.Context) error {
         return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission to view this table" })
     }
 
+    if message, err := validateResourcePermKey(handler.HandlerConns, body.PermKey); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+
     filter := bson.M{ "_id": body.Id }
 
     res, err := coll.ReplaceOne(ctx, filter, body)
@@ -162,6 +184,10 @@ func (handler *ChartHandler) EditChart(c echo.Context) error {
 
     c.Logger().Info("Chart edited:", res)
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_CHART, body.Id.Hex(), before, body)
+
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_CHART, Action: EVENT_ACTION_UPDATE, Id: body.Id, UserId: userId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: "Edited",
@@ -181,7 +207,12 @@ func (handler *ChartHandler) DeleteChart(c echo.Context) error {
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART)
 
-    isAllowed, err := handler.fetchCheckChartPerm(id, userId)
+    var before Chart
+    if err := coll.FindOne(ctx, bson.M{ "_id": id }).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    isAllowed, err := handler.checkChartPerm(before, userId, claims.Scope)
     if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
@@ -195,15 +226,23 @@ func (handler *ChartHandler) DeleteChart(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_DELETE, AUDIT_TARGET_CHART, id.Hex(), before, nil)
+
+    if err := deleteTargetComments(handler.HandlerConns.Db, COMMENT_TARGET_CHART, id); err != nil {
+        c.Logger().Error(err)
+    }
+
     c.Logger().Infof("Chart %s deleted", id)
 
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_CHART, Action: EVENT_ACTION_DELETE, Id: id, UserId: userId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: "Successfully deleted chart",
     })
 }
 
-func (handler *ChartHandler) fetchCheckChartPerm(id primitive.ObjectID, userId string) (bool, error) {
+func (handler *ChartHandler) fetchCheckChartPerm(id primitive.ObjectID, userId string, scope []string) (bool, error) {
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART)
 
@@ -215,13 +254,13 @@ func (handler *ChartHandler) fetchCheckChartPerm(id primitive.ObjectID, userId s
         return false, err
     }
     
-    return handler.checkChartPerm(chart, userId)
+    return handler.checkChartPerm(chart, userId, scope)
 }
 
-func (handler *ChartHandler) checkChartPerm(chart Chart, userId string) (bool, error) {
+func (handler *ChartHandler) checkChartPerm(chart Chart, userId string, scope []string) (bool, error) {
     if chart.PermKey == "" {
         return true, nil
     }
-    return checkPerm(handler.HandlerConns, userId, chart.PermKey)
+    return checkPerm(handler.HandlerConns, userId, scope, chart.PermKey)
 }
 
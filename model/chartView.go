@@ -18,22 +18,88 @@ type ChartView struct {
     Id       primitive.ObjectID   `bson:"_id"      json:"id"`
     Name     string               `bson:"name"     json:"name"`
     ChartIds []primitive.ObjectID `bson:"chart_id" json:"chartId"`
+    // Decides ChartIds when set, see normalizeChartViewLayout
+    Layout   *ChartViewLayout     `bson:"layout,omitempty" json:"layout,omitempty"`
+    // Drive every chart at once, see GetChartViewData
+    Filters  *ChartViewFilters    `bson:"filters,omitempty" json:"filters,omitempty"`
+
+    // Views from before owners were recorded have neither of these, and are
+    // treated as public
+    OwnerId    string `bson:"owner_id,omitempty"   json:"ownerId"    validate:"omitempty,hexadecimal,len=24"`
+    Visibility string `bson:"visibility,omitempty" json:"visibility" validate:"omitempty,oneof=private shared public"`
+    // Needed by everyone but the owner, whatever the visibility
+    PermKey    string           `bson:"perm_key,omitempty" json:"permKey"`
+    Shares     []ChartViewShare `bson:"shares,omitempty"   json:"shares" validate:"dive"`
 }
 
+// Shares a view with a user, or with everyone holding a permission key, which
+// is how identity provider groups reach the dashboard
+type ChartViewShare struct {
+    UserId  string `bson:"user_id,omitempty" json:"userId,omitempty" validate:"required_without=Key,omitempty,hexadecimal,len=24"`
+    Key     string `bson:"key,omitempty"     json:"key,omitempty"    validate:"required_without=UserId"`
+    CanEdit bool   `bson:"can_edit"          json:"canEdit"`
+}
+
+// A view with the charts the user can see, laid out
+type LoadedChartView struct {
+    ChartView
+    Charts []Chart `json:"charts"`
+    // Charts deleted since they were put in the view
+    MissingChartIds []primitive.ObjectID `json:"missingChartIds"`
+}
+
+const (
+    // Only the owner
+    CHART_VIEW_PRIVATE = "private"
+    // The owner and whoever the view is shared with
+    CHART_VIEW_SHARED = "shared"
+    // Every user, shares only give the right to edit
+    CHART_VIEW_PUBLIC = "public"
+)
+
+// Views the user can open
 func (handler *ChartViewHandler) GetChartViewList(c echo.Context) error {
+    claims := GetJwtClaims(c)
+
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART_VIEW)
 
-    cur, err := coll.Find(ctx, bson.M{})
+    // Visibility narrows down the views, shares by key and permission keys
+    // are checked below
+    filter := bson.M{
+        "$or": bson.A{
+            bson.M{ "owner_id": claims.UserId },
+            bson.M{ "visibility": bson.M{ "$in": bson.A{ CHART_VIEW_SHARED, CHART_VIEW_PUBLIC, nil } } },
+        },
+    }
+    cur, err := coll.Find(ctx, filter)
     if err != nil {
         return handleMongoErr(c, err)
     }
 
-    result := make([]ChartView, 0)
-    if err := cur.All(ctx, &result); err != nil {
+    views := make([]ChartView, 0)
+    if err := cur.All(ctx, &views); err != nil {
         return handleMongoErr(c, err)
     }
 
+    checker := newPermChecker(handler.HandlerConns, claims.UserId, claims.Scope)
+    result := make([]ChartView, 0, len(views))
+    for _, view := range views {
+        isAllowed, err := checkChartViewPerm(checker, view)
+        if err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
+        }
+        if !isAllowed {
+            continue
+        }
+        if view, err = chartViewForUser(checker, view, claims.IsSuper); err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
+        }
+        result = append(result, view)
+    }
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: "Success",
@@ -61,32 +127,43 @@ func (handler *ChartViewHandler) LoadChartView(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
-    collChart := handler.HandlerConns.Db.Collection(COLL_NAME_CHART)
-
-    result := make([]Chart, 0, len(chartView.ChartIds))
-    for _, id := range chartView.ChartIds {
-        var chart Chart
-        if err := collChart.FindOne(ctx, bson.M{ "_id": id }).Decode(&chart); err != nil {
-            return handleMongoErr(c, err)
-        }
-
-        c.Logger().Debug("Looking at chart: ", chart)
+    checker := newPermChecker(handler.HandlerConns, userId, claims.Scope)
+    if isAllowed, err := checkChartViewPerm(checker, chartView); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
+    } else if !isAllowed {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission to view this chart view" })
+    }
+    if chartView, err = chartViewForUser(checker, chartView, claims.IsSuper); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
+    }
 
-        isAllowed, err := handler.checkChartPerm(chart, userId)
-        if err != nil {
-            c.Logger().Error(err)
-            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
-        }
+    result, missing, err := handler.fetchViewCharts(chartView.ChartIds, userId, claims.Scope)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error loading charts" })
+    }
+    if len(missing) > 0 {
+        c.Logger().Warnf("Chart view %s has missing charts %v", id.Hex(), missing)
+    }
 
-        if isAllowed {
-            result = append(result, chart)
-        }
+    layout := chartView.Layout
+    if layout == nil {
+        layout = defaultChartViewLayout(chartView.ChartIds)
+    }
+    visible := make(map[primitive.ObjectID]bool)
+    chartView.ChartIds = make([]primitive.ObjectID, len(result))
+    for i, chart := range result {
+        visible[chart.Id] = true
+        chartView.ChartIds[i] = chart.Id
     }
+    chartView.Layout = filterChartViewLayout(layout, visible)
 
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: "Success",
-        Data: result,
+        Data: LoadedChartView{ ChartView: chartView, Charts: result, MissingChartIds: missing },
     })
 }
 
@@ -97,7 +174,26 @@ func (handler *ChartViewHandler) CreateChartView(c echo.Context) error {
         return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
     }
 
+    if message, err := validateChartViewSharing(handler.HandlerConns, body); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+    if message, err := normalizeChartViewLayout(handler.HandlerConns, body); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+    if message := validateChartViewFilters(body); message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+
+    claims := GetJwtClaims(c)
     body.Id = primitive.NewObjectID()
+    body.OwnerId = claims.UserId
+    if body.Visibility == "" {
+        body.Visibility = CHART_VIEW_PRIVATE
+    }
 
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART_VIEW)
@@ -111,9 +207,14 @@ func (handler *ChartViewHandler) CreateChartView(c echo.Context) error {
     message := fmt.Sprintf("ChartView '%s' created", body.Id)
     c.Logger().Info(message)
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_CHART_VIEW, body.Id.Hex(), nil, body)
+
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_CHART_VIEW, Action: EVENT_ACTION_CREATE, Id: body.Id, UserId: claims.UserId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: message,
+        Data: body,
     })
 }
 
@@ -124,17 +225,88 @@ func (handler *ChartViewHandler) EditChartView(c echo.Context) error {
         return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
     }
 
+    claims := GetJwtClaims(c)
+
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART_VIEW)
 
-    filter := bson.M{ "_id": body.Id }
+    var before ChartView
+    if err := coll.FindOne(ctx, bson.M{ "_id": body.Id }).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
 
-    res, err := coll.ReplaceOne(ctx, filter, body)
+    checker := newPermChecker(handler.HandlerConns, claims.UserId, claims.Scope)
+    if isAllowed, err := checkChartViewEdit(checker, before, claims.IsSuper); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
+    } else if !isAllowed {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission to edit this chart view" })
+    }
+
+    // Only the owner and super users decide who else gets the view
+    if before.OwnerId == claims.UserId || claims.IsSuper {
+        if body.OwnerId == "" {
+            body.OwnerId = before.OwnerId
+        }
+        if body.Visibility == "" {
+            body.Visibility = before.Visibility
+        }
+        if message, err := validateChartViewSharing(handler.HandlerConns, body); err != nil {
+            return handleMongoErr(c, err)
+        } else if message != "" {
+            return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+        }
+    } else {
+        body.OwnerId = before.OwnerId
+        body.Visibility = before.Visibility
+        body.PermKey = before.PermKey
+        body.Shares = before.Shares
+    }
+
+    // Editors were only given the charts they can see, the others are kept
+    visible, missing, err := handler.fetchViewCharts(before.ChartIds, claims.UserId, claims.Scope)
     if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error loading charts" })
+    }
+    hidden := make(map[primitive.ObjectID]bool)
+    for _, id := range before.ChartIds {
+        hidden[id] = true
+    }
+    for _, chart := range visible {
+        delete(hidden, chart.Id)
+    }
+    for _, id := range missing {
+        delete(hidden, id)
+    }
+    mergeHiddenChartViewItems(body, before, hidden)
+
+    if message, err := normalizeChartViewLayout(handler.HandlerConns, body); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+    if message := validateChartViewFilters(body); message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+
+    // Replaces only what was checked, in case the view changed meanwhile
+    filter := bson.M{ "_id": body.Id, "owner_id": before.OwnerId, "visibility": before.Visibility }
+    if before.OwnerId == "" {
+        filter["owner_id"] = nil
+    }
+    if before.Visibility == "" {
+        filter["visibility"] = nil
+    }
+    if err := coll.FindOneAndReplace(ctx, filter, body).Err(); err != nil {
         return handleMongoErr(c, err)
     }
 
-    c.Logger().Info("Chart edited:", res)
+    c.Logger().Info("Chart view edited: ", body.Id.Hex())
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_CHART_VIEW, body.Id.Hex(), before, body)
+
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_CHART_VIEW, Action: EVENT_ACTION_UPDATE, Id: body.Id, UserId: claims.UserId })
 
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
@@ -149,25 +321,188 @@ func (handler *ChartViewHandler) DeleteChartView(c echo.Context) error {
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
     }
 
+    claims := GetJwtClaims(c)
+
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART_VIEW)
 
+    var before ChartView
+    if err := coll.FindOne(ctx, bson.M{"_id": id }).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    checker := newPermChecker(handler.HandlerConns, claims.UserId, claims.Scope)
+    if isAllowed, err := checkChartViewDelete(checker, before, claims.IsSuper); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
+    } else if !isAllowed {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Only the owner can delete this chart view" })
+    }
+
     if _, err := coll.DeleteOne(ctx, bson.M{"_id": id }); err != nil {
         return handleMongoErr(c, err)
     }
 
     c.Logger().Infof("ChartView %s deleted", id)
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_DELETE, AUDIT_TARGET_CHART_VIEW, id.Hex(), before, nil)
+
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_CHART_VIEW, Action: EVENT_ACTION_DELETE, Id: id, UserId: claims.UserId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: "Successfully deleted chart view",
     })
 }
 
-func (handler *ChartViewHandler) checkChartPerm(chart Chart, userId string) (bool, error) {
-    if chart.PermKey == "" {
+// The charts the user may see in view order, and those no longer existing
+func (handler *ChartViewHandler) fetchViewCharts(chartIds []primitive.ObjectID, userId string, scope []string) ([]Chart, []primitive.ObjectID, error) {
+    // Views saved without charts have no chart_id, which $in refuses as null
+    if len(chartIds) == 0 {
+        return make([]Chart, 0), make([]primitive.ObjectID, 0), nil
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART)
+
+    cur, err := coll.Find(ctx, bson.M{ "_id": bson.M{ "$in": chartIds } })
+    if err != nil {
+        return nil, nil, err
+    }
+    charts := make([]Chart, 0, len(chartIds))
+    if err := cur.All(ctx, &charts); err != nil {
+        return nil, nil, err
+    }
+
+    byId := make(map[primitive.ObjectID]Chart)
+    keys := make([]string, 0)
+    for _, chart := range charts {
+        byId[chart.Id] = chart
+        if chart.PermKey != "" {
+            keys = append(keys, chart.PermKey)
+        }
+    }
+
+    perms, err := checkPerms(handler.HandlerConns, userId, scope, keys)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    result := make([]Chart, 0, len(chartIds))
+    missing := make([]primitive.ObjectID, 0)
+    for _, id := range chartIds {
+        chart, ok := byId[id]
+        if !ok {
+            missing = append(missing, id)
+        } else if chart.PermKey == "" || perms[chart.PermKey] {
+            result = append(result, chart)
+        }
+    }
+    return result, missing, nil
+}
+
+
+// Whether the checker's user may open the view. The owner always can;
+// everyone else needs the view's permission key before visibility decides.
+func checkChartViewPerm(checker *permChecker, view ChartView) (bool, error) {
+    if view.OwnerId != "" && view.OwnerId == checker.userId {
         return true, nil
     }
-    return checkPerm(handler.HandlerConns, userId, chart.PermKey)
+
+    if view.PermKey != "" {
+        if perm, err := checker.check(view.PermKey); err != nil || !perm {
+            return false, err
+        }
+    }
+
+    switch view.Visibility {
+    case "", CHART_VIEW_PUBLIC:
+        return true, nil
+    case CHART_VIEW_SHARED:
+        share, err := chartViewShare(checker, view)
+        return share != nil, err
+    }
+    return false, nil
+}
+
+// The owner can edit the view and super users any view they can open, so
+// not others' private ones. Everyone else needs a share allowing it. Views
+// without an owner are left to super users.
+func checkChartViewEdit(checker *permChecker, view ChartView, isSuper bool) (bool, error) {
+    if view.OwnerId != "" && view.OwnerId == checker.userId {
+        return true, nil
+    }
+    if isSuper {
+        return checkChartViewPerm(checker, view)
+    }
+    if view.Visibility == "" || view.Visibility == CHART_VIEW_PRIVATE {
+        return false, nil
+    }
+
+    if view.PermKey != "" {
+        if perm, err := checker.check(view.PermKey); err != nil || !perm {
+            return false, err
+        }
+    }
+
+    share, err := chartViewShare(checker, view)
+    return share != nil && share.CanEdit, err
 }
 
+// As for editing, but a share allowing edits does not allow deleting
+func checkChartViewDelete(checker *permChecker, view ChartView, isSuper bool) (bool, error) {
+    if view.OwnerId != "" && view.OwnerId == checker.userId {
+        return true, nil
+    }
+    if isSuper {
+        return checkChartViewPerm(checker, view)
+    }
+    return false, nil
+}
+
+// The view as the user may see it. Who it is shared with is only shown to
+// those who can edit it.
+func chartViewForUser(checker *permChecker, view ChartView, isSuper bool) (ChartView, error) {
+    canEdit, err := checkChartViewEdit(checker, view, isSuper)
+    if err != nil {
+        return view, err
+    }
+    if !canEdit {
+        view.PermKey = ""
+        view.Shares = make([]ChartViewShare, 0)
+    }
+    return view, nil
+}
+
+// The share reaching the user, preferring one that allows editing
+func chartViewShare(checker *permChecker, view ChartView) (*ChartViewShare, error) {
+    var found *ChartViewShare
+    for i := range view.Shares {
+        share := &view.Shares[i]
+        matches := share.UserId != "" && share.UserId == checker.userId
+        if !matches && share.Key != "" {
+            perm, err := checker.check(share.Key)
+            if err != nil {
+                return nil, err
+            }
+            matches = perm
+        }
+
+        if matches && share.CanEdit {
+            return share, nil
+        }
+        if matches && found == nil {
+            found = share
+        }
+    }
+    return found, nil
+}
+
+func validateChartViewSharing(conns *HandlerConns, view *ChartView) (string, error) {
+    for _, share := range view.Shares {
+        if share.Key != "" && !PERM_KEY_PATTERN.MatchString(share.Key) {
+            return "Invalid permission key " + share.Key, nil
+        }
+    }
+    return validateResourcePermKey(conns, view.PermKey)
+}
@@ -0,0 +1,310 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Filters applied to every chart of a view, except those listed in
+// IgnoreChartIds or whose layout item opts out
+type ChartViewFilters struct {
+    Period         *ChartViewPeriodRange  `bson:"period,omitempty"           json:"period,omitempty"`
+    Fields         []ChartViewFieldFilter `bson:"fields,omitempty"           json:"fields"           validate:"dive"`
+    IgnoreChartIds []primitive.ObjectID   `bson:"ignore_chart_ids,omitempty" json:"ignoreChartIds,omitempty"`
+}
+
+// Keeps rows whose field is any of the values, e.g. branch = North. Charts
+// whose table has no such field are not filtered by it.
+type ChartViewFieldFilter struct {
+    Field  string        `bson:"field"  json:"field"  validate:"required"`
+    Values []interface{} `bson:"values" json:"values" validate:"required,min=1"`
+}
+
+// The rows a chart is drawn from, with the filters that picked them
+type ChartData struct {
+    ChartId primitive.ObjectID     `json:"chartId"`
+    Period  *ChartViewPeriodRange  `json:"period,omitempty"`
+    Fields  []ChartViewFieldFilter `json:"fields"`
+    Rows    []ChartDataRow         `json:"rows"`
+    // The user cannot read the chart's table, so it has no rows
+    TableDenied bool `json:"tableDenied,omitempty"`
+}
+
+type ChartDataRow struct {
+    Year  string                 `json:"year"`
+    Month string                 `json:"month"`
+    Row   map[string]interface{} `json:"row"`
+}
+
+type ChartViewData struct {
+    Filters         ChartViewFilters     `json:"filters"`
+    Charts          []ChartData          `json:"charts"`
+    MissingChartIds []primitive.ObjectID `json:"missingChartIds"`
+}
+
+// Rows of every chart the user can see in the view, filtered the same way.
+// period_from and period_to replace the view's period for this request, so
+// one picker can drive the whole view. Either may be left out for a range
+// open at that end.
+func (handler *ChartViewHandler) GetChartViewData(c echo.Context) error {
+    claims := GetJwtClaims(c)
+
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    var view ChartView
+    if err := handler.HandlerConns.Db.Collection(COLL_NAME_CHART_VIEW).FindOne(context.Background(), bson.M{ "_id": id }).Decode(&view); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    if isAllowed, err := checkChartViewPerm(newPermChecker(handler.HandlerConns, claims.UserId, claims.Scope), view); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
+    } else if !isAllowed {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission to view this chart view" })
+    }
+
+    filters := ChartViewFilters{ Fields: make([]ChartViewFieldFilter, 0) }
+    if view.Filters != nil {
+        filters = *view.Filters
+    }
+    from, to := c.QueryParam("period_from"), c.QueryParam("period_to")
+    if from != "" || to != "" {
+        period := ChartViewPeriodRange{ From: from, To: to }
+        if message := validatePeriodRange(period); message != "" {
+            return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+        }
+        filters.Period = &period
+    }
+
+    charts, missing, err := handler.fetchViewCharts(view.ChartIds, claims.UserId, claims.Scope)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error loading charts" })
+    }
+
+    data, err := handler.chartViewData(view, filters, charts, claims.UserId, claims.Scope)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: ChartViewData{ Filters: filters, Charts: data, MissingChartIds: missing },
+    })
+}
+
+// Reads the tables behind the charts once, then filters their rows per chart.
+// Charts of tables the user cannot read get no rows.
+func (handler *ChartViewHandler) chartViewData(view ChartView, filters ChartViewFilters, charts []Chart, userId string, scope []string) ([]ChartData, error) {
+    ctx := context.Background()
+
+    items := make(map[primitive.ObjectID]ChartViewItem)
+    if view.Layout != nil {
+        for _, item := range view.Layout.Items {
+            items[item.ChartId] = item
+        }
+    }
+
+    ignored := make(map[primitive.ObjectID]bool)
+    for _, chartId := range filters.IgnoreChartIds {
+        ignored[chartId] = true
+    }
+
+    result := make([]ChartData, len(charts))
+    tableIds := make([]primitive.ObjectID, 0, len(charts))
+    for i, chart := range charts {
+        result[i] = chartDataFilters(chart, items[chart.Id], filters, ignored[chart.Id])
+        tableIds = append(tableIds, chart.TableId)
+    }
+
+    opts := options.Find().SetProjection(bson.M{ "_id": 1, "perm_key": 1, "data": 1 })
+    cur, err := handler.HandlerConns.Db.Collection(COLL_NAME_TABLE).Find(ctx, bson.M{ "_id": bson.M{ "$in": tableIds } }, opts)
+    if err != nil {
+        return nil, err
+    }
+    tables := make([]Table, 0, len(tableIds))
+    if err := cur.All(ctx, &tables); err != nil {
+        return nil, err
+    }
+
+    keys := make([]string, 0)
+    for _, table := range tables {
+        if table.PermKey != "" {
+            keys = append(keys, table.PermKey)
+        }
+    }
+    perms, err := checkPerms(handler.HandlerConns, userId, scope, keys)
+    if err != nil {
+        return nil, err
+    }
+
+    tablesById := make(map[primitive.ObjectID]*Table)
+    denied := make(map[primitive.ObjectID]bool)
+    for i := range tables {
+        if tables[i].PermKey != "" && !perms[tables[i].PermKey] {
+            denied[tables[i].Id] = true
+            continue
+        }
+        tablesById[tables[i].Id] = &tables[i]
+    }
+    for i, chart := range charts {
+        result[i].TableDenied = denied[chart.TableId]
+    }
+
+    // Only the periods some chart asks for are read
+    periods := make(map[primitive.ObjectID]tablePeriod)
+    for i, chart := range charts {
+        table, ok := tablesById[chart.TableId]
+        if !ok {
+            continue
+        }
+        for year, yearIds := range table.Data {
+            for month, dataId := range yearIds {
+                if periodInRange(year, month, result[i].Period) {
+                    periods[dataId] = tablePeriod{ table: table, year: year, month: month }
+                }
+            }
+        }
+    }
+
+    dataIds := make([]primitive.ObjectID, 0, len(periods))
+    for dataId := range periods {
+        dataIds = append(dataIds, dataId)
+    }
+    cur, err = handler.HandlerConns.Db.Collection(COLL_NAME_TABLE_DATA).Find(ctx, bson.M{ "_id": bson.M{ "$in": dataIds } })
+    if err != nil {
+        return nil, err
+    }
+    tableData := make([]TableData, 0, len(dataIds))
+    if err := cur.All(ctx, &tableData); err != nil {
+        return nil, err
+    }
+
+    // Oldest period first, as charts plot them
+    sort.Slice(tableData, func(i, j int) bool {
+        a, b := periods[tableData[i].Id], periods[tableData[j].Id]
+        return periodKey(a.year, a.month) < periodKey(b.year, b.month)
+    })
+
+    for i, chart := range charts {
+        rows := make([]ChartDataRow, 0)
+        for _, data := range tableData {
+            period := periods[data.Id]
+            if period.table.Id != chart.TableId || !periodInRange(period.year, period.month, result[i].Period) {
+                continue
+            }
+            for _, row := range data.Rows {
+                rows = append(rows, ChartDataRow{ Year: period.year, Month: period.month, Row: row })
+            }
+        }
+
+        fields := rowFieldNames(rows)
+        for _, row := range rows {
+            if rowMatchesFilters(row.Row, result[i].Fields, fields) {
+                result[i].Rows = append(result[i].Rows, row)
+            }
+        }
+    }
+
+    return result, nil
+}
+
+func validateChartViewFilters(view *ChartView) string {
+    if view.Filters != nil && view.Filters.Period != nil {
+        if message := validatePeriodRange(*view.Filters.Period); message != "" {
+            return "View filter: " + message
+        }
+    }
+    return ""
+}
+
+// The filters a chart gets. Charts opting out, through their layout item or
+// the view's list, keep only their own period override; the others take the
+// view's period over their own.
+func chartDataFilters(chart Chart, item ChartViewItem, filters ChartViewFilters, ignored bool) ChartData {
+    data := ChartData{ ChartId: chart.Id, Fields: make([]ChartViewFieldFilter, 0), Rows: make([]ChartDataRow, 0) }
+
+    if item.Overrides != nil {
+        data.Period = item.Overrides.Period
+    }
+    if item.IgnoreFilters || ignored {
+        return data
+    }
+
+    if filters.Period != nil {
+        data.Period = filters.Period
+    }
+    data.Fields = append(data.Fields, filters.Fields...)
+    return data
+}
+
+func rowMatchesFilters(row map[string]interface{}, filters []ChartViewFieldFilter, fields map[string]bool) bool {
+    for _, filter := range filters {
+        if !fields[filter.Field] {
+            continue
+        }
+
+        // Cells keep whatever type the frontend saved, so compare as text
+        value := fmt.Sprint(row[filter.Field])
+        matches := false
+        for _, wanted := range filter.Values {
+            if fmt.Sprint(wanted) == value {
+                matches = true
+                break
+            }
+        }
+        if !matches {
+            return false
+        }
+    }
+    return true
+}
+
+// Fields used by any of the rows, as tables do not declare their field names
+func rowFieldNames(rows []ChartDataRow) map[string]bool {
+    names := make(map[string]bool)
+    for _, row := range rows {
+        for name := range row.Row {
+            names[name] = true
+        }
+    }
+    return names
+}
+
+// The period as YYYY-MM, or "" when the table period is not numeric
+func periodKey(year string, month string) string {
+    y, err := strconv.Atoi(year)
+    if err != nil {
+        return ""
+    }
+    m, err := strconv.Atoi(month)
+    if err != nil || m < 1 || m > 12 {
+        return ""
+    }
+    return fmt.Sprintf("%04d-%02d", y, m)
+}
+
+// Periods that cannot be read as a date only pass without a range. A range
+// without From or To is open at that end.
+func periodInRange(year string, month string, period *ChartViewPeriodRange) bool {
+    if period == nil {
+        return true
+    }
+    key := periodKey(year, month)
+    if key == "" {
+        return false
+    }
+    return (period.From == "" || key >= period.From) && (period.To == "" || key <= period.To)
+}
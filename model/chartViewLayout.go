@@ -0,0 +1,264 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How a view arranges its charts, on a grid CHART_VIEW_GRID_COLUMNS wide
+type ChartViewLayout struct {
+    // Sections are shown one at a time as tabs, otherwise one under another
+    Tabs     bool               `bson:"tabs"               json:"tabs"`
+    Sections []ChartViewSection `bson:"sections,omitempty" json:"sections" validate:"dive"`
+    Items    []ChartViewItem    `bson:"items"              json:"items"    validate:"dive"`
+}
+
+type ChartViewSection struct {
+    Id    string `bson:"id"    json:"id"    validate:"required"`
+    Title string `bson:"title" json:"title" validate:"required"`
+}
+
+// Where a chart sits, in grid cells from the top left of its section
+type ChartViewItem struct {
+    ChartId   primitive.ObjectID  `bson:"chart_id"             json:"chartId"             validate:"required"`
+    SectionId string              `bson:"section_id,omitempty" json:"sectionId,omitempty"`
+    X         int                 `bson:"x"                    json:"x"                   validate:"min=0"`
+    Y         int                 `bson:"y"                    json:"y"                   validate:"min=0"`
+    W         int                 `bson:"w"                    json:"w"                   validate:"min=1"`
+    H         int                 `bson:"h"                    json:"h"                   validate:"min=1"`
+    Overrides *ChartViewOverrides `bson:"overrides,omitempty"  json:"overrides,omitempty"`
+    // Leaves the chart out of the view's filters
+    IgnoreFilters bool            `bson:"ignore_filters,omitempty" json:"ignoreFilters"`
+}
+
+// Replaces the chart's own settings within this view only
+type ChartViewOverrides struct {
+    Title   string                `bson:"title,omitempty"   json:"title,omitempty"`
+    Period  *ChartViewPeriodRange `bson:"period,omitempty"  json:"period,omitempty"`
+    Palette []string              `bson:"palette,omitempty" json:"palette,omitempty" validate:"omitempty,max=32,dive,hexcolor"`
+}
+
+// Periods as YYYY-MM, both ends included. Either end may be left out, but
+// not both.
+type ChartViewPeriodRange struct {
+    From string `bson:"from,omitempty" json:"from,omitempty"`
+    To   string `bson:"to,omitempty"   json:"to,omitempty"`
+}
+
+const CHART_VIEW_GRID_COLUMNS = 12
+const CHART_VIEW_MAX_ROWS = 1000
+
+// Size of the charts in a generated layout, two to a row
+const CHART_VIEW_DEFAULT_WIDTH = 6
+const CHART_VIEW_DEFAULT_HEIGHT = 4
+
+var CHART_VIEW_PERIOD_PATTERN = regexp.MustCompile(`^[0-9]{4}-(0[1-9]|1[0-2])$`)
+
+// Checks the layout fits the grid, then sets ChartIds to the existing charts
+// placed, in layout order: by section, then top to bottom, left to right.
+// Returns a message for the user when the layout is invalid.
+func normalizeChartViewLayout(conns *HandlerConns, view *ChartView) (string, error) {
+    layout := view.Layout
+    if layout == nil {
+        return "", nil
+    }
+
+    sectionOrder := make(map[string]int)
+    for i, section := range layout.Sections {
+        if _, ok := sectionOrder[section.Id]; ok {
+            return "Duplicate section " + section.Id, nil
+        }
+        sectionOrder[section.Id] = i
+    }
+    if layout.Tabs && len(layout.Sections) == 0 {
+        return "Tabs need at least one section", nil
+    }
+
+    seen := make(map[primitive.ObjectID]bool)
+    for _, item := range layout.Items {
+        if seen[item.ChartId] {
+            return "Chart " + item.ChartId.Hex() + " is in the layout more than once", nil
+        }
+        seen[item.ChartId] = true
+
+        if len(layout.Sections) > 0 {
+            if _, ok := sectionOrder[item.SectionId]; !ok {
+                return fmt.Sprintf("Chart %s is in unknown section '%s'", item.ChartId.Hex(), item.SectionId), nil
+            }
+        } else if item.SectionId != "" {
+            return "Chart " + item.ChartId.Hex() + " is in a section, but the layout has none", nil
+        }
+
+        if item.X + item.W > CHART_VIEW_GRID_COLUMNS {
+            return fmt.Sprintf("Chart %s does not fit in %d columns", item.ChartId.Hex(), CHART_VIEW_GRID_COLUMNS), nil
+        }
+        if item.Y + item.H > CHART_VIEW_MAX_ROWS {
+            return fmt.Sprintf("Chart %s goes past row %d", item.ChartId.Hex(), CHART_VIEW_MAX_ROWS), nil
+        }
+
+        if item.Overrides != nil && item.Overrides.Period != nil {
+            if message := validatePeriodRange(*item.Overrides.Period); message != "" {
+                return "Chart " + item.ChartId.Hex() + ": " + message, nil
+            }
+        }
+    }
+
+    for i, item := range layout.Items {
+        for _, other := range layout.Items[i + 1:] {
+            if item.SectionId == other.SectionId && chartViewItemsOverlap(item, other) {
+                return "Charts " + item.ChartId.Hex() + " and " + other.ChartId.Hex() + " overlap", nil
+            }
+        }
+    }
+
+    // Charts deleted since the view was loaded are dropped, as loading the
+    // view would skip them anyway
+    ids := make([]primitive.ObjectID, 0, len(seen))
+    for id := range seen {
+        ids = append(ids, id)
+    }
+    found, err := conns.Db.Collection(COLL_NAME_CHART).Distinct(context.Background(), "_id", bson.M{ "_id": bson.M{ "$in": ids } })
+    if err != nil {
+        return "", err
+    }
+    exists := make(map[primitive.ObjectID]bool)
+    for _, value := range found {
+        if id, ok := value.(primitive.ObjectID); ok {
+            exists[id] = true
+        }
+    }
+    *layout = *filterChartViewLayout(layout, exists)
+
+    sort.SliceStable(layout.Items, func(i, j int) bool {
+        a, b := layout.Items[i], layout.Items[j]
+        if sectionOrder[a.SectionId] != sectionOrder[b.SectionId] {
+            return sectionOrder[a.SectionId] < sectionOrder[b.SectionId]
+        }
+        if a.Y != b.Y {
+            return a.Y < b.Y
+        }
+        return a.X < b.X
+    })
+
+    view.ChartIds = make([]primitive.ObjectID, len(layout.Items))
+    for i, item := range layout.Items {
+        view.ChartIds[i] = item.ChartId
+    }
+    return "", nil
+}
+
+func chartViewItemsOverlap(a ChartViewItem, b ChartViewItem) bool {
+    return a.X < b.X + b.W && b.X < a.X + a.W && a.Y < b.Y + b.H && b.Y < a.Y + a.H
+}
+
+func validatePeriodRange(period ChartViewPeriodRange) string {
+    if period.From == "" && period.To == "" {
+        return "period range needs a start or an end"
+    }
+    if (period.From != "" && !CHART_VIEW_PERIOD_PATTERN.MatchString(period.From)) || (period.To != "" && !CHART_VIEW_PERIOD_PATTERN.MatchString(period.To)) {
+        return "periods must be written as YYYY-MM"
+    }
+    // Zero padded, so they compare as strings
+    if period.From != "" && period.To != "" && period.From > period.To {
+        return "period range ends before it starts"
+    }
+    return ""
+}
+
+// Lays the charts out two to a row, for views saved without a layout
+func defaultChartViewLayout(chartIds []primitive.ObjectID) *ChartViewLayout {
+    perRow := CHART_VIEW_GRID_COLUMNS / CHART_VIEW_DEFAULT_WIDTH
+
+    layout := &ChartViewLayout{ Sections: make([]ChartViewSection, 0), Items: make([]ChartViewItem, len(chartIds)) }
+    for i, id := range chartIds {
+        layout.Items[i] = ChartViewItem{
+            ChartId: id,
+            X: (i % perRow) * CHART_VIEW_DEFAULT_WIDTH,
+            Y: (i / perRow) * CHART_VIEW_DEFAULT_HEIGHT,
+            W: CHART_VIEW_DEFAULT_WIDTH,
+            H: CHART_VIEW_DEFAULT_HEIGHT,
+        }
+    }
+    return layout
+}
+
+// The layout with only the given charts, so it does not give away charts
+// the user cannot see
+func filterChartViewLayout(layout *ChartViewLayout, visible map[primitive.ObjectID]bool) *ChartViewLayout {
+    filtered := *layout
+    filtered.Items = make([]ChartViewItem, 0, len(layout.Items))
+    for _, item := range layout.Items {
+        if visible[item.ChartId] {
+            filtered.Items = append(filtered.Items, item)
+        }
+    }
+    return &filtered
+}
+
+// Puts the stored view's hidden charts back into the edited one, as the
+// editor could not see them to keep them. Those whose section is gone go to
+// the first section, and those whose spot was taken go below the others.
+func mergeHiddenChartViewItems(view *ChartView, before ChartView, hidden map[primitive.ObjectID]bool) {
+    if len(hidden) == 0 {
+        return
+    }
+
+    present := make(map[primitive.ObjectID]bool)
+    for _, id := range view.ChartIds {
+        present[id] = true
+    }
+    if view.Layout == nil {
+        for _, id := range before.ChartIds {
+            if hidden[id] && !present[id] {
+                view.ChartIds = append(view.ChartIds, id)
+            }
+        }
+        return
+    }
+
+    layout := view.Layout
+    for _, item := range layout.Items {
+        present[item.ChartId] = true
+    }
+    sections := make(map[string]bool)
+    for _, section := range layout.Sections {
+        sections[section.Id] = true
+    }
+
+    stored := before.Layout
+    if stored == nil {
+        stored = defaultChartViewLayout(before.ChartIds)
+    }
+    for _, item := range stored.Items {
+        if !hidden[item.ChartId] || present[item.ChartId] {
+            continue
+        }
+
+        if len(layout.Sections) == 0 {
+            item.SectionId = ""
+        } else if !sections[item.SectionId] {
+            item.SectionId = layout.Sections[0].Id
+        }
+
+        bottom, overlaps := 0, false
+        for _, other := range layout.Items {
+            if other.SectionId != item.SectionId {
+                continue
+            }
+            overlaps = overlaps || chartViewItemsOverlap(item, other)
+            if other.Y + other.H > bottom {
+                bottom = other.Y + other.H
+            }
+        }
+        if overlaps {
+            item.Y = bottom
+        }
+
+        layout.Items = append(layout.Items, item)
+    }
+}
@@ -0,0 +1,410 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/websocket"
+)
+
+type CollabHandler struct {
+    *HandlerConns
+}
+
+const (
+    COLLAB_CHANNEL_PREFIX = "ec:collab:"
+    COLLAB_PRESENCE_PREFIX = "ec:collab:presence:"
+    COLLAB_PRESENCE_TTL = 1 * time.Hour
+    // Presence entries not refreshed within this time are treated as gone,
+    // e.g. when the instance holding the connection crashed
+    COLLAB_PRESENCE_TIMEOUT = 5 * time.Minute
+    COLLAB_SEND_BUFFER = 64
+)
+
+const (
+    COLLAB_MSG_JOIN = "join"
+    COLLAB_MSG_LEAVE = "leave"
+    COLLAB_MSG_SNAPSHOT = "snapshot"
+    COLLAB_MSG_PRESENCE = "presence"
+    COLLAB_MSG_ROW_UPDATE = "row_update"
+    COLLAB_MSG_ROW_INSERT = "row_insert"
+    COLLAB_MSG_RELOAD = "reload"
+    COLLAB_MSG_ERROR = "error"
+)
+
+type CollabCell struct {
+    RowIndex int    `json:"rowIndex"`
+    Field    string `json:"field"`
+}
+
+type CollabPresence struct {
+    ClientId string      `json:"clientId"`
+    UserId   string      `json:"userId"`
+    Cell     *CollabCell `json:"cell,omitempty"`
+    Editing  bool        `json:"editing"`
+    LastSeen time.Time   `json:"lastSeen"`
+}
+
+// Envelope for every message going through the socket and Redis. ClientId is
+// the connection that caused the message, so it is not echoed back to it.
+type CollabMessage struct {
+    Type     string                 `json:"type"`
+    ClientId string                 `json:"clientId,omitempty"`
+    UserId   string                 `json:"userId,omitempty"`
+    Cell     *CollabCell            `json:"cell,omitempty"`
+    Editing  bool                   `json:"editing,omitempty"`
+    RowIndex *int                   `json:"rowIndex,omitempty"`
+    Row      map[string]interface{} `json:"row,omitempty"`
+    Presence []CollabPresence       `json:"presence,omitempty"`
+    Message  string                 `json:"message,omitempty"`
+}
+
+type collabClient struct {
+    id     string
+    userId string
+    send   chan []byte
+}
+
+type collabRoom struct {
+    clients map[*collabClient]bool
+    pubsub  *redis.PubSub
+}
+
+// Connections are tracked per instance; Redis pub/sub fans messages out to
+// the other instances holding connections to the same room
+type collabHub struct {
+    mutex sync.Mutex
+    rooms map[string]*collabRoom
+}
+
+var hub = &collabHub{ rooms: make(map[string]*collabRoom) }
+
+func (handler *CollabHandler) TableSocket(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    year := c.Param("year")
+    month := c.Param("month")
+
+    tableHandler := TableHandler{ HandlerConns: handler.HandlerConns }
+    if perm, err := tableHandler.fetchCheckTablePerm(id, userId, claims.Scope); err != nil {
+        return handleMongoErr(c, err)
+    } else if !perm {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission" })
+    }
+
+    room := collabRoomKey(id, year, month)
+    actor := newAuditActor(c)
+    client := &collabClient{
+        id: primitive.NewObjectID().Hex(),
+        userId: userId,
+        send: make(chan []byte, COLLAB_SEND_BUFFER),
+    }
+
+    // Only pages of this app may open the socket, see checkWebSocketOrigin
+    server := websocket.Server{ Handshake: checkWebSocketOrigin }
+    server.Handler = func(ws *websocket.Conn) {
+        defer ws.Close()
+
+        hub.join(handler.HandlerConns.Redis, room, client)
+        defer func() {
+            hub.leave(room, client)
+            handler.removePresence(room, client)
+            handler.publish(room, CollabMessage{ Type: COLLAB_MSG_LEAVE, ClientId: client.id, UserId: userId })
+        }()
+
+        go func() {
+            for payload := range client.send {
+                if err := websocket.Message.Send(ws, string(payload)); err != nil {
+                    ws.Close()
+                    return
+                }
+            }
+        }()
+
+        if err := handler.setPresence(room, CollabPresence{ ClientId: client.id, UserId: userId }); err != nil {
+            c.Logger().Error(err)
+        }
+        handler.publish(room, CollabMessage{ Type: COLLAB_MSG_JOIN, ClientId: client.id, UserId: userId })
+
+        presence, err := handler.getPresence(room)
+        if err != nil {
+            c.Logger().Error(err)
+        }
+        client.write(CollabMessage{ Type: COLLAB_MSG_SNAPSHOT, ClientId: client.id, Presence: presence })
+
+        c.Logger().Infof("User %s joined table %s (%s/%s)", userId, id.Hex(), year, month)
+
+        for {
+            var msg CollabMessage
+            if err := websocket.JSON.Receive(ws, &msg); err != nil {
+                break
+            }
+
+            msg.ClientId = client.id
+            msg.UserId = userId
+
+            if err := handler.handleMessage(id, year, month, room, actor, claims.Scope, msg); err != nil {
+                c.Logger().Error(err)
+                client.write(CollabMessage{ Type: COLLAB_MSG_ERROR, Message: err.Error() })
+            }
+        }
+
+        c.Logger().Infof("User %s left table %s (%s/%s)", userId, id.Hex(), year, month)
+    }
+    server.ServeHTTP(c.Response(), c.Request())
+
+    return nil
+}
+
+func (handler *CollabHandler) handleMessage(id primitive.ObjectID, year string, month string, room string, actor AuditActor, scope []string, msg CollabMessage) error {
+    switch msg.Type {
+    case COLLAB_MSG_PRESENCE:
+        presence := CollabPresence{
+            ClientId: msg.ClientId,
+            UserId: msg.UserId,
+            Cell: msg.Cell,
+            Editing: msg.Editing,
+        }
+        if err := handler.setPresence(room, presence); err != nil {
+            return err
+        }
+
+    case COLLAB_MSG_ROW_UPDATE, COLLAB_MSG_ROW_INSERT:
+        before, err := handler.saveRow(id, year, month, scope, msg)
+        if err != nil {
+            return err
+        }
+
+        // Only the row touched goes into the audit entry, not the whole month
+        field := "row"
+        if msg.Type == COLLAB_MSG_ROW_UPDATE {
+            field = "rows." + strconv.Itoa(*msg.RowIndex)
+        }
+        if err := insertAudit(handler.HandlerConns, actor, AUDIT_ACTION_UPDATE, AUDIT_TARGET_TABLE_DATA, room, bson.M{ field: before }, bson.M{ field: msg.Row }); err != nil {
+            log.Error(err)
+        }
+        publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_TABLE_DATA, Action: EVENT_ACTION_UPDATE, Id: id, Year: year, Month: month, UserId: msg.UserId })
+
+    default:
+        return fmt.Errorf("Unknown message type '%s'", msg.Type)
+    }
+
+    handler.publish(room, msg)
+    return nil
+}
+
+// Row changes are written one row at a time so that concurrent editors only
+// overwrite each other when they touch the same row
+func (handler *CollabHandler) saveRow(id primitive.ObjectID, year string, month string, scope []string, msg CollabMessage) (map[string]interface{}, error) {
+    if msg.Row == nil {
+        return nil, fmt.Errorf("Row is required")
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_TABLE)
+
+    var table Table
+    opt := options.FindOne().SetProjection(bson.M{ "perm_key": 1, "data": 1 })
+    if err := coll.FindOne(ctx, bson.M{ "_id": id }, opt).Decode(&table); err != nil {
+        return nil, err
+    }
+
+    tableHandler := TableHandler{ HandlerConns: handler.HandlerConns }
+    if perm, err := tableHandler.checkTablePerm(table, msg.UserId, scope); err != nil {
+        return nil, err
+    } else if !perm {
+        return nil, fmt.Errorf("No permission")
+    }
+
+    dataId, ok := table.Data[year][month]
+    if !ok {
+        return nil, fmt.Errorf("Table has no data for %s/%s yet, save it first", year, month)
+    }
+
+    dataColl := handler.HandlerConns.Db.Collection(COLL_NAME_TABLE_DATA)
+    filter := bson.M{ "_id": dataId }
+    var update bson.M
+
+    if msg.Type == COLLAB_MSG_ROW_INSERT {
+        update = bson.M{ "$push": bson.M{ "rows": msg.Row } }
+    } else {
+        if msg.RowIndex == nil || *msg.RowIndex < 0 {
+            return nil, fmt.Errorf("Row index is required")
+        }
+        field := "rows." + strconv.Itoa(*msg.RowIndex)
+        filter[field] = bson.M{ "$exists": true }
+        update = bson.M{ "$set": bson.M{ field: msg.Row } }
+    }
+
+    // The previous row is read back in the same round trip for the audit log
+    if msg.Type == COLLAB_MSG_ROW_UPDATE {
+        opts := options.FindOneAndUpdate().SetProjection(bson.M{ "rows": bson.M{ "$slice": []int{ *msg.RowIndex, 1 } } })
+
+        var data TableData
+        if err := dataColl.FindOneAndUpdate(ctx, filter, update, opts).Decode(&data); err == mongo.ErrNoDocuments {
+            return nil, fmt.Errorf("Row does not exist")
+        } else if err != nil {
+            return nil, err
+        }
+        if len(data.Rows) == 0 {
+            return nil, nil
+        }
+        return data.Rows[0], nil
+    }
+
+    res, err := dataColl.UpdateOne(ctx, filter, update)
+    if err != nil {
+        return nil, err
+    }
+    if res.MatchedCount == 0 {
+        return nil, fmt.Errorf("Row does not exist")
+    }
+
+    return nil, nil
+}
+
+func (handler *CollabHandler) publish(room string, msg CollabMessage) {
+    publishCollab(handler.HandlerConns.Redis, room, msg)
+}
+
+func (handler *CollabHandler) setPresence(room string, presence CollabPresence) error {
+    presence.LastSeen = time.Now()
+    payload, err := json.Marshal(presence)
+    if err != nil {
+        return err
+    }
+
+    ctx := context.Background()
+    key := COLLAB_PRESENCE_PREFIX + room
+
+    pipe := handler.HandlerConns.Redis.TxPipeline()
+    pipe.HSet(ctx, key, presence.ClientId, payload)
+    pipe.Expire(ctx, key, COLLAB_PRESENCE_TTL)
+    _, err = pipe.Exec(ctx)
+    return err
+}
+
+func (handler *CollabHandler) removePresence(room string, client *collabClient) {
+    handler.HandlerConns.Redis.HDel(context.Background(), COLLAB_PRESENCE_PREFIX + room, client.id)
+}
+
+func (handler *CollabHandler) getPresence(room string) ([]CollabPresence, error) {
+    entries, err := handler.HandlerConns.Redis.HGetAll(context.Background(), COLLAB_PRESENCE_PREFIX + room).Result()
+    if err != nil {
+        return nil, err
+    }
+
+    result := make([]CollabPresence, 0, len(entries))
+    for _, entry := range entries {
+        var presence CollabPresence
+        if err := json.Unmarshal([]byte(entry), &presence); err != nil {
+            continue
+        }
+        if time.Since(presence.LastSeen) > COLLAB_PRESENCE_TIMEOUT {
+            continue
+        }
+        result = append(result, presence)
+    }
+
+    return result, nil
+}
+
+func (hub *collabHub) join(rdb *redis.Client, room string, client *collabClient) {
+    hub.mutex.Lock()
+    defer hub.mutex.Unlock()
+
+    r, ok := hub.rooms[room]
+    if !ok {
+        r = &collabRoom{
+            clients: make(map[*collabClient]bool),
+            pubsub: rdb.Subscribe(context.Background(), COLLAB_CHANNEL_PREFIX + room),
+        }
+        hub.rooms[room] = r
+        go hub.relay(room, r)
+    }
+    r.clients[client] = true
+}
+
+func (hub *collabHub) leave(room string, client *collabClient) {
+    hub.mutex.Lock()
+    defer hub.mutex.Unlock()
+
+    r, ok := hub.rooms[room]
+    if !ok {
+        return
+    }
+
+    delete(r.clients, client)
+    close(client.send)
+
+    if len(r.clients) == 0 {
+        r.pubsub.Close()
+        delete(hub.rooms, room)
+    }
+}
+
+// Forwards messages published to the room by any instance to the local clients
+func (hub *collabHub) relay(room string, r *collabRoom) {
+    for redisMsg := range r.pubsub.Channel() {
+        var msg CollabMessage
+        if err := json.Unmarshal([]byte(redisMsg.Payload), &msg); err != nil {
+            continue
+        }
+
+        hub.mutex.Lock()
+        for client := range r.clients {
+            if client.id == msg.ClientId {
+                continue
+            }
+            client.writeRaw([]byte(redisMsg.Payload))
+        }
+        hub.mutex.Unlock()
+    }
+}
+
+func (client *collabClient) write(msg CollabMessage) {
+    payload, err := json.Marshal(msg)
+    if err != nil {
+        return
+    }
+    client.writeRaw(payload)
+}
+
+// Slow clients drop messages instead of blocking the whole room
+func (client *collabClient) writeRaw(payload []byte) {
+    select {
+    case client.send <- payload:
+    default:
+    }
+}
+
+func collabRoomKey(tableId primitive.ObjectID, year string, month string) string {
+    return tableId.Hex() + ":" + year + ":" + month
+}
+
+func publishCollab(rdb *redis.Client, room string, msg CollabMessage) {
+    payload, err := json.Marshal(msg)
+    if err != nil {
+        return
+    }
+    rdb.Publish(context.Background(), COLLAB_CHANNEL_PREFIX + room, payload)
+}
@@ -0,0 +1,499 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type CommentHandler struct {
+    *HandlerConns
+}
+
+const (
+    COMMENT_TARGET_TABLE = "table"
+    COMMENT_TARGET_CHART = "chart"
+)
+
+// A comment is attached to a chart, or to a table optionally narrowed down to
+// a period, a row and a field (cell)
+type CommentTarget struct {
+    Type  string             `bson:"type"             json:"type"  validate:"required,oneof=table chart"`
+    Id    primitive.ObjectID `bson:"id"               json:"id"    validate:"required"`
+    Year  string             `bson:"year,omitempty"   json:"year,omitempty"`
+    Month string             `bson:"month,omitempty"  json:"month,omitempty"`
+    RowId string             `bson:"row_id,omitempty" json:"rowId,omitempty"`
+    Field string             `bson:"field,omitempty"  json:"field,omitempty"`
+}
+
+type Comment struct {
+    Id         primitive.ObjectID  `bson:"_id"                   json:"id"`
+    Target     CommentTarget       `bson:"target"                json:"target"`
+    ParentId   *primitive.ObjectID `bson:"parent_id,omitempty"   json:"parentId,omitempty"`
+    AuthorId   string              `bson:"author_id"             json:"authorId"`
+    Body       string              `bson:"body"                  json:"body"`
+    Mentions   []string            `bson:"mentions"              json:"mentions"`
+    Resolved   bool                `bson:"resolved"              json:"resolved"`
+    ResolvedBy string              `bson:"resolved_by,omitempty" json:"resolvedBy,omitempty"`
+    ResolvedAt *time.Time          `bson:"resolved_at,omitempty" json:"resolvedAt,omitempty"`
+    CreatedAt  time.Time           `bson:"created_at"            json:"createdAt"`
+    UpdatedAt  time.Time           `bson:"updated_at"            json:"updatedAt"`
+}
+
+type CommentThread struct {
+    Comment
+    Replies []Comment `json:"replies"`
+}
+
+type CreateCommentBody struct {
+    Target   *CommentTarget `json:"target"`
+    ParentId string         `json:"parentId" validate:"omitempty,hexadecimal,len=24"`
+    Body     string         `json:"body"     validate:"required"`
+    Mentions []string       `json:"mentions" validate:"dive,hexadecimal,len=24"`
+}
+
+type EditCommentBody struct {
+    Body     string   `json:"body"     validate:"required"`
+    Mentions []string `json:"mentions" validate:"dive,hexadecimal,len=24"`
+}
+
+var COMMENT_SORT = bson.M{ "created_at": 1 }
+
+func (handler *CommentHandler) GetCommentList(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    id, err := primitive.ObjectIDFromHex(c.QueryParam("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    target := CommentTarget{
+        Type: c.QueryParam("type"),
+        Id: id,
+        Year: c.QueryParam("year"),
+        Month: c.QueryParam("month"),
+        RowId: c.QueryParam("row_id"),
+        Field: c.QueryParam("field"),
+    }
+    if err := c.Validate(&target); err != nil {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    if perm, err := handler.checkTargetPerm(target, userId, claims.Scope); err != nil {
+        return handleMongoErr(c, err)
+    } else if !perm {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission" })
+    }
+
+    // Narrower fields are only filtered on when given, so asking for a table
+    // returns comments on all of its cells
+    filter := bson.M{ "target.type": target.Type, "target.id": target.Id }
+    for key, value := range map[string]string{
+        "target.year": target.Year,
+        "target.month": target.Month,
+        "target.row_id": target.RowId,
+        "target.field": target.Field,
+    } {
+        if value != "" {
+            filter[key] = value
+        }
+    }
+    if c.QueryParam("resolved") == "false" {
+        filter["resolved"] = false
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_COMMENT)
+
+    opts := options.Find().SetSort(COMMENT_SORT)
+    cur, err := coll.Find(ctx, filter, opts)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    comments := make([]Comment, 0)
+    if err := cur.All(ctx, &comments); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: buildCommentThreads(comments),
+    })
+}
+
+func (handler *CommentHandler) GetMentionList(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_COMMENT)
+
+    opts := options.Find().SetSort(bson.M{ "created_at": -1 })
+    cur, err := coll.Find(ctx, bson.M{ "mentions": userId }, opts)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    defer cur.Close(ctx)
+
+    result := make([]Comment, 0)
+    for cur.Next(ctx) {
+        var comment Comment
+        if err := cur.Decode(&comment); err != nil {
+            return handleMongoErr(c, err)
+        }
+
+        // The user may have lost access since being mentioned
+        isAllowed, err := handler.checkTargetPerm(comment.Target, userId, claims.Scope)
+        if err != nil {
+            c.Logger().Error(err)
+            continue
+        }
+
+        if isAllowed {
+            result = append(result, comment)
+        }
+    }
+    if err := cur.Err(); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: result,
+    })
+}
+
+func (handler *CommentHandler) CreateComment(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    body := new(CreateCommentBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_COMMENT)
+
+    now := time.Now()
+    comment := Comment{
+        Id: primitive.NewObjectID(),
+        AuthorId: userId,
+        Body: body.Body,
+        Mentions: body.Mentions,
+        CreatedAt: now,
+        UpdatedAt: now,
+    }
+
+    if body.ParentId != "" {
+        // Replies live in the parent's thread, so they share its target
+        parentId, _ := primitive.ObjectIDFromHex(body.ParentId)
+
+        var parent Comment
+        if err := coll.FindOne(ctx, bson.M{ "_id": parentId }).Decode(&parent); err != nil {
+            return handleMongoErr(c, err)
+        }
+        if parent.ParentId != nil {
+            parentId = *parent.ParentId
+        }
+
+        comment.ParentId = &parentId
+        comment.Target = parent.Target
+    } else if body.Target != nil {
+        comment.Target = *body.Target
+    } else {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Either target or parent is required" })
+    }
+
+    if perm, err := handler.checkTargetPerm(comment.Target, userId, claims.Scope); err != nil {
+        return handleMongoErr(c, err)
+    } else if !perm {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission" })
+    }
+
+    if comment.Mentions == nil {
+        comment.Mentions = make([]string, 0)
+    }
+    if ok, err := handler.checkMentions(comment.Mentions); err != nil {
+        return handleMongoErr(c, err)
+    } else if !ok {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Mentioned user does not exist" })
+    }
+
+    if res, err := coll.InsertOne(ctx, comment); err != nil {
+        c.Logger().Info(res)
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Cannot save comment into DB" })
+    }
+
+    c.Logger().Infof("Comment %s created on %s %s", comment.Id.Hex(), comment.Target.Type, comment.Target.Id.Hex())
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_COMMENT, comment.Id.Hex(), nil, comment)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Comment created",
+        Data: comment,
+    })
+}
+
+func (handler *CommentHandler) EditComment(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    body := new(EditCommentBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    comment, err := handler.fetchCheckComment(c)
+    if err != nil || comment == nil {
+        return err
+    }
+
+    if comment.AuthorId != userId {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Only the author can edit a comment" })
+    }
+
+    if body.Mentions == nil {
+        body.Mentions = make([]string, 0)
+    }
+    if ok, err := handler.checkMentions(body.Mentions); err != nil {
+        return handleMongoErr(c, err)
+    } else if !ok {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Mentioned user does not exist" })
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_COMMENT)
+
+    update := bson.M{
+        "$set": bson.M{
+            "body": body.Body,
+            "mentions": body.Mentions,
+            "updated_at": time.Now(),
+        },
+    }
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+    var after Comment
+    if err := coll.FindOneAndUpdate(ctx, bson.M{ "_id": comment.Id }, update, opts).Decode(&after); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_COMMENT, comment.Id.Hex(), comment, after)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Edited",
+    })
+}
+
+func (handler *CommentHandler) ResolveComment(c echo.Context) error {
+    return handler.setResolved(c, true)
+}
+
+func (handler *CommentHandler) UnresolveComment(c echo.Context) error {
+    return handler.setResolved(c, false)
+}
+
+func (handler *CommentHandler) DeleteComment(c echo.Context) error {
+    claims := GetJwtClaims(c)
+
+    comment, err := handler.fetchCheckComment(c)
+    if err != nil || comment == nil {
+        return err
+    }
+
+    if comment.AuthorId != claims.UserId && !claims.IsSuper {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Only the author can delete a comment" })
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_COMMENT)
+
+    // Deleting the start of a thread removes its replies as well
+    filter := bson.M{
+        "$or": bson.A{
+            bson.M{ "_id": comment.Id },
+            bson.M{ "parent_id": comment.Id },
+        },
+    }
+    if _, err := coll.DeleteMany(ctx, filter); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    c.Logger().Infof("Comment %s deleted", comment.Id.Hex())
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_DELETE, AUDIT_TARGET_COMMENT, comment.Id.Hex(), comment, nil)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Successfully deleted comment",
+    })
+}
+
+func (handler *CommentHandler) setResolved(c echo.Context, resolved bool) error {
+    claims := GetJwtClaims(c)
+
+    comment, err := handler.fetchCheckComment(c)
+    if err != nil || comment == nil {
+        return err
+    }
+
+    if comment.ParentId != nil {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Only a thread can be resolved, not a reply" })
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_COMMENT)
+
+    var update bson.M
+    if resolved {
+        update = bson.M{
+            "$set": bson.M{
+                "resolved": true,
+                "resolved_by": claims.UserId,
+                "resolved_at": time.Now(),
+            },
+        }
+    } else {
+        update = bson.M{
+            "$set": bson.M{ "resolved": false },
+            "$unset": bson.M{ "resolved_by": "", "resolved_at": "" },
+        }
+    }
+
+    opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+    var after Comment
+    if err := coll.FindOneAndUpdate(ctx, bson.M{ "_id": comment.Id }, update, opts).Decode(&after); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_COMMENT, comment.Id.Hex(), comment, after)
+
+    message := "Comment unresolved"
+    if resolved {
+        message = "Comment resolved"
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: message,
+    })
+}
+
+// Looks up the comment in the path and checks the permission of its target.
+// A nil comment with nil error means a response has already been written.
+func (handler *CommentHandler) fetchCheckComment(c echo.Context) (*Comment, error) {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return nil, c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_COMMENT)
+
+    comment := new(Comment)
+    if err := coll.FindOne(ctx, bson.M{ "_id": id }).Decode(comment); err != nil {
+        return nil, handleMongoErr(c, err)
+    }
+
+    if perm, err := handler.checkTargetPerm(comment.Target, userId, claims.Scope); err != nil {
+        return nil, handleMongoErr(c, err)
+    } else if !perm {
+        return nil, c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission" })
+    }
+
+    return comment, nil
+}
+
+// Comments are visible to whoever can see the table or chart they are on
+func (handler *CommentHandler) checkTargetPerm(target CommentTarget, userId string, scope []string) (bool, error) {
+    switch target.Type {
+    case COMMENT_TARGET_TABLE:
+        tableHandler := TableHandler{ HandlerConns: handler.HandlerConns }
+        return tableHandler.fetchCheckTablePerm(target.Id, userId, scope)
+    case COMMENT_TARGET_CHART:
+        chartHandler := ChartHandler{ HandlerConns: handler.HandlerConns }
+        return chartHandler.fetchCheckChartPerm(target.Id, userId, scope)
+    }
+    return false, nil
+}
+
+func (handler *CommentHandler) checkMentions(userIds []string) (bool, error) {
+    if len(userIds) == 0 {
+        return true, nil
+    }
+
+    ids := make([]primitive.ObjectID, 0, len(userIds))
+    seen := make(map[string]bool)
+    for _, userId := range userIds {
+        if seen[userId] {
+            continue
+        }
+        seen[userId] = true
+
+        id, err := primitive.ObjectIDFromHex(userId)
+        if err != nil {
+            return false, nil
+        }
+        ids = append(ids, id)
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    count, err := coll.CountDocuments(context.Background(), bson.M{ "_id": bson.M{ "$in": ids } })
+    if err != nil {
+        return false, err
+    }
+
+    return count == int64(len(ids)), nil
+}
+
+// Removes every comment on a table or chart, used when the target is deleted
+func deleteTargetComments(db *mongo.Database, targetType string, targetId primitive.ObjectID) error {
+    coll := db.Collection(COLL_NAME_COMMENT)
+    _, err := coll.DeleteMany(context.Background(), bson.M{ "target.type": targetType, "target.id": targetId })
+    return err
+}
+
+func buildCommentThreads(comments []Comment) []CommentThread {
+    threads := make([]CommentThread, 0)
+    index := make(map[primitive.ObjectID]int)
+
+    for _, comment := range comments {
+        if comment.ParentId == nil {
+            index[comment.Id] = len(threads)
+            threads = append(threads, CommentThread{ Comment: comment, Replies: make([]Comment, 0) })
+        }
+    }
+
+    for _, comment := range comments {
+        if comment.ParentId == nil {
+            continue
+        }
+        if i, ok := index[*comment.ParentId]; ok {
+            threads[i].Replies = append(threads[i].Replies, comment)
+        }
+    }
+
+    return threads
+}
@@ -0,0 +1,312 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type EventHandler struct {
+    *HandlerConns
+}
+
+// Handlers publish to this channel whenever they change a document, which
+// works without a replica set unlike Mongo change streams
+const EVENT_CHANNEL = "ec:events"
+const EVENT_HEARTBEAT = 30 * time.Second
+
+const (
+    EVENT_TYPE_TABLE = "table"
+    EVENT_TYPE_TABLE_DATA = "table_data"
+    EVENT_TYPE_CHART = "chart"
+    EVENT_TYPE_CHART_VIEW = "chart_view"
+    EVENT_TYPE_USER = "user"
+    EVENT_TYPE_PERMISSION = "permission"
+)
+
+const (
+    EVENT_ACTION_CREATE = "create"
+    EVENT_ACTION_UPDATE = "update"
+    EVENT_ACTION_DELETE = "delete"
+    // Sent for a chart when the data of its table changed
+    EVENT_ACTION_DATA = "data"
+)
+
+// For table_data events Id is the table, with Year and Month the period saved.
+// For permission events Id is the user granted or revoked Key.
+type ChangeEvent struct {
+    Type   string             `json:"type"`
+    Action string             `json:"action"`
+    Id     primitive.ObjectID `json:"id"`
+    Year   string             `json:"year,omitempty"`
+    Month  string             `json:"month,omitempty"`
+    Key    string             `json:"key,omitempty"`
+    UserId string             `json:"userId,omitempty"`
+    Time   time.Time          `json:"time"`
+}
+
+type eventSubscription struct {
+    userId string
+    scope  []string
+    viewId *primitive.ObjectID
+    charts []primitive.ObjectID
+    tables []primitive.ObjectID
+
+    // Resolved from the above, holding only what the user may see
+    watchView   bool
+    watchCharts map[primitive.ObjectID]bool
+    watchTables map[primitive.ObjectID]bool
+    chartTables map[primitive.ObjectID][]primitive.ObjectID
+}
+
+func (handler *EventHandler) Subscribe(c echo.Context) error {
+    claims := GetJwtClaims(c)
+
+    sub := &eventSubscription{ userId: claims.UserId, scope: claims.Scope }
+
+    if viewId := c.QueryParam("chart_view"); viewId != "" {
+        id, err := primitive.ObjectIDFromHex(viewId)
+        if err != nil {
+            return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+        }
+        sub.viewId = &id
+    }
+
+    var err error
+    if sub.charts, err = parseObjectIdList(c.QueryParam("chart")); err != nil {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+    if sub.tables, err = parseObjectIdList(c.QueryParam("table")); err != nil {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    if sub.viewId == nil && len(sub.charts) == 0 && len(sub.tables) == 0 {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Nothing to subscribe to" })
+    }
+
+    if err := handler.resolve(sub); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    ctx := c.Request().Context()
+    pubsub := handler.HandlerConns.Redis.Subscribe(ctx, EVENT_CHANNEL)
+    defer pubsub.Close()
+
+    res := c.Response()
+    res.Header().Set(echo.HeaderContentType, "text/event-stream")
+    res.Header().Set(echo.HeaderCacheControl, "no-cache")
+    res.Header().Set(echo.HeaderConnection, "keep-alive")
+    res.WriteHeader(http.StatusOK)
+    res.Flush()
+
+    c.Logger().Infof("User %s subscribed to events", sub.userId)
+
+    ticker := time.NewTicker(EVENT_HEARTBEAT)
+    defer ticker.Stop()
+
+    events := pubsub.Channel()
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+
+        case <-ticker.C:
+            if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+                return nil
+            }
+            res.Flush()
+
+        case msg, ok := <-events:
+            if !ok {
+                return nil
+            }
+
+            var event ChangeEvent
+            if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+                continue
+            }
+
+            for _, out := range handler.filter(sub, event) {
+                if err := writeServerSentEvent(res, out); err != nil {
+                    return nil
+                }
+            }
+            res.Flush()
+        }
+    }
+}
+
+// Works out which events a subscriber gets, checking permissions again since
+// they may have changed after subscribing
+func (handler *EventHandler) filter(sub *eventSubscription, event ChangeEvent) []ChangeEvent {
+    result := make([]ChangeEvent, 0)
+
+    switch event.Type {
+    case EVENT_TYPE_CHART_VIEW:
+        if !sub.watchView || event.Id != *sub.viewId {
+            return result
+        }
+        if event.Action != EVENT_ACTION_DELETE {
+            // The view may now hold a different set of charts, or no longer
+            // be shared with the user
+            if err := handler.resolve(sub); err != nil || !sub.watchView {
+                return result
+            }
+        }
+        result = append(result, event)
+
+    case EVENT_TYPE_CHART:
+        if !sub.watchCharts[event.Id] {
+            return result
+        }
+        if event.Action != EVENT_ACTION_DELETE {
+            chartHandler := ChartHandler{ HandlerConns: handler.HandlerConns }
+            if perm, err := chartHandler.fetchCheckChartPerm(event.Id, sub.userId, sub.scope); err != nil || !perm {
+                return result
+            }
+        }
+        result = append(result, event)
+
+    case EVENT_TYPE_TABLE, EVENT_TYPE_TABLE_DATA:
+        if sub.watchTables[event.Id] && handler.checkTable(event, sub) {
+            result = append(result, event)
+        }
+
+        // Charts are only told their data changed, without exposing the table
+        // or who changed it
+        if event.Type == EVENT_TYPE_TABLE_DATA {
+            chartHandler := ChartHandler{ HandlerConns: handler.HandlerConns }
+            for _, chartId := range sub.chartTables[event.Id] {
+                if perm, err := chartHandler.fetchCheckChartPerm(chartId, sub.userId, sub.scope); err != nil || !perm {
+                    continue
+                }
+                result = append(result, ChangeEvent{
+                    Type: EVENT_TYPE_CHART,
+                    Action: EVENT_ACTION_DATA,
+                    Id: chartId,
+                    Year: event.Year,
+                    Month: event.Month,
+                    Time: event.Time,
+                })
+            }
+        }
+    }
+
+    return result
+}
+
+func (handler *EventHandler) checkTable(event ChangeEvent, sub *eventSubscription) bool {
+    if event.Action == EVENT_ACTION_DELETE {
+        return true
+    }
+    tableHandler := TableHandler{ HandlerConns: handler.HandlerConns }
+    perm, err := tableHandler.fetchCheckTablePerm(event.Id, sub.userId, sub.scope)
+    return err == nil && perm
+}
+
+func (handler *EventHandler) resolve(sub *eventSubscription) error {
+    ctx := context.Background()
+
+    sub.watchView = false
+    sub.watchCharts = make(map[primitive.ObjectID]bool)
+    sub.watchTables = make(map[primitive.ObjectID]bool)
+    sub.chartTables = make(map[primitive.ObjectID][]primitive.ObjectID)
+
+    chartIds := append(make([]primitive.ObjectID, 0), sub.charts...)
+
+    if sub.viewId != nil {
+        var chartView ChartView
+        coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART_VIEW)
+        if err := coll.FindOne(ctx, bson.M{ "_id": *sub.viewId }).Decode(&chartView); err != nil {
+            return err
+        }
+        if perm, err := checkChartViewPerm(newPermChecker(handler.HandlerConns, sub.userId, sub.scope), chartView); err != nil {
+            return err
+        } else if perm {
+            sub.watchView = true
+            chartIds = append(chartIds, chartView.ChartIds...)
+        }
+    }
+
+    if len(chartIds) > 0 {
+        coll := handler.HandlerConns.Db.Collection(COLL_NAME_CHART)
+        opts := options.Find().SetProjection(bson.M{ "_id": 1, "perm_key": 1, "table_id": 1 })
+        cur, err := coll.Find(ctx, bson.M{ "_id": bson.M{ "$in": chartIds } }, opts)
+        if err != nil {
+            return err
+        }
+
+        charts := make([]Chart, 0)
+        if err := cur.All(ctx, &charts); err != nil {
+            return err
+        }
+
+        chartHandler := ChartHandler{ HandlerConns: handler.HandlerConns }
+        for _, chart := range charts {
+            if perm, err := chartHandler.checkChartPerm(chart, sub.userId, sub.scope); err != nil {
+                return err
+            } else if perm {
+                sub.watchCharts[chart.Id] = true
+                sub.chartTables[chart.TableId] = append(sub.chartTables[chart.TableId], chart.Id)
+            }
+        }
+    }
+
+    tableHandler := TableHandler{ HandlerConns: handler.HandlerConns }
+    for _, tableId := range sub.tables {
+        if perm, err := tableHandler.fetchCheckTablePerm(tableId, sub.userId, sub.scope); err == mongo.ErrNoDocuments {
+            continue
+        } else if err != nil {
+            return err
+        } else if perm {
+            sub.watchTables[tableId] = true
+        }
+    }
+
+    return nil
+}
+
+func writeServerSentEvent(res *echo.Response, event ChangeEvent) error {
+    payload, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Type, payload)
+    return err
+}
+
+func publishEvent(rdb *redis.Client, event ChangeEvent) {
+    event.Time = time.Now()
+    payload, err := json.Marshal(event)
+    if err != nil {
+        return
+    }
+    rdb.Publish(context.Background(), EVENT_CHANNEL, payload)
+    enqueueWebhookEvent(rdb, payload)
+}
+
+func parseObjectIdList(param string) ([]primitive.ObjectID, error) {
+    ids := make([]primitive.ObjectID, 0)
+    if param == "" {
+        return ids, nil
+    }
+
+    for _, hex := range strings.Split(param, ",") {
+        id, err := primitive.ObjectIDFromHex(strings.TrimSpace(hex))
+        if err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    return ids, nil
+}
@@ -0,0 +1,406 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Tokens are stored under their hash so a Redis dump cannot be used to
+// accept an invitation or reset a password
+const ONE_TIME_TOKEN_PREFIX = "ec:token:"
+
+const (
+    TOKEN_KIND_INVITE = "invite"
+    TOKEN_KIND_RESET = "reset"
+    TOKEN_KIND_EMAIL = "email"
+)
+
+const (
+    INVITE_TOKEN_TTL = 72 * time.Hour
+    RESET_TOKEN_TTL = 1 * time.Hour
+    EMAIL_TOKEN_TTL = 24 * time.Hour
+    // Points at the user's latest reset token so older ones can be revoked
+    RESET_TOKEN_USER_PREFIX = "ec:token:reset:user:"
+)
+
+type InviteUserBody struct {
+    Email    string `json:"email"    validate:"required,email"`
+    Username string `json:"username" validate:"required"`
+    IsSuper  bool   `json:"is_super" validate:"boolean"`
+}
+
+type AcceptInviteBody struct {
+    Token    string `json:"token"    validate:"required"`
+    Password string `json:"password" validate:"required"`
+}
+
+type ForgotPasswordBody struct {
+    // Username or email
+    Username string `json:"username" validate:"required"`
+}
+
+type ResetPasswordBody struct {
+    Token    string `json:"token"    validate:"required"`
+    Password string `json:"password" validate:"required"`
+}
+
+type InviteToken struct {
+    Username  string `json:"username"`
+    Email     string `json:"email"`
+    IsSuper   bool   `json:"is_super"`
+    InvitedBy string `json:"invited_by"`
+}
+
+type resetToken struct {
+    UserId string `json:"user_id"`
+}
+
+type emailToken struct {
+    UserId string `json:"user_id"`
+    Email  string `json:"email"`
+}
+
+// Emails a link for the new user to set their own password
+func (handler *UserHandler) InviteUser(c echo.Context) error {
+    body := new(InviteUserBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+    if body.IsSuper && !claims.IsSuper {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Only super users can create super users" })
+    }
+
+    if exists, err := handler.usernameExists(body.Username); err != nil {
+        return handleMongoErr(c, err)
+    } else if exists {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Username exists" })
+    }
+
+    invite := InviteToken{
+        Username: body.Username,
+        Email: body.Email,
+        IsSuper: body.IsSuper,
+        InvitedBy: claims.UserId,
+    }
+    token, err := createOneTimeToken(handler.HandlerConns.Redis, TOKEN_KIND_INVITE, invite, INVITE_TOKEN_TTL)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    link := appLink("/invite", token)
+    text := fmt.Sprintf("You have been invited to the EC admin dashboard as %s.\n\nSet your password here within %s:\n%s\n", body.Username, INVITE_TOKEN_TTL, link)
+    if err := handler.HandlerConns.Mailer.Send(body.Email, "Your EC admin dashboard invitation", text); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error sending invitation email" })
+    }
+
+    c.Logger().Infof("User %s invited %s", claims.UserId, body.Username)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Invitation sent to " + body.Email })
+}
+
+// Lets the invitation page show who the account is for without using the token
+func (handler *UserHandler) GetInvite(c echo.Context) error {
+    var invite InviteToken
+    if err := peekOneTimeToken(handler.HandlerConns.Redis, TOKEN_KIND_INVITE, c.QueryParam("token"), &invite); err == redis.Nil {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Invitation is invalid or has expired" })
+    } else if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: InviteToken{ Username: invite.Username, Email: invite.Email },
+    })
+}
+
+func (handler *UserHandler) AcceptInvite(c echo.Context) error {
+    body := new(AcceptInviteBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    rdb := handler.HandlerConns.Redis
+
+    // Checked before using up the token, so a taken username can be fixed by
+    // inviting again and a weak password by choosing another
+    var invite InviteToken
+    if err := peekOneTimeToken(rdb, TOKEN_KIND_INVITE, body.Token, &invite); err == redis.Nil {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Invitation is invalid or has expired" })
+    } else if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    if exists, err := handler.usernameExists(invite.Username); err != nil {
+        return handleMongoErr(c, err)
+    } else if exists {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Username exists" })
+    }
+
+    user := &User{
+        Id: primitive.NewObjectID(),
+        Username: invite.Username,
+        Email: invite.Email,
+        // The invitation was sent to it
+        EmailVerified: true,
+        IsSuper: invite.IsSuper,
+        CreatedAt: time.Now(),
+    }
+
+    if err := setUserPassword(user, body.Password); err != nil {
+        return handlePasswordErr(c, err)
+    }
+
+    if err := useOneTimeToken(rdb, TOKEN_KIND_INVITE, body.Token, &invite); err == redis.Nil {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Invitation is invalid or has expired" })
+    } else if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    if res, err := coll.InsertOne(context.Background(), user); err != nil {
+        c.Logger().Info(res)
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Cannot save user into DB" })
+    }
+
+    c.Logger().Infof("User %s accepted invitation from %s", user.Username, invite.InvitedBy)
+
+    if err := insertAudit(handler.HandlerConns, AuditActor{ UserId: invite.InvitedBy, Ip: c.RealIP(), UserAgent: c.Request().UserAgent() }, AUDIT_ACTION_CREATE, AUDIT_TARGET_USER, user.Id.Hex(), nil, user); err != nil {
+        c.Logger().Error(err)
+    }
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_CREATE, Id: user.Id, UserId: invite.InvitedBy })
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "User " + user.Username + " created" })
+}
+
+// Always gives the same answer so it cannot be used to find accounts. The
+// email is sent in the background for the same reason.
+func (handler *UserHandler) ForgotPassword(c echo.Context) error {
+    body := new(ForgotPasswordBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    response := HttpResponseBody{ Success: true, Message: "If the account exists and has an email address, a reset link has been sent" }
+
+    filter := bson.M{
+        "$or": bson.A{ bson.M{ "username": body.Username }, bson.M{ "email": body.Username } },
+        "is_service": bson.M{ "$ne": true },
+    }
+    user := new(User)
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    if err := coll.FindOne(context.Background(), filter).Decode(user); err == mongo.ErrNoDocuments {
+        return c.JSON(http.StatusOK, response)
+    } else if err != nil {
+        return handleMongoErr(c, err)
+    }
+    if user.Email == "" {
+        return c.JSON(http.StatusOK, response)
+    }
+
+    logger := c.Logger()
+    go func() {
+        if err := handler.sendPasswordReset(user); err != nil {
+            logger.Error(err)
+        }
+    }()
+
+    return c.JSON(http.StatusOK, response)
+}
+
+// Lets a super user send a reset link instead of recreating the account
+func (handler *UserHandler) SendPasswordReset(c echo.Context) error {
+    user, err := handler.fetchUser(c.Param("id"))
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    if user.Email == "" {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "User has no email address" })
+    }
+    if user.IsService {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Service accounts have no password" })
+    }
+
+    if err := handler.sendPasswordReset(user); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error sending reset email" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Reset link sent to " + user.Email })
+}
+
+func (handler *UserHandler) ResetPassword(c echo.Context) error {
+    body := new(ResetPasswordBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    rdb := handler.HandlerConns.Redis
+
+    // Only used up once the password passes the policy, so a weak one can
+    // be fixed without asking for another link
+    var reset resetToken
+    if err := peekOneTimeToken(rdb, TOKEN_KIND_RESET, body.Token, &reset); err == redis.Nil {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Reset link is invalid or has expired" })
+    } else if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    user, err := handler.fetchUser(reset.UserId)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    before := *user
+
+    if err := setUserPassword(user, body.Password); err != nil {
+        return handlePasswordErr(c, err)
+    }
+
+    if err := useOneTimeToken(rdb, TOKEN_KIND_RESET, body.Token, &reset); err == redis.Nil {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Reset link is invalid or has expired" })
+    } else if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    update := bson.M{
+        "$set": bson.M{
+            "password": user.Password,
+            "salt": user.Salt,
+            "password_history": user.PasswordHistory,
+            "must_change_password": false,
+        },
+    }
+    if _, err := coll.UpdateByID(context.Background(), user.Id, update); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    rdb.Del(context.Background(), RESET_TOKEN_USER_PREFIX + reset.UserId)
+    if err := clearLoginFailures(rdb, user.Username); err != nil {
+        c.Logger().Error(err)
+    }
+    // Whoever knew the old password may still be logged in
+    if err := revokeUserSessions(rdb, user.Id.Hex()); err != nil {
+        c.Logger().Error(err)
+    }
+
+    c.Logger().Infof("User %s reset their password", user.Username)
+
+    if err := insertAudit(handler.HandlerConns, AuditActor{ UserId: user.Id.Hex(), Ip: c.RealIP(), UserAgent: c.Request().UserAgent() }, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, user.Id.Hex(), before, user); err != nil {
+        c.Logger().Error(err)
+    }
+    publishEvent(rdb, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_UPDATE, Id: user.Id, UserId: user.Id.Hex() })
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Password changed successfully" })
+}
+
+// Issues a reset token, revoking any earlier one, and emails the link
+func (handler *UserHandler) sendPasswordReset(user *User) error {
+    ctx := context.Background()
+    rdb := handler.HandlerConns.Redis
+    userKey := RESET_TOKEN_USER_PREFIX + user.Id.Hex()
+
+    token, err := createOneTimeToken(rdb, TOKEN_KIND_RESET, resetToken{ UserId: user.Id.Hex() }, RESET_TOKEN_TTL)
+    if err != nil {
+        return err
+    }
+
+    if previous, err := rdb.Get(ctx, userKey).Result(); err == nil {
+        rdb.Del(ctx, previous)
+    }
+    if err := rdb.Set(ctx, userKey, oneTimeTokenKey(TOKEN_KIND_RESET, token), RESET_TOKEN_TTL).Err(); err != nil {
+        return err
+    }
+
+    link := appLink("/reset_password", token)
+    text := fmt.Sprintf("A password reset was requested for %s.\n\nChoose a new password here within %s:\n%s\n\nIf this was not you, ignore this email.\n", user.Username, RESET_TOKEN_TTL, link)
+    return handler.HandlerConns.Mailer.Send(user.Email, "Reset your EC admin dashboard password", text)
+}
+
+func (handler *UserHandler) usernameExists(username string) (bool, error) {
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    if err := coll.FindOne(context.Background(), bson.M{ "username": username }).Err(); err == mongo.ErrNoDocuments {
+        return false, nil
+    } else if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+func createOneTimeToken(rdb *redis.Client, kind string, data interface{}, ttl time.Duration) (string, error) {
+    tokenBytes := make([]byte, 32)
+    if _, err := rand.Read(tokenBytes); err != nil {
+        return "", err
+    }
+    token := hex.EncodeToString(tokenBytes)
+
+    payload, err := json.Marshal(data)
+    if err != nil {
+        return "", err
+    }
+    if err := rdb.Set(context.Background(), oneTimeTokenKey(kind, token), payload, ttl).Err(); err != nil {
+        return "", err
+    }
+    return token, nil
+}
+
+// Reads the token's data without using it up, redis.Nil if it is not valid
+func peekOneTimeToken(rdb *redis.Client, kind string, token string, data interface{}) error {
+    if token == "" {
+        return redis.Nil
+    }
+    payload, err := rdb.Get(context.Background(), oneTimeTokenKey(kind, token)).Result()
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal([]byte(payload), data)
+}
+
+// Reads and deletes the token at once so it works only one time
+func useOneTimeToken(rdb *redis.Client, kind string, token string, data interface{}) error {
+    if token == "" {
+        return redis.Nil
+    }
+    payload, err := rdb.GetDel(context.Background(), oneTimeTokenKey(kind, token)).Result()
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal([]byte(payload), data)
+}
+
+func oneTimeTokenKey(kind string, token string) string {
+    hash, _ := sha256Hash([]byte(token))
+    return ONE_TIME_TOKEN_PREFIX + kind + ":" + hex.EncodeToString(hash)
+}
+
+// Link into the frontend at APP_URL
+func appLink(path string, token string) string {
+    return strings.TrimRight(os.Getenv("APP_URL"), "/") + path + "?token=" + url.QueryEscape(token)
+}
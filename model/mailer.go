@@ -0,0 +1,94 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// Sends plain text emails, e.g. invitations and password resets
+type Mailer interface {
+    Send(to string, subject string, body string) error
+}
+
+type SmtpMailer struct {
+    Host     string
+    Port     string
+    Username string
+    Password string
+    From     string
+}
+
+// Writes emails to the log instead of sending them, for development
+type LogMailer struct {
+    Logger echo.Logger
+}
+
+// Uses SMTP when SMTP_HOST is set, otherwise only logs
+func NewMailerFromEnv() Mailer {
+    host := os.Getenv("SMTP_HOST")
+    if host == "" {
+        return &LogMailer{ Logger: log.New("mailer") }
+    }
+
+    port := os.Getenv("SMTP_PORT")
+    if port == "" {
+        port = "587"
+    }
+
+    return &SmtpMailer{
+        Host: host,
+        Port: port,
+        Username: os.Getenv("SMTP_USERNAME"),
+        Password: os.Getenv("SMTP_PASSWORD"),
+        From: os.Getenv("SMTP_FROM"),
+    }
+}
+
+func (mailer *SmtpMailer) Send(to string, subject string, body string) error {
+    if err := checkMailHeader(to, subject); err != nil {
+        return err
+    }
+
+    var auth smtp.Auth
+    if mailer.Username != "" {
+        auth = smtp.PlainAuth("", mailer.Username, mailer.Password, mailer.Host)
+    }
+
+    message := strings.Join([]string{
+        "From: " + mailer.From,
+        "To: " + to,
+        "Subject: " + subject,
+        "Date: " + time.Now().Format(time.RFC1123Z),
+        "MIME-Version: 1.0",
+        "Content-Type: text/plain; charset=UTF-8",
+        "",
+        body,
+    }, "\r\n")
+
+    return smtp.SendMail(net.JoinHostPort(mailer.Host, mailer.Port), auth, mailer.From, []string{ to }, []byte(message))
+}
+
+func (mailer *LogMailer) Send(to string, subject string, body string) error {
+    if err := checkMailHeader(to, subject); err != nil {
+        return err
+    }
+    mailer.Logger.Infof("Email to %s: %s\n%s", to, subject, body)
+    return nil
+}
+
+// Header values come from users, so newlines would let them add headers
+func checkMailHeader(values ...string) error {
+    for _, value := range values {
+        if strings.ContainsAny(value, "\r\n") {
+            return fmt.Errorf("Invalid email header value")
+        }
+    }
+    return nil
+}
@@ -0,0 +1,722 @@
+package model
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type OidcHandler struct {
+    *HandlerConns
+}
+
+const (
+    OIDC_STATE_PREFIX = "ec:oidc:state:"
+    OIDC_STATE_TTL = 10 * time.Minute
+    // Holds a hash of the state, tying it to the browser that started the login
+    OIDC_STATE_COOKIE = "ec-oidc"
+    OIDC_HTTP_TIMEOUT = 10 * time.Second
+    // How often the provider's keys may be refetched for an unknown kid
+    OIDC_JWKS_REFRESH = time.Minute
+    DEFAULT_OIDC_SCOPES = "openid email profile"
+    DEFAULT_OIDC_GROUP_CLAIM = "groups"
+    // Query parameter carrying the 2FA challenge back to the frontend, see
+    // UserHandler.GetTwoFactorChallenge
+    OIDC_TWO_FACTOR_PARAM = "two_factor"
+)
+
+// Read from the environment, see oidcConfigFromEnv
+type OidcConfig struct {
+    Issuer       string
+    ClientId     string
+    ClientSecret string
+    RedirectUrl  string
+    Scopes       string
+    // Where the browser is sent after logging in
+    PostLoginUrl string
+    // Create users on their first sign in instead of only matching existing ones
+    JitProvision bool
+    GroupClaim   string
+    // IdP group to the permission keys its members get
+    GroupPerms   map[string][]string
+    SuperGroups  []string
+}
+
+type oidcDiscovery struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcJwk struct {
+    Kid string `json:"kid"`
+    Kty string `json:"kty"`
+    Crv string `json:"crv"`
+    N   string `json:"n"`
+    E   string `json:"e"`
+    X   string `json:"x"`
+    Y   string `json:"y"`
+}
+
+type oidcTokenResponse struct {
+    IdToken          string `json:"id_token"`
+    Error            string `json:"error"`
+    ErrorDescription string `json:"error_description"`
+}
+
+// Cached discovery document and signing keys of the configured provider
+type oidcProvider struct {
+    lock        sync.Mutex
+    discovery   *oidcDiscovery
+    keys        map[string]interface{}
+    keysFetched time.Time
+}
+
+var idp = &oidcProvider{}
+
+var oidcClient = &http.Client{ Timeout: OIDC_HTTP_TIMEOUT }
+
+// Redirects the browser to the identity provider. An optional "redirect" path
+// is kept for after logging in.
+func (handler *OidcHandler) Login(c echo.Context) error {
+    config, ok := oidcConfigFromEnv()
+    if !ok {
+        return c.JSON(http.StatusNotFound, HttpResponseBody{ Success: false, Message: "Single sign-on is not configured" })
+    }
+
+    discovery, err := idp.getDiscovery(config)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadGateway, HttpResponseBody{ Success: false, Message: "Cannot reach identity provider" })
+    }
+
+    state, err := randomUrlString(32)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    nonce, err := randomUrlString(32)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    verifier, err := randomUrlString(48)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    redirect := c.QueryParam("redirect")
+    // Only paths on our own site, so this cannot be used as an open redirect
+    if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+        redirect = ""
+    }
+
+    ctx := context.Background()
+    key := OIDC_STATE_PREFIX + state
+    pipe := handler.HandlerConns.Redis.TxPipeline()
+    pipe.HSet(ctx, key, map[string]interface{}{ "verifier": verifier, "nonce": nonce, "redirect": redirect })
+    pipe.Expire(ctx, key, OIDC_STATE_TTL)
+    if _, err := pipe.Exec(ctx); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    // Only the browser that started the login may finish it. Otherwise anyone
+    // could send a victim their own callback URL and sign them in as themselves.
+    c.SetCookie(&http.Cookie{
+        Name: OIDC_STATE_COOKIE,
+        Value: hashOidcState(state),
+        Path: "/",
+        MaxAge: int(OIDC_STATE_TTL / time.Second),
+        HttpOnly: true,
+        Secure: strings.HasPrefix(config.RedirectUrl, "https://"),
+        SameSite: http.SameSiteLaxMode,
+    })
+
+    challenge := sha256.Sum256([]byte(verifier))
+
+    query := url.Values{}
+    query.Set("response_type", "code")
+    query.Set("client_id", config.ClientId)
+    query.Set("redirect_uri", config.RedirectUrl)
+    query.Set("scope", config.Scopes)
+    query.Set("state", state)
+    query.Set("nonce", nonce)
+    query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+    query.Set("code_challenge_method", "S256")
+
+    authUrl := discovery.AuthorizationEndpoint
+    if strings.Contains(authUrl, "?") {
+        authUrl += "&" + query.Encode()
+    } else {
+        authUrl += "?" + query.Encode()
+    }
+
+    return c.Redirect(http.StatusFound, authUrl)
+}
+
+// The identity provider sends the browser back here with the code
+func (handler *OidcHandler) Callback(c echo.Context) error {
+    config, ok := oidcConfigFromEnv()
+    if !ok {
+        return c.JSON(http.StatusNotFound, HttpResponseBody{ Success: false, Message: "Single sign-on is not configured" })
+    }
+
+    if idpErr := c.QueryParam("error"); idpErr != "" {
+        c.Logger().Warnf("Identity provider returned %s: %s", idpErr, c.QueryParam("error_description"))
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Sign in was not completed" })
+    }
+
+    cookie, err := c.Cookie(OIDC_STATE_COOKIE)
+    c.SetCookie(&http.Cookie{ Name: OIDC_STATE_COOKIE, Value: "", Path: "/", MaxAge: -1 })
+    if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashOidcState(c.QueryParam("state")))) != 1 {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Invalid or expired sign in, please try again" })
+    }
+
+    ctx := context.Background()
+    rdb := handler.HandlerConns.Redis
+    key := OIDC_STATE_PREFIX + c.QueryParam("state")
+
+    // Read and delete together so the state can only be used once
+    pipe := rdb.TxPipeline()
+    stateCmd := pipe.HGetAll(ctx, key)
+    pipe.Del(ctx, key)
+    if _, err := pipe.Exec(ctx); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    state := stateCmd.Val()
+    if len(state) == 0 || c.QueryParam("code") == "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Invalid or expired sign in, please try again" })
+    }
+
+    idToken, err := exchangeOidcCode(config, c.QueryParam("code"), state["verifier"])
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Sign in was not completed" })
+    }
+
+    claims, err := idp.verifyIdToken(config, idToken, state["nonce"])
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Invalid identity token" })
+    }
+
+    user, err := handler.resolveUser(c, config, claims)
+    if err == mongo.ErrNoDocuments {
+        return c.JSON(http.StatusForbidden, HttpResponseBody{ Success: false, Message: "No account for this identity, ask a super user to create one" })
+    } else if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    if user.Disabled {
+        return c.JSON(http.StatusForbidden, HttpResponseBody{ Success: false, Message: "Account is disabled" })
+    }
+
+    target := config.PostLoginUrl
+    if redirect := state["redirect"]; redirect != "" {
+        target = strings.TrimRight(target, "/") + redirect
+    }
+
+    // Signing in through the provider does not skip 2FA. The frontend asks
+    // for the code and finishes the login with POST /login/2fa, which is
+    // also when the groups are synced, so the provider's credential alone
+    // cannot change anyone's privileges.
+    groups := oidcGroups(claims, config.GroupClaim)
+    if user.TotpEnabled || (oidcIsSuper(config, user, groups) && superRequiresTotp()) {
+        encoded, err := json.Marshal(groups)
+        if err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+        }
+        // The challenge ID goes into a URL, so the login is also bound to
+        // this browser by a cookie
+        fields, err := bindTwoFactorChallenge(c)
+        if err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+        }
+        fields[TOTP_CHALLENGE_OIDC_GROUPS] = string(encoded)
+        challenge, err := createTwoFactorChallenge(handler.HandlerConns, user, fields)
+        if err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+        }
+        return c.Redirect(http.StatusFound, withQueryParam(target, OIDC_TWO_FACTOR_PARAM, challenge.Challenge))
+    }
+
+    if err := syncOidcGroups(c, handler.HandlerConns, config, user, groups); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    if _, err := issueLoginToken(c, handler.HandlerConns, user); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error generating JWT token" })
+    }
+    if err := recordLogin(handler.HandlerConns, user); err != nil {
+        c.Logger().Error(err)
+    }
+
+    return c.Redirect(http.StatusFound, target)
+}
+
+func withQueryParam(target string, name string, value string) string {
+    separator := "?"
+    if strings.Contains(target, "?") {
+        separator = "&"
+    }
+    return target + separator + url.QueryEscape(name) + "=" + url.QueryEscape(value)
+}
+
+// Finds the user by IdP subject, then by verified email (linking the two),
+// creating one if just-in-time provisioning is on
+func (handler *OidcHandler) resolveUser(c echo.Context, config OidcConfig, claims jwt.MapClaims) (*User, error) {
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+
+    subject, _ := claims["sub"].(string)
+    if subject == "" {
+        return nil, fmt.Errorf("Identity token has no subject")
+    }
+    email, _ := claims["email"].(string)
+    emailVerified, _ := claims["email_verified"].(bool)
+
+    user := new(User)
+    err := coll.FindOne(ctx, bson.M{ "oidc_subject": subject, "is_service": bson.M{ "$ne": true } }).Decode(user)
+    if err == nil {
+        return user, nil
+    } else if err != mongo.ErrNoDocuments {
+        return nil, err
+    }
+
+    if email != "" && emailVerified {
+        // Users can type in any email, so only those they proved they own
+        // are linked
+        filter := bson.M{ "email": email, "email_verified": true, "oidc_subject": bson.M{ "$exists": false }, "is_service": bson.M{ "$ne": true } }
+        update := bson.M{ "$set": bson.M{ "oidc_subject": subject } }
+        err := coll.FindOneAndUpdate(ctx, filter, update).Decode(user)
+        if err == nil {
+            user.OidcSubject = subject
+            c.Logger().Infof("Linked user %s to identity %s", user.Username, subject)
+            return user, nil
+        } else if err != mongo.ErrNoDocuments {
+            return nil, err
+        }
+    }
+
+    if !config.JitProvision {
+        return nil, mongo.ErrNoDocuments
+    }
+
+    username, _ := claims["preferred_username"].(string)
+    if username == "" {
+        username = email
+    }
+    if username == "" {
+        username = subject
+    }
+
+    if err := coll.FindOne(ctx, bson.M{ "username": username }).Err(); err == nil {
+        return nil, fmt.Errorf("Username %s is taken by another account", username)
+    } else if err != mongo.ErrNoDocuments {
+        return nil, err
+    }
+
+    user = &User{
+        Id: primitive.NewObjectID(),
+        Username: username,
+        OidcSubject: subject,
+        CreatedAt: time.Now(),
+    }
+    user.DisplayName, _ = claims["name"].(string)
+    if emailVerified {
+        user.Email = email
+        user.EmailVerified = true
+    }
+
+    if _, err := coll.InsertOne(ctx, user); err != nil {
+        return nil, err
+    }
+
+    c.Logger().Infof("Provisioned user %s from identity %s", user.Username, subject)
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_USER, user.Id.Hex(), nil, user)
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_CREATE, Id: user.Id, UserId: user.Id.Hex() })
+
+    return user, nil
+}
+
+// Syncs the groups a 2FA challenge kept from single sign-on, once it was
+// answered. Nothing is synced if single sign-on was turned off meanwhile.
+func syncChallengeGroups(c echo.Context, conns *HandlerConns, user *User, encoded string) error {
+    config, ok := oidcConfigFromEnv()
+    if !ok {
+        return nil
+    }
+
+    groups := make([]string, 0)
+    if err := json.Unmarshal([]byte(encoded), &groups); err != nil {
+        return err
+    }
+    return syncOidcGroups(c, conns, config, user, groups)
+}
+
+// Grants the permission keys mapped from the user's groups and revokes those
+// granted on an earlier sign in that no longer apply. Super status follows the
+// super groups when any are configured.
+func syncOidcGroups(c echo.Context, conns *HandlerConns, config OidcConfig, user *User, groups []string) error {
+    ctx := context.Background()
+
+    inGroup := make(map[string]bool)
+    for _, group := range groups {
+        inGroup[group] = true
+    }
+
+    keys := make([]string, 0)
+    // The first group mapping to each key, kept as the grant's reason
+    wanted := make(map[string]string)
+    for group, groupKeys := range config.GroupPerms {
+        if !inGroup[group] {
+            continue
+        }
+        for _, key := range groupKeys {
+            if _, ok := wanted[key]; !ok {
+                wanted[key] = group
+                keys = append(keys, key)
+            }
+        }
+    }
+
+    before := *user
+    had := make(map[string]bool)
+    for _, key := range user.OidcPermKeys {
+        had[key] = true
+        if _, ok := wanted[key]; !ok {
+            if _, err := endPermGrants(conns, user.Id.Hex(), key, PERM_SOURCE_SSO, "", PERM_END_REVOKED); err != nil {
+                return err
+            }
+        }
+    }
+    for _, key := range keys {
+        if had[key] {
+            continue
+        }
+        grant := PermissionGrant{
+            UserId: user.Id.Hex(),
+            Key: key,
+            Source: PERM_SOURCE_SSO,
+            Reason: "Identity provider group " + wanted[key],
+        }
+        if _, err := grantPerm(conns, grant); err != nil {
+            return err
+        }
+    }
+
+    set := bson.M{ "oidc_perm_keys": keys }
+    user.OidcPermKeys = keys
+    if len(config.SuperGroups) > 0 {
+        user.IsSuper = oidcIsSuper(config, user, groups)
+        set["is_super"] = user.IsSuper
+    }
+
+    coll := conns.Db.Collection(COLL_NAME_USER)
+    if _, err := coll.UpdateByID(ctx, user.Id, bson.M{ "$set": set }); err != nil {
+        return err
+    }
+
+    if before.IsSuper != user.IsSuper {
+        recordAudit(c, conns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, user.Id.Hex(), before, user)
+    }
+    return nil
+}
+
+// Whether the user is a super user once their groups are synced
+func oidcIsSuper(config OidcConfig, user *User, groups []string) bool {
+    if len(config.SuperGroups) == 0 {
+        return user.IsSuper
+    }
+    for _, group := range groups {
+        for _, superGroup := range config.SuperGroups {
+            if group == superGroup {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Keeps the state out of the cookie, as the state is also in the callback URL
+func hashOidcState(state string) string {
+    hash, _ := sha256Hash([]byte(state))
+    return hex.EncodeToString(hash)
+}
+
+func (p *oidcProvider) getDiscovery(config OidcConfig) (*oidcDiscovery, error) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+
+    if p.discovery != nil {
+        return p.discovery, nil
+    }
+
+    discovery := new(oidcDiscovery)
+    if err := getJson(strings.TrimRight(config.Issuer, "/") + "/.well-known/openid-configuration", discovery); err != nil {
+        return nil, err
+    }
+    if discovery.Issuer != config.Issuer {
+        return nil, fmt.Errorf("Issuer mismatch: configured %s, provider says %s", config.Issuer, discovery.Issuer)
+    }
+
+    p.discovery = discovery
+    return discovery, nil
+}
+
+// Keys are refetched when a token is signed with an unknown kid, which is how
+// providers rotate them
+func (p *oidcProvider) getKey(config OidcConfig, kid string) (interface{}, error) {
+    discovery, err := p.getDiscovery(config)
+    if err != nil {
+        return nil, err
+    }
+
+    p.lock.Lock()
+    defer p.lock.Unlock()
+
+    if key, ok := p.keys[kid]; ok {
+        return key, nil
+    }
+    if p.keys != nil && time.Since(p.keysFetched) < OIDC_JWKS_REFRESH {
+        return nil, fmt.Errorf("Unknown signing key %s", kid)
+    }
+
+    var jwks struct {
+        Keys []oidcJwk `json:"keys"`
+    }
+    if err := getJson(discovery.JwksUri, &jwks); err != nil {
+        return nil, err
+    }
+
+    p.keys = make(map[string]interface{})
+    p.keysFetched = time.Now()
+    for _, jwk := range jwks.Keys {
+        if key, err := jwk.publicKey(); err == nil {
+            p.keys[jwk.Kid] = key
+        }
+    }
+
+    if key, ok := p.keys[kid]; ok {
+        return key, nil
+    }
+    return nil, fmt.Errorf("Unknown signing key %s", kid)
+}
+
+func (p *oidcProvider) verifyIdToken(config OidcConfig, idToken string, nonce string) (jwt.MapClaims, error) {
+    claims := jwt.MapClaims{}
+    _, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+        kid, _ := token.Header["kid"].(string)
+        return p.getKey(config, kid)
+    },
+        jwt.WithValidMethods([]string{ "RS256", "RS384", "RS512", "ES256", "ES384", "ES512" }),
+        jwt.WithIssuer(config.Issuer),
+        jwt.WithAudience(config.ClientId),
+        jwt.WithLeeway(time.Minute),
+    )
+    if err != nil {
+        return nil, err
+    }
+
+    if exp, err := claims.GetExpirationTime(); err != nil || exp == nil {
+        return nil, fmt.Errorf("Identity token has no expiry")
+    }
+    if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+        return nil, fmt.Errorf("Identity token nonce does not match")
+    }
+    return claims, nil
+}
+
+func exchangeOidcCode(config OidcConfig, code string, verifier string) (string, error) {
+    discovery, err := idp.getDiscovery(config)
+    if err != nil {
+        return "", err
+    }
+
+    form := url.Values{}
+    form.Set("grant_type", "authorization_code")
+    form.Set("code", code)
+    form.Set("redirect_uri", config.RedirectUrl)
+    form.Set("client_id", config.ClientId)
+    form.Set("code_verifier", verifier)
+
+    req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+    req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+    // Public clients rely on PKCE alone
+    if config.ClientSecret != "" {
+        req.SetBasicAuth(url.QueryEscape(config.ClientId), url.QueryEscape(config.ClientSecret))
+    }
+
+    res, err := oidcClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer res.Body.Close()
+
+    var token oidcTokenResponse
+    if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+        return "", err
+    }
+    if res.StatusCode != http.StatusOK || token.Error != "" {
+        return "", fmt.Errorf("Token endpoint returned %d: %s %s", res.StatusCode, token.Error, token.ErrorDescription)
+    }
+    if token.IdToken == "" {
+        return "", fmt.Errorf("Token endpoint returned no id_token")
+    }
+    return token.IdToken, nil
+}
+
+func (jwk oidcJwk) publicKey() (interface{}, error) {
+    switch jwk.Kty {
+    case "RSA":
+        n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+        if err != nil {
+            return nil, err
+        }
+        e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+        if err != nil {
+            return nil, err
+        }
+        return &rsa.PublicKey{ N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64()) }, nil
+
+    case "EC":
+        var curve elliptic.Curve
+        switch jwk.Crv {
+        case "P-256":
+            curve = elliptic.P256()
+        case "P-384":
+            curve = elliptic.P384()
+        case "P-521":
+            curve = elliptic.P521()
+        default:
+            return nil, fmt.Errorf("Unsupported curve %s", jwk.Crv)
+        }
+        x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+        if err != nil {
+            return nil, err
+        }
+        y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+        if err != nil {
+            return nil, err
+        }
+        return &ecdsa.PublicKey{ Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y) }, nil
+    }
+
+    return nil, fmt.Errorf("Unsupported key type %s", jwk.Kty)
+}
+
+// Accepts the group claim as a list or a single string
+func oidcGroups(claims jwt.MapClaims, claim string) []string {
+    groups := make([]string, 0)
+    switch value := claims[claim].(type) {
+    case []interface{}:
+        for _, group := range value {
+            if s, ok := group.(string); ok {
+                groups = append(groups, s)
+            }
+        }
+    case string:
+        groups = append(groups, value)
+    }
+    return groups
+}
+
+// OIDC_GROUP_PERMS maps groups to permission keys as JSON, e.g.
+// {"finance": ["finance_report", "sales"]}. OIDC_SUPER_GROUPS is a comma
+// separated list of groups whose members are super users.
+func oidcConfigFromEnv() (OidcConfig, bool) {
+    config := OidcConfig{
+        Issuer: os.Getenv("OIDC_ISSUER"),
+        ClientId: os.Getenv("OIDC_CLIENT_ID"),
+        ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+        RedirectUrl: os.Getenv("OIDC_REDIRECT_URL"),
+        Scopes: os.Getenv("OIDC_SCOPES"),
+        PostLoginUrl: os.Getenv("OIDC_POST_LOGIN_URL"),
+        GroupClaim: os.Getenv("OIDC_GROUP_CLAIM"),
+        GroupPerms: make(map[string][]string),
+        SuperGroups: make([]string, 0),
+    }
+    if config.Issuer == "" || config.ClientId == "" || config.RedirectUrl == "" {
+        return config, false
+    }
+
+    if config.Scopes == "" {
+        config.Scopes = DEFAULT_OIDC_SCOPES
+    }
+    if config.PostLoginUrl == "" {
+        config.PostLoginUrl = "/"
+    }
+    if config.GroupClaim == "" {
+        config.GroupClaim = DEFAULT_OIDC_GROUP_CLAIM
+    }
+    config.JitProvision, _ = strconv.ParseBool(os.Getenv("OIDC_JIT_PROVISION"))
+
+    if perms := os.Getenv("OIDC_GROUP_PERMS"); perms != "" {
+        json.Unmarshal([]byte(perms), &config.GroupPerms)
+    }
+    for _, group := range strings.Split(os.Getenv("OIDC_SUPER_GROUPS"), ",") {
+        if group = strings.TrimSpace(group); group != "" {
+            config.SuperGroups = append(config.SuperGroups, group)
+        }
+    }
+
+    return config, true
+}
+
+func getJson(url string, target interface{}) error {
+    res, err := oidcClient.Get(url)
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s returned %d", url, res.StatusCode)
+    }
+    return json.NewDecoder(res.Body).Decode(target)
+}
+
+func randomUrlString(size int) (string, error) {
+    buf := make([]byte, size)
+    if _, err := rand.Read(buf); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(buf), nil
+}
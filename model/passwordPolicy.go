@@ -0,0 +1,263 @@
+package model
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PasswordPolicy struct {
+    MinLength     int  `json:"min_length"`
+    RequireLower  bool `json:"require_lower"`
+    RequireUpper  bool `json:"require_upper"`
+    RequireDigit  bool `json:"require_digit"`
+    RequireSymbol bool `json:"require_symbol"`
+    // How many previous passwords cannot be used again
+    HistorySize   int  `json:"history_size"`
+}
+
+// A password that breaks the policy, as opposed to a failure checking it
+type PasswordPolicyError struct {
+    Message string
+}
+
+func (err *PasswordPolicyError) Error() string {
+    return err.Message
+}
+
+type PasswordHistoryEntry struct {
+    Password string `bson:"password" json:"-" redact:"true"`
+    Salt     string `bson:"salt"     json:"-" redact:"true"`
+}
+
+const (
+    DEFAULT_PASSWORD_MIN_LENGTH = 10
+    DEFAULT_PASSWORD_REQUIRE = "lower,upper,digit"
+    DEFAULT_PASSWORD_HISTORY = 5
+)
+
+// Offline list of the most common passwords, one per line in lower case
+//go:embed commonPasswords.txt
+var commonPasswordList string
+
+var commonPasswords = parseCommonPasswords(commonPasswordList)
+
+// Routes a token marked for a password change may still use
+var PASSWORD_CHANGE_ALLOWED_PATHS = map[string]bool{
+    "/change_pwd": true,
+    "/checkToken": true,
+    "/password/policy": true,
+}
+
+func (handler *UserHandler) GetPasswordPolicy(c echo.Context) error {
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: passwordPolicyFromEnv(),
+    })
+}
+
+// Makes the user pick a new password the next time they log in
+func (handler *UserHandler) ForcePasswordChange(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    filter := bson.M{ "_id": id, "is_service": bson.M{ "$ne": true } }
+
+    var before User
+    if err := coll.FindOneAndUpdate(context.Background(), filter, bson.M{ "$set": bson.M{ "must_change_password": true } }).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    c.Logger().Infof("User %s must change their password at next login", before.Username)
+
+    after := before
+    after.MustChangePassword = true
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, id.Hex(), before, after)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "User must change password at next login" })
+}
+
+// Rejects requests from tokens issued to users who have to change their
+// password, except for changing it
+func PasswordChangeGuard(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+        if claims := GetJwtClaims(c); claims.MustChangePassword && !PASSWORD_CHANGE_ALLOWED_PATHS[c.Path()] {
+            return c.JSON(http.StatusForbidden, HttpResponseBody{ Success: false, Message: "Password change required" })
+        }
+        return next(c)
+    }
+}
+
+// Returns every rule the password breaks as one error
+func (policy PasswordPolicy) Check(password string, username string) error {
+    problems := make([]string, 0)
+
+    if len([]rune(password)) < policy.MinLength {
+        problems = append(problems, fmt.Sprintf("be at least %d characters long", policy.MinLength))
+    }
+
+    var lower, upper, digit, symbol bool
+    for _, r := range password {
+        switch {
+        case unicode.IsLower(r):
+            lower = true
+        case unicode.IsUpper(r):
+            upper = true
+        case unicode.IsDigit(r):
+            digit = true
+        default:
+            symbol = true
+        }
+    }
+    if policy.RequireLower && !lower {
+        problems = append(problems, "contain a lowercase letter")
+    }
+    if policy.RequireUpper && !upper {
+        problems = append(problems, "contain an uppercase letter")
+    }
+    if policy.RequireDigit && !digit {
+        problems = append(problems, "contain a digit")
+    }
+    if policy.RequireSymbol && !symbol {
+        problems = append(problems, "contain a symbol")
+    }
+
+    lowered := strings.ToLower(password)
+    if commonPasswords[lowered] {
+        problems = append(problems, "not be a commonly used password")
+    }
+    if username != "" && strings.Contains(lowered, strings.ToLower(username)) {
+        problems = append(problems, "not contain the username")
+    }
+
+    if len(problems) > 0 {
+        return &PasswordPolicyError{ Message: "Password must " + strings.Join(problems, ", ") }
+    }
+    return nil
+}
+
+// Whether the password is the current one or among the remembered previous ones
+func passwordReused(user *User, password string, historySize int) (bool, error) {
+    entries := append([]PasswordHistoryEntry{ { Password: user.Password, Salt: user.Salt } }, user.PasswordHistory...)
+    if len(entries) > historySize {
+        entries = entries[:historySize]
+    }
+
+    for _, entry := range entries {
+        if entry.Password == "" {
+            continue
+        }
+        same, err := verifyPassword(password, entry.Salt, entry.Password)
+        if err != nil {
+            return false, err
+        }
+        if same {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+// Checks the new password against the policy and history, then sets it on the
+// user, remembering the old one. Errors are meant to be shown to the user.
+func setUserPassword(user *User, password string) error {
+    policy := passwordPolicyFromEnv()
+    if err := policy.Check(password, user.Username); err != nil {
+        return err
+    }
+
+    if policy.HistorySize > 0 {
+        reused, err := passwordReused(user, password, policy.HistorySize)
+        if err != nil {
+            return err
+        }
+        if reused {
+            return &PasswordPolicyError{ Message: fmt.Sprintf("Password must not be one of the last %d passwords", policy.HistorySize) }
+        }
+    }
+
+    hash, salt, err := generateSaltAndPasswordHash(password)
+    if err != nil {
+        return err
+    }
+
+    if user.Password != "" && policy.HistorySize > 0 {
+        history := append([]PasswordHistoryEntry{ { Password: user.Password, Salt: user.Salt } }, user.PasswordHistory...)
+        if len(history) > policy.HistorySize {
+            history = history[:policy.HistorySize]
+        }
+        user.PasswordHistory = history
+    }
+
+    user.Password = hash
+    user.Salt = salt
+    user.MustChangePassword = false
+    return nil
+}
+
+func handlePasswordErr(c echo.Context, err error) error {
+    if policyErr, ok := err.(*PasswordPolicyError); ok {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: policyErr.Message })
+    }
+    c.Logger().Error(err)
+    return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+}
+
+// PASSWORD_REQUIRE lists the character classes needed, out of lower, upper,
+// digit and symbol. Set it to "none" to require none.
+func passwordPolicyFromEnv() PasswordPolicy {
+    policy := PasswordPolicy{
+        MinLength: DEFAULT_PASSWORD_MIN_LENGTH,
+        HistorySize: DEFAULT_PASSWORD_HISTORY,
+    }
+
+    if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+        policy.MinLength = n
+    }
+    if n, err := strconv.Atoi(os.Getenv("PASSWORD_HISTORY")); err == nil && n >= 0 {
+        policy.HistorySize = n
+    }
+
+    require := os.Getenv("PASSWORD_REQUIRE")
+    if require == "" {
+        require = DEFAULT_PASSWORD_REQUIRE
+    }
+    for _, class := range strings.Split(require, ",") {
+        switch strings.TrimSpace(class) {
+        case "lower":
+            policy.RequireLower = true
+        case "upper":
+            policy.RequireUpper = true
+        case "digit":
+            policy.RequireDigit = true
+        case "symbol":
+            policy.RequireSymbol = true
+        }
+    }
+
+    return policy
+}
+
+func parseCommonPasswords(list string) map[string]bool {
+    passwords := make(map[string]bool)
+    for _, line := range strings.Split(list, "\n") {
+        if line = strings.TrimSpace(line); line != "" {
+            passwords[line] = true
+        }
+    }
+    return passwords
+}
@@ -3,10 +3,12 @@ package model
 import (
 	"context"
 	"net/http"
-	"sort"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type PermissionHandler struct {
@@ -22,7 +24,7 @@ func (handler *PermissionHandler) CheckPerm(c echo.Context) error {
 
     key := c.Param("key")
 
-    perm, err := checkPerm(handler.HandlerConns, userId, key)
+    perm, err := checkPerm(handler.HandlerConns, userId, claims.Scope, key)
     if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
@@ -34,6 +36,9 @@ func (handler *PermissionHandler) CheckPerm(c echo.Context) error {
 type SetPermBody struct {
     UserId string `json:"user_id" validate:"omitempty,hexadecimal"`
     Key    string `json:"key" validate:"required"`
+    // Only used when granting; access is permanent without an expiry
+    Reason    string     `json:"reason,omitempty"`
+    ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 func (handler *PermissionHandler) SetPerm(c echo.Context) error {
@@ -48,15 +53,27 @@ func (handler *PermissionHandler) SetPerm(c echo.Context) error {
         body.UserId = claims.UserId
     }
 
-    ctx := context.Background()
-    cmd := handler.HandlerConns.Redis.SAdd(ctx, PERM_SET_KEY_PREFIX + body.Key, USER_PREFIX + body.UserId)
+    if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Expiry must be in the future" })
+    }
 
-    if _, err := cmd.Result(); err != nil {
+    grant, err := grantPerm(handler.HandlerConns, PermissionGrant{
+        UserId: body.UserId,
+        Key: body.Key,
+        Source: PERM_SOURCE_DIRECT,
+        Reason: body.Reason,
+        GrantedBy: GetJwtClaims(c).UserId,
+        ExpiresAt: body.ExpiresAt,
+    })
+    if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error adding permission key" })
     }
 
-    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Added permission key " + body.Key })
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_GRANT, AUDIT_TARGET_PERMISSION, body.UserId, nil, grant)
+    publishPermEvent(c, handler.HandlerConns, EVENT_ACTION_CREATE, body)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Added permission key " + body.Key, Data: grant })
 }
 
 func (handler *PermissionHandler) RemovePerm(c echo.Context) error {
@@ -71,42 +88,25 @@ func (handler *PermissionHandler) RemovePerm(c echo.Context) error {
         body.UserId = claims.UserId
     }
 
-    ctx := context.Background()
-    cmd := handler.HandlerConns.Redis.SRem(ctx, PERM_SET_KEY_PREFIX + body.Key, USER_PREFIX + body.UserId)
-
-    if _, err := cmd.Result(); err != nil {
+    ended, err := endPermGrants(handler.HandlerConns, body.UserId, body.Key, "", GetJwtClaims(c).UserId, PERM_END_REVOKED)
+    if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error removing permission key" })
     }
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_REVOKE, AUDIT_TARGET_PERMISSION, body.UserId, PermissionRevocation{ Key: body.Key, Grants: ended }, nil)
+    publishPermEvent(c, handler.HandlerConns, EVENT_ACTION_DELETE, body)
+
     return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Removed permission key " + body.Key })
 }
 
 func (handler *PermissionHandler) GetAllPermKey(c echo.Context) error {
-    ctx := context.Background()
-
-    keys := make([]string, 0)
-    var cursor uint64 = 0
-
-    for {
-        cmd := handler.HandlerConns.Redis.Scan(ctx, cursor, PERM_SET_KEY_PREFIX + "*", 0)
-        result, cursor, err := cmd.Result()
-        if err != nil {
-            c.Logger().Error(err)
-            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error scanning permission keys" })
-        }
-
-        for _, key := range result {
-            keys = append(keys, strings.TrimPrefix(key, PERM_SET_KEY_PREFIX))
-        }
-
-        if cursor == 0 {
-            break
-        }
+    keys, err := allPermKeys(handler.HandlerConns)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error getting permission keys" })
     }
 
-    sort.Strings(keys)
-
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Data: keys,
@@ -138,9 +138,149 @@ func (handler *PermissionHandler) GetPermUserList(c echo.Context) error {
     })
 }
 
-func checkPerm(handlerConns *HandlerConns, userId string, key string) (bool, error) {
+// What a revocation ended, for the audit log
+type PermissionRevocation struct {
+    Key    string            `json:"key"`
+    Grants []PermissionGrant `json:"grants"`
+}
+
+func publishPermEvent(c echo.Context, handlerConns *HandlerConns, action string, body *SetPermBody) {
+    claims := GetJwtClaims(c)
+    userId, err := primitive.ObjectIDFromHex(body.UserId)
+    if err != nil {
+        c.Logger().Error(err)
+        return
+    }
+    publishEvent(handlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_PERMISSION, Action: action, Id: userId, Key: body.Key, UserId: claims.UserId })
+}
+
+// Takes the user out of every permission key, ending their grants
+func removeUserPerms(handlerConns *HandlerConns, userId string, endedBy string) error {
+    keys, err := userPermKeys(handlerConns.Redis, userId)
+    if err != nil {
+        return err
+    }
+    for _, key := range keys {
+        if _, err := endPermGrants(handlerConns, userId, key, "", endedBy, PERM_END_REVOKED); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Remembers checkPerm results of one user, for handlers checking many
+// resources guarded by the same keys
+type permChecker struct {
+    conns   *HandlerConns
+    userId  string
+    scope   []string
+    results map[string]bool
+}
+
+func newPermChecker(handlerConns *HandlerConns, userId string, scope []string) *permChecker {
+    return &permChecker{ conns: handlerConns, userId: userId, scope: scope, results: make(map[string]bool) }
+}
+
+func (checker *permChecker) check(key string) (bool, error) {
+    if perm, ok := checker.results[key]; ok {
+        return perm, nil
+    }
+    perm, err := checkPerm(checker.conns, checker.userId, checker.scope, key)
+    if err != nil {
+        return false, err
+    }
+    checker.results[key] = perm
+    return perm, nil
+}
+
+// Holding a wildcard of any ancestor also grants the key, see
+// permKeyCandidates. A non-empty scope, from the API key used, limits the
+// user to the keys it covers.
+func checkPerm(handlerConns *HandlerConns, userId string, scope []string, key string) (bool, error) {
+    perms, err := checkPerms(handlerConns, userId, scope, []string{ key })
+    if err != nil {
+        return false, err
+    }
+    return perms[key], nil
+}
+
+// checkPerm for many keys in one round trip
+func checkPerms(handlerConns *HandlerConns, userId string, scope []string, keys []string) (map[string]bool, error) {
     ctx := context.Background()
-    cmd := handlerConns.Redis.SIsMember(ctx, PERM_SET_KEY_PREFIX + key, USER_PREFIX + userId)
-    return cmd.Result()
+
+    candidates := make(map[string][]string)
+    memberships := make(map[string]permMembershipCmds)
+
+    pipe := handlerConns.Redis.Pipeline()
+    for _, key := range keys {
+        candidates[key] = permKeyCandidates(key)
+        for _, candidate := range candidates[key] {
+            if _, ok := memberships[candidate]; ok {
+                continue
+            }
+            memberships[candidate] = queuePermMembership(ctx, pipe, userId, candidate)
+        }
+    }
+    if len(memberships) > 0 {
+        if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+            return nil, err
+        }
+    }
+
+    now := time.Now()
+    result := make(map[string]bool)
+    for _, key := range keys {
+        if !permScopeCovers(scope, key) {
+            continue
+        }
+        for _, candidate := range candidates[key] {
+            if held, _ := memberships[candidate].held(now); held {
+                result[key] = true
+                break
+            }
+        }
+    }
+    return result, nil
+}
+
+// The reads telling whether a user holds one key, queued on a pipeline
+type permMembershipCmds struct {
+    isMember *redis.BoolCmd
+    expiry   *redis.FloatCmd
 }
 
+func queuePermMembership(ctx context.Context, pipe redis.Pipeliner, userId string, key string) permMembershipCmds {
+    member := USER_PREFIX + userId
+    return permMembershipCmds{
+        isMember: pipe.SIsMember(ctx, PERM_SET_KEY_PREFIX + key, member),
+        expiry: pipe.ZScore(ctx, PERM_EXPIRY_KEY_PREFIX + key, member),
+    }
+}
+
+// Whether the user held the key at now, once the pipeline ran. Users whose
+// access ran out but the expirer has not removed yet do not, and expiredAt
+// says when it ran out.
+func (cmds permMembershipCmds) held(now time.Time) (held bool, expiredAt *time.Time) {
+    if !cmds.isMember.Val() {
+        return false, nil
+    }
+    if cmds.expiry.Err() == nil {
+        expiresAt := time.Unix(int64(cmds.expiry.Val()), 0)
+        if !expiresAt.After(now) {
+            return false, &expiresAt
+        }
+    }
+    return true, nil
+}
+
+func permScopeCovers(scope []string, key string) bool {
+    if len(scope) == 0 {
+        return true
+    }
+    for _, granted := range scope {
+        if permKeyCovers(granted, key) {
+            return true
+        }
+    }
+    return false
+}
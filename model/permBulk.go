@@ -0,0 +1,571 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A user and a key they may hold
+type PermissionPair struct {
+    UserId string `json:"user_id"`
+    Key    string `json:"key"`
+}
+
+// Grants or revokes every key for every user
+type BulkPermBody struct {
+    UserIds []string `json:"user_ids" validate:"required,min=1,dive,hexadecimal,len=24"`
+    Keys    []string `json:"keys"     validate:"required,min=1,dive,required"`
+    // Only used when granting
+    Reason    string     `json:"reason,omitempty"`
+    ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type CopyPermBody struct {
+    FromUserId string `json:"from_user_id" validate:"required,hexadecimal,len=24"`
+    ToUserId   string `json:"to_user_id"   validate:"required,hexadecimal,len=24"`
+    // Also revoke the keys the target holds and the source does not
+    Replace bool `json:"replace"`
+}
+
+// Users × keys. Each row lists the keys the user holds out of Keys.
+type PermissionMatrix struct {
+    Keys  []string              `json:"keys"`
+    Users []PermissionMatrixRow `json:"users"`
+}
+
+type PermissionMatrixRow struct {
+    UserId   string   `json:"user_id"`
+    Username string   `json:"username,omitempty"`
+    Keys     []string `json:"keys"`
+}
+
+type PermissionChanges struct {
+    Granted []PermissionPair `json:"granted"`
+    Revoked []PermissionPair `json:"revoked"`
+}
+
+const PERM_MATRIX_FORMAT_CSV = "csv"
+
+// First CSV columns, followed by one column per key
+const PERM_MATRIX_CSV_USER_ID = "user_id"
+const PERM_MATRIX_CSV_USERNAME = "username"
+const PERM_MATRIX_CSV_HELD = "1"
+
+func (handler *PermissionHandler) BulkGrantPerm(c echo.Context) error {
+    body := new(BulkPermBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Expiry must be in the future" })
+    }
+    if message, err := validateBulkPerm(handler.HandlerConns, body.UserIds, body.Keys); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+
+    claims := GetJwtClaims(c)
+    grants := make([]PermissionGrant, 0, len(body.UserIds) * len(body.Keys))
+    for _, userId := range body.UserIds {
+        for _, key := range body.Keys {
+            grants = append(grants, PermissionGrant{
+                UserId: userId,
+                Key: key,
+                Source: PERM_SOURCE_DIRECT,
+                Reason: body.Reason,
+                GrantedBy: claims.UserId,
+                ExpiresAt: body.ExpiresAt,
+            })
+        }
+    }
+
+    grants, err := grantPerms(handler.HandlerConns, grants)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error adding permission keys" })
+    }
+
+    for _, grant := range grants {
+        recordAudit(c, handler.HandlerConns, AUDIT_ACTION_GRANT, AUDIT_TARGET_PERMISSION, grant.UserId, nil, grant)
+    }
+    publishPermEvents(c, handler.HandlerConns, EVENT_ACTION_CREATE, grantPairs(grants))
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Added permission keys", Data: grants })
+}
+
+func (handler *PermissionHandler) BulkRemovePerm(c echo.Context) error {
+    body := new(BulkPermBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    pairs := make([]PermissionPair, 0, len(body.UserIds) * len(body.Keys))
+    for _, userId := range body.UserIds {
+        for _, key := range body.Keys {
+            pairs = append(pairs, PermissionPair{ UserId: userId, Key: key })
+        }
+    }
+
+    if err := revokePerms(c, handler.HandlerConns, pairs); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error removing permission keys" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Removed permission keys" })
+}
+
+// Gives the target every key the source holds, expiring when the source's
+// access does. The target's direct grants for those keys are replaced.
+func (handler *PermissionHandler) CopyPerm(c echo.Context) error {
+    body := new(CopyPermBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    if body.FromUserId == body.ToUserId {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Cannot copy permissions to the same user" })
+    }
+    if message, err := validateBulkPerm(handler.HandlerConns, []string{ body.FromUserId, body.ToUserId }, nil); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+
+    source, err := effectivePerms(handler.HandlerConns, body.FromUserId)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error getting permissions" })
+    }
+
+    claims := GetJwtClaims(c)
+    copied := make(map[string]bool)
+    grants := make([]PermissionGrant, len(source))
+    for i, perm := range source {
+        copied[perm.Key] = true
+        grants[i] = PermissionGrant{
+            UserId: body.ToUserId,
+            Key: perm.Key,
+            Source: PERM_SOURCE_DIRECT,
+            Reason: "Copied from user " + body.FromUserId,
+            GrantedBy: claims.UserId,
+            ExpiresAt: perm.ExpiresAt,
+        }
+    }
+
+    revoked := make([]PermissionPair, 0)
+    if body.Replace {
+        held, err := userPermKeys(handler.HandlerConns.Redis, body.ToUserId)
+        if err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error getting permissions" })
+        }
+        for _, key := range held {
+            if !copied[key] {
+                revoked = append(revoked, PermissionPair{ UserId: body.ToUserId, Key: key })
+            }
+        }
+    }
+
+    grants, err = applyPermChanges(c, handler.HandlerConns, grants, revoked)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error copying permissions" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Copied permissions",
+        Data: PermissionChanges{ Granted: grantPairs(grants), Revoked: revoked },
+    })
+}
+
+// The whole matrix as JSON, or CSV with format=csv
+func (handler *PermissionHandler) ExportPermMatrix(c echo.Context) error {
+    matrix, err := permMatrix(handler.HandlerConns)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error getting permission matrix" })
+    }
+
+    if c.QueryParam("format") != PERM_MATRIX_FORMAT_CSV {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Success", Data: matrix })
+    }
+
+    buf := new(bytes.Buffer)
+    if err := writePermMatrixCsv(buf, matrix); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error writing permission matrix" })
+    }
+
+    c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="permissions.csv"`)
+    return c.Blob(http.StatusOK, "text/csv", buf.Bytes())
+}
+
+// Makes the listed users hold exactly the ticked keys out of the listed
+// ones. Other users and keys are left alone. Takes the export's CSV or JSON;
+// dry_run=true only reports the changes.
+func (handler *PermissionHandler) ImportPermMatrix(c echo.Context) error {
+    var matrix *PermissionMatrix
+    var err error
+    if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), "text/csv") {
+        matrix, err = readPermMatrixCsv(c.Request().Body)
+    } else {
+        matrix = new(PermissionMatrix)
+        err = c.Bind(matrix)
+    }
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    userIds := make([]string, len(matrix.Users))
+    for i, row := range matrix.Users {
+        userIds[i] = row.UserId
+    }
+    if len(userIds) == 0 || len(matrix.Keys) == 0 {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Permission matrix has no users or keys" })
+    }
+    if message, err := validateBulkPerm(handler.HandlerConns, userIds, matrix.Keys); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+
+    changes, err := permMatrixChanges(handler.HandlerConns, matrix)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error getting permission matrix" })
+    }
+
+    if c.QueryParam("dry_run") == "true" {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Dry run, nothing changed", Data: changes })
+    }
+
+    claims := GetJwtClaims(c)
+    grants := make([]PermissionGrant, len(changes.Granted))
+    for i, pair := range changes.Granted {
+        grants[i] = PermissionGrant{
+            UserId: pair.UserId,
+            Key: pair.Key,
+            Source: PERM_SOURCE_DIRECT,
+            Reason: "Imported permission matrix",
+            GrantedBy: claims.UserId,
+        }
+    }
+
+    if _, err := applyPermChanges(c, handler.HandlerConns, grants, changes.Revoked); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error importing permission matrix" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Imported permission matrix", Data: changes })
+}
+
+// Checks every user exists and every key is well formed before anything is
+// changed, so a typo cannot leave a bulk change half done
+func validateBulkPerm(conns *HandlerConns, userIds []string, keys []string) (string, error) {
+    for _, key := range keys {
+        if !PERM_KEY_PATTERN.MatchString(key) {
+            return "Invalid permission key " + key, nil
+        }
+    }
+
+    ids := make([]primitive.ObjectID, 0, len(userIds))
+    for _, userId := range userIds {
+        id, err := primitive.ObjectIDFromHex(userId)
+        if err != nil {
+            return "Invalid user ID " + userId, nil
+        }
+        ids = append(ids, id)
+    }
+
+    found, err := conns.Db.Collection(COLL_NAME_USER).Distinct(context.Background(), "_id", bson.M{ "_id": bson.M{ "$in": ids } })
+    if err != nil {
+        return "", err
+    }
+    exists := make(map[primitive.ObjectID]bool)
+    for _, value := range found {
+        if id, ok := value.(primitive.ObjectID); ok {
+            exists[id] = true
+        }
+    }
+    for _, id := range ids {
+        if !exists[id] {
+            return "User " + id.Hex() + " not found", nil
+        }
+    }
+    return "", nil
+}
+
+// Ends every grant of the pairs and removes them from the keys in one MULTI,
+// like RemovePerm does for one
+func revokePerms(c echo.Context, conns *HandlerConns, pairs []PermissionPair) error {
+    _, err := applyPermChanges(c, conns, nil, pairs)
+    return err
+}
+
+// Records the grants and ends every grant of the revoked pairs, then syncs
+// all of their memberships in one MULTI, so no one sees half of the change.
+// The memberships are synced even when a write fails, so the keys match
+// whichever records were written.
+func applyPermChanges(c echo.Context, conns *HandlerConns, grants []PermissionGrant, revoked []PermissionPair) ([]PermissionGrant, error) {
+    pairs := append(grantPairs(grants), revoked...)
+    if len(pairs) == 0 {
+        return grants, nil
+    }
+
+    grants, err := recordPermGrants(conns, grants)
+    var ended []PermissionGrant
+    if err == nil {
+        ended, err = endPermPairs(conns, revoked, GetJwtClaims(c).UserId)
+    }
+    if syncErr := syncPermMemberships(conns, pairs); err == nil {
+        err = syncErr
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    for _, grant := range grants {
+        recordAudit(c, conns, AUDIT_ACTION_GRANT, AUDIT_TARGET_PERMISSION, grant.UserId, nil, grant)
+    }
+    publishPermEvents(c, conns, EVENT_ACTION_CREATE, grantPairs(grants))
+
+    byPair := make(map[PermissionPair][]PermissionGrant)
+    for _, grant := range ended {
+        pair := PermissionPair{ UserId: grant.UserId, Key: grant.Key }
+        byPair[pair] = append(byPair[pair], grant)
+    }
+    for _, pair := range revoked {
+        recordAudit(c, conns, AUDIT_ACTION_REVOKE, AUDIT_TARGET_PERMISSION, pair.UserId, PermissionRevocation{ Key: pair.Key, Grants: byPair[pair] }, nil)
+    }
+    publishPermEvents(c, conns, EVENT_ACTION_DELETE, revoked)
+
+    return grants, nil
+}
+
+// Ends the active grants of the pairs, leaving the memberships to be synced
+// by the caller. Returns the grants ended.
+func endPermPairs(conns *HandlerConns, pairs []PermissionPair, endedBy string) ([]PermissionGrant, error) {
+    if len(pairs) == 0 {
+        return nil, nil
+    }
+
+    ctx := context.Background()
+    coll := conns.Db.Collection(COLL_NAME_PERMISSION_GRANT)
+    now := time.Now()
+
+    or := make(bson.A, len(pairs))
+    for i, pair := range pairs {
+        or[i] = bson.M{ "user_id": pair.UserId, "key": pair.Key }
+    }
+    filter := activeGrantFilter(now)
+    filter["$and"] = bson.A{ bson.M{ "$or": or } }
+
+    cur, err := coll.Find(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    ended := make([]PermissionGrant, 0)
+    if err := cur.All(ctx, &ended); err != nil {
+        return nil, err
+    }
+    if len(ended) == 0 {
+        return ended, nil
+    }
+
+    ids := make([]primitive.ObjectID, len(ended))
+    for i := range ended {
+        ids[i] = ended[i].Id
+        ended[i].EndedAt = &now
+        ended[i].EndedBy = endedBy
+        ended[i].EndReason = PERM_END_REVOKED
+    }
+    update := bson.M{ "$set": bson.M{ "ended_at": now, "ended_by": endedBy, "end_reason": PERM_END_REVOKED } }
+    if _, err := coll.UpdateMany(ctx, bson.M{ "_id": bson.M{ "$in": ids } }, update); err != nil {
+        return nil, err
+    }
+    return ended, nil
+}
+
+// Every user against every known key
+func permMatrix(conns *HandlerConns) (*PermissionMatrix, error) {
+    ctx := context.Background()
+
+    keys, err := allPermKeys(conns)
+    if err != nil {
+        return nil, err
+    }
+
+    opts := options.Find().SetProjection(bson.M{ "_id": 1, "username": 1 }).SetSort(bson.M{ "username": 1 })
+    cur, err := conns.Db.Collection(COLL_NAME_USER).Find(ctx, bson.M{}, opts)
+    if err != nil {
+        return nil, err
+    }
+    users := make([]User, 0)
+    if err := cur.All(ctx, &users); err != nil {
+        return nil, err
+    }
+
+    pipe := conns.Redis.Pipeline()
+    cmds := make([]*redis.StringSliceCmd, len(keys))
+    for i, key := range keys {
+        cmds[i] = pipe.SMembers(ctx, PERM_SET_KEY_PREFIX + key)
+    }
+    if len(keys) > 0 {
+        if _, err := pipe.Exec(ctx); err != nil {
+            return nil, err
+        }
+    }
+
+    held := make(map[string][]string)
+    for i, cmd := range cmds {
+        for _, member := range cmd.Val() {
+            userId := strings.TrimPrefix(member, USER_PREFIX)
+            held[userId] = append(held[userId], keys[i])
+        }
+    }
+
+    matrix := &PermissionMatrix{ Keys: keys, Users: make([]PermissionMatrixRow, len(users)) }
+    for i, user := range users {
+        row := PermissionMatrixRow{ UserId: user.Id.Hex(), Username: user.Username, Keys: held[user.Id.Hex()] }
+        if row.Keys == nil {
+            row.Keys = make([]string, 0)
+        }
+        matrix.Users[i] = row
+    }
+    return matrix, nil
+}
+
+// What importing the matrix would grant and revoke
+func permMatrixChanges(conns *HandlerConns, matrix *PermissionMatrix) (*PermissionChanges, error) {
+    ctx := context.Background()
+
+    pairs := make([]PermissionPair, 0, len(matrix.Users) * len(matrix.Keys))
+    pipe := conns.Redis.Pipeline()
+    cmds := make([]*redis.BoolCmd, 0, cap(pairs))
+    for _, row := range matrix.Users {
+        for _, key := range matrix.Keys {
+            pairs = append(pairs, PermissionPair{ UserId: row.UserId, Key: key })
+            cmds = append(cmds, pipe.SIsMember(ctx, PERM_SET_KEY_PREFIX + key, USER_PREFIX + row.UserId))
+        }
+    }
+    if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+        return nil, err
+    }
+
+    wanted := make(map[PermissionPair]bool)
+    for _, row := range matrix.Users {
+        for _, key := range row.Keys {
+            wanted[PermissionPair{ UserId: row.UserId, Key: key }] = true
+        }
+    }
+
+    changes := &PermissionChanges{ Granted: make([]PermissionPair, 0), Revoked: make([]PermissionPair, 0) }
+    for i, pair := range pairs {
+        if wanted[pair] && !cmds[i].Val() {
+            changes.Granted = append(changes.Granted, pair)
+        } else if !wanted[pair] && cmds[i].Val() {
+            changes.Revoked = append(changes.Revoked, pair)
+        }
+    }
+    return changes, nil
+}
+
+func writePermMatrixCsv(w io.Writer, matrix *PermissionMatrix) error {
+    writer := csv.NewWriter(w)
+
+    header := append([]string{ PERM_MATRIX_CSV_USER_ID, PERM_MATRIX_CSV_USERNAME }, matrix.Keys...)
+    if err := writer.Write(header); err != nil {
+        return err
+    }
+
+    for _, row := range matrix.Users {
+        held := make(map[string]bool)
+        for _, key := range row.Keys {
+            held[key] = true
+        }
+
+        record := []string{ row.UserId, row.Username }
+        for _, key := range matrix.Keys {
+            if held[key] {
+                record = append(record, PERM_MATRIX_CSV_HELD)
+            } else {
+                record = append(record, "")
+            }
+        }
+        if err := writer.Write(record); err != nil {
+            return err
+        }
+    }
+
+    writer.Flush()
+    return writer.Error()
+}
+
+// Reads the export's layout. The username column is optional; a key is held
+// when its cell is 1, true, yes or x.
+func readPermMatrixCsv(r io.Reader) (*PermissionMatrix, error) {
+    records, err := csv.NewReader(r).ReadAll()
+    if err != nil {
+        return nil, err
+    }
+    if len(records) == 0 || len(records[0]) == 0 || records[0][0] != PERM_MATRIX_CSV_USER_ID {
+        return nil, errors.New("First column must be " + PERM_MATRIX_CSV_USER_ID)
+    }
+
+    first := 1
+    if len(records[0]) > 1 && records[0][1] == PERM_MATRIX_CSV_USERNAME {
+        first = 2
+    }
+
+    matrix := &PermissionMatrix{ Keys: records[0][first:], Users: make([]PermissionMatrixRow, 0, len(records) - 1) }
+    for _, record := range records[1:] {
+        row := PermissionMatrixRow{ UserId: record[0], Keys: make([]string, 0) }
+        if first == 2 {
+            row.Username = record[1]
+        }
+        for i, cell := range record[first:] {
+            switch strings.ToLower(strings.TrimSpace(cell)) {
+            case PERM_MATRIX_CSV_HELD, "true", "yes", "x":
+                row.Keys = append(row.Keys, matrix.Keys[i])
+            case "", "0", "false", "no":
+            default:
+                return nil, errors.New("Invalid cell " + cell + " for user " + row.UserId)
+            }
+        }
+        matrix.Users = append(matrix.Users, row)
+    }
+    return matrix, nil
+}
+
+func grantPairs(grants []PermissionGrant) []PermissionPair {
+    pairs := make([]PermissionPair, len(grants))
+    for i, grant := range grants {
+        pairs[i] = PermissionPair{ UserId: grant.UserId, Key: grant.Key }
+    }
+    return pairs
+}
+
+func publishPermEvents(c echo.Context, handlerConns *HandlerConns, action string, pairs []PermissionPair) {
+    for _, pair := range pairs {
+        publishPermEvent(c, handlerConns, action, &SetPermBody{ UserId: pair.UserId, Key: pair.Key })
+    }
+}
@@ -0,0 +1,510 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// One reason a user holds a permission key. The Redis set behind checkPerm
+// holds a user while any of their grants for the key is active; grants are
+// never deleted, so they double as the history of who had access when.
+type PermissionGrant struct {
+    Id        primitive.ObjectID `bson:"_id"                  json:"id"`
+    UserId    string             `bson:"user_id"              json:"userId"`
+    Key       string             `bson:"key"                  json:"key"`
+    Source    string             `bson:"source"               json:"source"`
+    Reason    string             `bson:"reason,omitempty"     json:"reason,omitempty"`
+    GrantedBy string             `bson:"granted_by,omitempty" json:"grantedBy,omitempty"`
+    GrantedAt time.Time          `bson:"granted_at"           json:"grantedAt"`
+    ExpiresAt *time.Time         `bson:"expires_at,omitempty" json:"expiresAt,omitempty"`
+    EndedAt   *time.Time         `bson:"ended_at,omitempty"   json:"endedAt,omitempty"`
+    EndedBy   string             `bson:"ended_by,omitempty"   json:"endedBy,omitempty"`
+    EndReason string             `bson:"end_reason,omitempty" json:"endReason,omitempty"`
+}
+
+// A key the user holds, and every active grant giving it to them
+type EffectivePermission struct {
+    Key       string            `json:"key"`
+    ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+    Sources   []PermissionGrant `json:"sources"`
+}
+
+const (
+    PERM_SOURCE_DIRECT = "direct"
+    PERM_SOURCE_SSO = "sso"
+    // Set membership from before grants were recorded
+    PERM_SOURCE_LEGACY = "legacy"
+)
+
+const (
+    PERM_END_REVOKED = "revoked"
+    PERM_END_EXPIRED = "expired"
+    PERM_END_REPLACED = "replaced"
+)
+
+// Sorted set per key of users whose access ends, scored by the unix time it
+// does. Users holding the key without an expiry are not in it.
+const PERM_EXPIRY_KEY_PREFIX = "ec:permission_expiry:"
+const PERM_EXPIRY_INTERVAL = time.Minute
+
+// Grants of a user, key or both, newest first. Only active ones with
+// active=true.
+func (handler *PermissionHandler) GetPermGrantList(c echo.Context) error {
+    filter := bson.M{}
+    if userId := c.QueryParam("user_id"); userId != "" {
+        filter["user_id"] = userId
+    }
+    if key := c.QueryParam("key"); key != "" {
+        filter["key"] = key
+    }
+    if c.QueryParam("active") == "true" {
+        for field, value := range activeGrantFilter(time.Now()) {
+            filter[field] = value
+        }
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_PERMISSION_GRANT)
+    cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{ "granted_at": -1 }))
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    result := make([]PermissionGrant, 0)
+    if err := cur.All(ctx, &result); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Success", Data: result })
+}
+
+// Every key the user holds with where it comes from. Users can see their own.
+func (handler *PermissionHandler) GetEffectivePerms(c echo.Context) error {
+    userId := c.Param("id")
+    if _, err := primitive.ObjectIDFromHex(userId); err != nil {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+    if !claims.IsSuper && claims.UserId != userId {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Non-super users cannot get other users' permissions" })
+    }
+
+    perms, err := effectivePerms(handler.HandlerConns, userId)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error getting permissions" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Success", Data: perms })
+}
+
+func effectivePerms(conns *HandlerConns, userId string) ([]EffectivePermission, error) {
+    ctx := context.Background()
+    now := time.Now()
+
+    keys, err := userPermKeys(conns.Redis, userId)
+    if err != nil {
+        return nil, err
+    }
+
+    filter := activeGrantFilter(now)
+    filter["user_id"] = userId
+    cur, err := conns.Db.Collection(COLL_NAME_PERMISSION_GRANT).Find(ctx, filter, options.Find().SetSort(bson.M{ "granted_at": 1 }))
+    if err != nil {
+        return nil, err
+    }
+    grants := make([]PermissionGrant, 0)
+    if err := cur.All(ctx, &grants); err != nil {
+        return nil, err
+    }
+
+    byKey := make(map[string][]PermissionGrant)
+    for _, grant := range grants {
+        byKey[grant.Key] = append(byKey[grant.Key], grant)
+    }
+
+    result := make([]EffectivePermission, 0, len(keys))
+    for _, key := range keys {
+        allowed, err := checkPerm(conns, userId, nil, key)
+        if err != nil {
+            return nil, err
+        }
+        if !allowed {
+            continue
+        }
+
+        perm := EffectivePermission{ Key: key, Sources: byKey[key] }
+        if len(perm.Sources) == 0 {
+            perm.Sources = []PermissionGrant{ { UserId: userId, Key: key, Source: PERM_SOURCE_LEGACY } }
+        }
+        perm.ExpiresAt = grantsExpiry(perm.Sources)
+        result = append(result, perm)
+    }
+    return result, nil
+}
+
+// Keys whose set holds the user, sorted
+func userPermKeys(rdb *redis.Client, userId string) ([]string, error) {
+    ctx := context.Background()
+    member := USER_PREFIX + userId
+
+    keys := make([]string, 0)
+    var cursor uint64 = 0
+    for {
+        sets, next, err := rdb.Scan(ctx, cursor, PERM_SET_KEY_PREFIX + "*", 0).Result()
+        if err != nil {
+            return nil, err
+        }
+
+        pipe := rdb.Pipeline()
+        cmds := make([]*redis.BoolCmd, len(sets))
+        for i, set := range sets {
+            cmds[i] = pipe.SIsMember(ctx, set, member)
+        }
+        if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+            return nil, err
+        }
+        for i, cmd := range cmds {
+            if cmd.Val() {
+                keys = append(keys, strings.TrimPrefix(sets[i], PERM_SET_KEY_PREFIX))
+            }
+        }
+
+        if cursor = next; cursor == 0 {
+            break
+        }
+    }
+
+    sort.Strings(keys)
+    return keys, nil
+}
+
+// Records a legacy grant for each user in a key's set who never had a grant
+// for it, i.e. who was given the key before grants were recorded. Syncing the
+// key would otherwise take their access away, or make it expire with the
+// first expiring grant they get. Safe to run again and on every replica.
+func InitLegacyPermGrants(conns *HandlerConns) error {
+    ctx := context.Background()
+    coll := conns.Db.Collection(COLL_NAME_PERMISSION_GRANT)
+    now := time.Now()
+
+    keys, err := heldPermKeys(conns)
+    if err != nil {
+        return err
+    }
+
+    for _, key := range keys {
+        members, err := conns.Redis.SMembers(ctx, PERM_SET_KEY_PREFIX + key).Result()
+        if err != nil {
+            return err
+        }
+        userIds := make([]string, len(members))
+        for i, member := range members {
+            userIds[i] = strings.TrimPrefix(member, USER_PREFIX)
+        }
+
+        // Members with any grant, even an ended one, are already managed by
+        // grants and are left to them
+        found, err := coll.Distinct(ctx, "user_id", bson.M{ "key": key, "user_id": bson.M{ "$in": userIds } })
+        if err != nil {
+            return err
+        }
+        hasGrant := make(map[string]bool)
+        for _, value := range found {
+            if userId, ok := value.(string); ok {
+                hasGrant[userId] = true
+            }
+        }
+
+        for _, userId := range userIds {
+            if hasGrant[userId] {
+                continue
+            }
+            filter := bson.M{ "user_id": userId, "key": key, "source": PERM_SOURCE_LEGACY }
+            update := bson.M{ "$setOnInsert": bson.M{ "_id": primitive.NewObjectID(), "granted_at": now } }
+            if _, err := coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// Records a grant and adds the user to the key. A direct grant replaces the
+// direct grants before it, so granting again changes the expiry.
+func grantPerm(conns *HandlerConns, grant PermissionGrant) (*PermissionGrant, error) {
+    grants, err := grantPerms(conns, []PermissionGrant{ grant })
+    if err != nil {
+        return nil, err
+    }
+    return &grants[0], nil
+}
+
+// grantPerm for many grants at once, with every membership change applied in
+// one MULTI
+func grantPerms(conns *HandlerConns, grants []PermissionGrant) ([]PermissionGrant, error) {
+    if len(grants) == 0 {
+        return grants, nil
+    }
+
+    grants, err := recordPermGrants(conns, grants)
+    if err != nil {
+        return nil, err
+    }
+    if err := syncPermMemberships(conns, grantPairs(grants)); err != nil {
+        return nil, err
+    }
+    return grants, nil
+}
+
+// Writes the grants and ends the direct grants they replace, leaving the
+// memberships to be synced by the caller
+func recordPermGrants(conns *HandlerConns, grants []PermissionGrant) ([]PermissionGrant, error) {
+    if len(grants) == 0 {
+        return grants, nil
+    }
+
+    ctx := context.Background()
+    coll := conns.Db.Collection(COLL_NAME_PERMISSION_GRANT)
+    now := time.Now()
+
+    replaced := make(bson.A, 0)
+    docs := make([]interface{}, len(grants))
+    for i := range grants {
+        if grants[i].Source == PERM_SOURCE_DIRECT {
+            replaced = append(replaced, bson.M{ "user_id": grants[i].UserId, "key": grants[i].Key })
+        }
+        grants[i].Id = primitive.NewObjectID()
+        grants[i].GrantedAt = now
+        docs[i] = grants[i]
+    }
+
+    if len(replaced) > 0 {
+        filter := activeGrantFilter(now)
+        filter["source"] = PERM_SOURCE_DIRECT
+        filter["$and"] = bson.A{ bson.M{ "$or": replaced } }
+        update := bson.M{ "$set": bson.M{ "ended_at": now, "ended_by": grants[0].GrantedBy, "end_reason": PERM_END_REPLACED } }
+        if _, err := coll.UpdateMany(ctx, filter, update); err != nil {
+            return nil, err
+        }
+    }
+
+    if _, err := coll.InsertMany(ctx, docs); err != nil {
+        return nil, err
+    }
+    return grants, nil
+}
+
+// Ends the user's active grants for the key, of one source or all of them
+// when source is empty, and removes them from the key if nothing else grants
+// it. Returns the grants ended.
+func endPermGrants(conns *HandlerConns, userId string, key string, source string, endedBy string, reason string) ([]PermissionGrant, error) {
+    ctx := context.Background()
+    coll := conns.Db.Collection(COLL_NAME_PERMISSION_GRANT)
+    now := time.Now()
+
+    filter := activeGrantFilter(now)
+    filter["user_id"] = userId
+    filter["key"] = key
+    if source != "" {
+        filter["source"] = source
+    }
+
+    cur, err := coll.Find(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    ended := make([]PermissionGrant, 0)
+    if err := cur.All(ctx, &ended); err != nil {
+        return nil, err
+    }
+
+    if len(ended) > 0 {
+        ids := make([]primitive.ObjectID, len(ended))
+        for i := range ended {
+            ids[i] = ended[i].Id
+            ended[i].EndedAt = &now
+            ended[i].EndedBy = endedBy
+            ended[i].EndReason = reason
+        }
+        update := bson.M{ "$set": bson.M{ "ended_at": now, "ended_by": endedBy, "end_reason": reason } }
+        if _, err := coll.UpdateMany(ctx, bson.M{ "_id": bson.M{ "$in": ids } }, update); err != nil {
+            return nil, err
+        }
+    }
+
+    // Revoking everything also drops membership no grant accounts for, e.g.
+    // added to the set since InitLegacyPermGrants ran
+    if source == "" {
+        pipe := conns.Redis.TxPipeline()
+        pipe.SRem(ctx, PERM_SET_KEY_PREFIX + key, USER_PREFIX + userId)
+        pipe.ZRem(ctx, PERM_EXPIRY_KEY_PREFIX + key, USER_PREFIX + userId)
+        _, err := pipe.Exec(ctx)
+        return ended, err
+    }
+    return ended, syncPermMembership(conns, userId, key)
+}
+
+// Makes the Redis set and expiry of the key match the user's active grants
+func syncPermMembership(conns *HandlerConns, userId string, key string) error {
+    return syncPermMemberships(conns, []PermissionPair{ { UserId: userId, Key: key } })
+}
+
+func syncPermMemberships(conns *HandlerConns, pairs []PermissionPair) error {
+    ctx := context.Background()
+
+    userIds := make([]string, len(pairs))
+    keys := make([]string, len(pairs))
+    for i, pair := range pairs {
+        userIds[i] = pair.UserId
+        keys[i] = pair.Key
+    }
+
+    filter := activeGrantFilter(time.Now())
+    filter["user_id"] = bson.M{ "$in": userIds }
+    filter["key"] = bson.M{ "$in": keys }
+    cur, err := conns.Db.Collection(COLL_NAME_PERMISSION_GRANT).Find(ctx, filter)
+    if err != nil {
+        return err
+    }
+    grants := make([]PermissionGrant, 0)
+    if err := cur.All(ctx, &grants); err != nil {
+        return err
+    }
+
+    byPair := make(map[PermissionPair][]PermissionGrant)
+    for _, grant := range grants {
+        pair := PermissionPair{ UserId: grant.UserId, Key: grant.Key }
+        byPair[pair] = append(byPair[pair], grant)
+    }
+
+    pipe := conns.Redis.TxPipeline()
+    for _, pair := range pairs {
+        member := USER_PREFIX + pair.UserId
+        if grants := byPair[pair]; len(grants) == 0 {
+            pipe.SRem(ctx, PERM_SET_KEY_PREFIX + pair.Key, member)
+            pipe.ZRem(ctx, PERM_EXPIRY_KEY_PREFIX + pair.Key, member)
+        } else if expiresAt := grantsExpiry(grants); expiresAt == nil {
+            pipe.SAdd(ctx, PERM_SET_KEY_PREFIX + pair.Key, member)
+            pipe.ZRem(ctx, PERM_EXPIRY_KEY_PREFIX + pair.Key, member)
+        } else {
+            pipe.SAdd(ctx, PERM_SET_KEY_PREFIX + pair.Key, member)
+            pipe.ZAdd(ctx, PERM_EXPIRY_KEY_PREFIX + pair.Key, redis.Z{ Score: float64(expiresAt.Unix()), Member: member })
+        }
+    }
+    _, err = pipe.Exec(ctx)
+    return err
+}
+
+// When the last of the grants runs out, nil if one never does
+func grantsExpiry(grants []PermissionGrant) *time.Time {
+    var latest *time.Time
+    for _, grant := range grants {
+        if grant.ExpiresAt == nil {
+            return nil
+        }
+        if latest == nil || grant.ExpiresAt.After(*latest) {
+            latest = grant.ExpiresAt
+        }
+    }
+    return latest
+}
+
+func activeGrantFilter(now time.Time) bson.M {
+    return bson.M{
+        "ended_at": nil,
+        "$or": bson.A{
+            bson.M{ "expires_at": nil },
+            bson.M{ "expires_at": bson.M{ "$gt": now } },
+        },
+    }
+}
+
+// Closes grants that ran out, so their history says so and the users leave
+// the keys. checkPerm already refuses them in the meantime.
+type PermissionExpirer struct {
+    *HandlerConns
+    Logger   *log.Logger
+    Interval time.Duration
+}
+
+func NewPermissionExpirer(conns *HandlerConns) *PermissionExpirer {
+    return &PermissionExpirer{
+        HandlerConns: conns,
+        Logger: log.New("permission"),
+        Interval: PERM_EXPIRY_INTERVAL,
+    }
+}
+
+func (expirer *PermissionExpirer) Run(ctx context.Context) {
+    ticker := time.NewTicker(expirer.Interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if err := expirer.ExpireDue(); err != nil {
+                expirer.Logger.Error(err)
+            }
+        }
+    }
+}
+
+func (expirer *PermissionExpirer) ExpireDue() error {
+    ctx := context.Background()
+    coll := expirer.HandlerConns.Db.Collection(COLL_NAME_PERMISSION_GRANT)
+    now := time.Now()
+
+    filter := bson.M{ "ended_at": nil, "expires_at": bson.M{ "$lte": now } }
+    cur, err := coll.Find(ctx, filter)
+    if err != nil {
+        return err
+    }
+    due := make([]PermissionGrant, 0)
+    if err := cur.All(ctx, &due); err != nil {
+        return err
+    }
+
+    for _, grant := range due {
+        // Other replicas run this too, only one of them closes each grant
+        update := bson.M{ "$set": bson.M{ "ended_at": grant.ExpiresAt, "end_reason": PERM_END_EXPIRED } }
+        err := coll.FindOneAndUpdate(ctx, bson.M{ "_id": grant.Id, "ended_at": nil }, update).Err()
+        if err == mongo.ErrNoDocuments {
+            continue
+        } else if err != nil {
+            return err
+        }
+
+        if err := syncPermMembership(expirer.HandlerConns, grant.UserId, grant.Key); err != nil {
+            return err
+        }
+
+        after := grant
+        after.EndedAt = grant.ExpiresAt
+        after.EndReason = PERM_END_EXPIRED
+        if err := insertAudit(expirer.HandlerConns, AuditActor{}, AUDIT_ACTION_EXPIRE, AUDIT_TARGET_PERMISSION, grant.UserId, grant, after); err != nil {
+            expirer.Logger.Error(err)
+        }
+
+        if userId, err := primitive.ObjectIDFromHex(grant.UserId); err == nil {
+            publishEvent(expirer.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_PERMISSION, Action: EVENT_ACTION_DELETE, Id: userId, Key: grant.Key })
+        }
+
+        expirer.Logger.Infof("Permission %s of user %s expired", grant.Key, grant.UserId)
+    }
+    return nil
+}
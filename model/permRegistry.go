@@ -0,0 +1,373 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A declared permission key. Keys are hierarchical, with segments separated
+// by ":"; holding "finance:*" grants every key under "finance".
+type PermissionKey struct {
+    Key         string    `bson:"_id"                  json:"key"`
+    Description string    `bson:"description"          json:"description"`
+    // User responsible for who gets the key
+    Owner       string    `bson:"owner,omitempty"      json:"owner,omitempty"`
+    CreatedBy   string    `bson:"created_by,omitempty" json:"createdBy,omitempty"`
+    CreatedAt   time.Time `bson:"created_at"           json:"createdAt"`
+}
+
+type PermissionKeyResource struct {
+    Type string             `json:"type"`
+    Id   primitive.ObjectID `json:"id"`
+    Name string             `json:"name"`
+    // The resource's own key, which differs for wildcard keys
+    Key  string             `json:"key"`
+}
+
+type PermissionKeyDetail struct {
+    PermissionKey
+    Resources []PermissionKeyResource `json:"resources"`
+}
+
+type RegisterPermKeyBody struct {
+    Key         string `json:"key"         validate:"required"`
+    Description string `json:"description" validate:"required"`
+    Owner       string `json:"owner"       validate:"omitempty,hexadecimal,len=24"`
+}
+
+type EditPermKeyBody struct {
+    Description string `json:"description" validate:"required"`
+    Owner       string `json:"owner"       validate:"omitempty,hexadecimal,len=24"`
+}
+
+const (
+    PERM_KEY_SEPARATOR = ":"
+    PERM_KEY_WILDCARD = "*"
+)
+
+// Segments of letters, digits, "_", "-" and ".", optionally ending in ":*"
+var PERM_KEY_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_.-]+(:[A-Za-z0-9_.-]+)*(:\*)?$`)
+
+// Registered keys with the tables, charts and chart views using them
+func (handler *PermissionHandler) GetPermKeyRegistry(c echo.Context) error {
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_PERMISSION_KEY)
+
+    cur, err := coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{ "_id": 1 }))
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    keys := make([]PermissionKey, 0)
+    if err := cur.All(ctx, &keys); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    resources, err := permKeyResources(handler.HandlerConns)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    result := make([]PermissionKeyDetail, len(keys))
+    for i, key := range keys {
+        result[i] = PermissionKeyDetail{ PermissionKey: key, Resources: resourcesUnder(resources, key.Key) }
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Success", Data: result })
+}
+
+func (handler *PermissionHandler) GetPermKeyDetail(c echo.Context) error {
+    key := new(PermissionKey)
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_PERMISSION_KEY)
+    if err := coll.FindOne(context.Background(), bson.M{ "_id": c.Param("key") }).Decode(key); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    resources, err := permKeyResources(handler.HandlerConns)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: PermissionKeyDetail{ PermissionKey: *key, Resources: resourcesUnder(resources, key.Key) },
+    })
+}
+
+func (handler *PermissionHandler) RegisterPermKey(c echo.Context) error {
+    body := new(RegisterPermKeyBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    if !PERM_KEY_PATTERN.MatchString(body.Key) {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Invalid permission key, use segments of letters, digits, '_', '-' and '.' separated by ':', optionally ending in ':*'" })
+    }
+
+    key := PermissionKey{
+        Key: body.Key,
+        Description: body.Description,
+        Owner: body.Owner,
+        CreatedBy: GetJwtClaims(c).UserId,
+        CreatedAt: time.Now(),
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_PERMISSION_KEY)
+    if _, err := coll.InsertOne(context.Background(), key); mongo.IsDuplicateKeyError(err) {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Permission key exists" })
+    } else if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_PERMISSION_KEY, key.Key, nil, key)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Registered permission key " + key.Key, Data: key })
+}
+
+func (handler *PermissionHandler) EditPermKey(c echo.Context) error {
+    body := new(EditPermKeyBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_PERMISSION_KEY)
+    update := bson.M{ "$set": bson.M{ "description": body.Description, "owner": body.Owner } }
+
+    var before PermissionKey
+    if err := coll.FindOneAndUpdate(context.Background(), bson.M{ "_id": c.Param("key") }, update).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    after := before
+    after.Description = body.Description
+    after.Owner = body.Owner
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_PERMISSION_KEY, before.Key, before, after)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Permission key updated", Data: after })
+}
+
+// Keys still used by a table, chart or chart view cannot be removed. Users
+// holding the key keep it; the registry only declares keys.
+func (handler *PermissionHandler) DeletePermKey(c echo.Context) error {
+    key := c.Param("key")
+
+    resources, err := permKeyResources(handler.HandlerConns)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    for _, resource := range resources {
+        if resource.Key == key {
+            return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Permission key is used by " + resource.Type + " " + resource.Name })
+        }
+    }
+
+    var before PermissionKey
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_PERMISSION_KEY)
+    if err := coll.FindOneAndDelete(context.Background(), bson.M{ "_id": key }).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_DELETE, AUDIT_TARGET_PERMISSION_KEY, key, before, nil)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Removed permission key " + key })
+}
+
+// Registers the keys already in use, so that existing tables and charts can
+// still be saved once unknown keys are rejected
+func InitPermissionRegistry(conns *HandlerConns) error {
+    ctx := context.Background()
+
+    keys := make(map[string]bool)
+    resources, err := permKeyResources(conns)
+    if err != nil {
+        return err
+    }
+    for _, resource := range resources {
+        keys[resource.Key] = true
+    }
+
+    held, err := heldPermKeys(conns)
+    if err != nil {
+        return err
+    }
+    for _, key := range held {
+        keys[key] = true
+    }
+
+    coll := conns.Db.Collection(COLL_NAME_PERMISSION_KEY)
+    now := time.Now()
+    for key := range keys {
+        update := bson.M{ "$setOnInsert": bson.M{ "description": "", "created_at": now } }
+        if _, err := coll.UpdateOne(ctx, bson.M{ "_id": key }, update, options.Update().SetUpsert(true)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Rejects keys a table, chart or chart view cannot use. Empty keys leave the
+// resource open to everyone.
+func validateResourcePermKey(conns *HandlerConns, key string) (string, error) {
+    if key == "" {
+        return "", nil
+    }
+    if isWildcardPermKey(key) {
+        return "Tables, charts and chart views need a permission key without a wildcard", nil
+    }
+
+    err := conns.Db.Collection(COLL_NAME_PERMISSION_KEY).FindOne(context.Background(), bson.M{ "_id": key }).Err()
+    if err == mongo.ErrNoDocuments {
+        return "Unknown permission key " + key + ", register it first", nil
+    }
+    return "", err
+}
+
+// The key itself, then the wildcard of each ancestor, nearest first: for
+// "a:b:c" that is "a:b:c", "a:b:*" and "a:*"
+func permKeyCandidates(key string) []string {
+    candidates := []string{ key }
+    segments := strings.Split(key, PERM_KEY_SEPARATOR)
+    for i := len(segments) - 1; i > 0; i-- {
+        wildcard := strings.Join(segments[:i], PERM_KEY_SEPARATOR) + PERM_KEY_SEPARATOR + PERM_KEY_WILDCARD
+        if wildcard != key {
+            candidates = append(candidates, wildcard)
+        }
+    }
+    return candidates
+}
+
+func isWildcardPermKey(key string) bool {
+    return key == PERM_KEY_WILDCARD || strings.HasSuffix(key, PERM_KEY_SEPARATOR + PERM_KEY_WILDCARD)
+}
+
+// Whether holding granted gives key, directly or through a wildcard
+func permKeyCovers(granted string, key string) bool {
+    if granted == key {
+        return true
+    }
+    if !strings.HasSuffix(granted, PERM_KEY_SEPARATOR + PERM_KEY_WILDCARD) {
+        return false
+    }
+    return strings.HasPrefix(key, strings.TrimSuffix(granted, PERM_KEY_WILDCARD))
+}
+
+func resourcesUnder(resources []PermissionKeyResource, key string) []PermissionKeyResource {
+    result := make([]PermissionKeyResource, 0)
+    for _, resource := range resources {
+        if permKeyCovers(key, resource.Key) {
+            result = append(result, resource)
+        }
+    }
+    return result
+}
+
+// Every table, chart and chart view with a permission key
+func permKeyResources(conns *HandlerConns) ([]PermissionKeyResource, error) {
+    ctx := context.Background()
+    filter := bson.M{ "perm_key": bson.M{ "$nin": bson.A{ "", nil } } }
+    resources := make([]PermissionKeyResource, 0)
+
+    cur, err := conns.Db.Collection(COLL_NAME_TABLE).Find(ctx, filter, options.Find().SetProjection(TABLE_BASIC_PROJECTION))
+    if err != nil {
+        return nil, err
+    }
+    tables := make([]Table, 0)
+    if err := cur.All(ctx, &tables); err != nil {
+        return nil, err
+    }
+    for _, table := range tables {
+        resources = append(resources, PermissionKeyResource{ Type: AUDIT_TARGET_TABLE, Id: table.Id, Name: table.Name, Key: table.PermKey })
+    }
+
+    opts := options.Find().SetProjection(bson.M{ "_id": 1, "title": 1, "perm_key": 1 })
+    cur, err = conns.Db.Collection(COLL_NAME_CHART).Find(ctx, filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    charts := make([]Chart, 0)
+    if err := cur.All(ctx, &charts); err != nil {
+        return nil, err
+    }
+    for _, chart := range charts {
+        resources = append(resources, PermissionKeyResource{ Type: AUDIT_TARGET_CHART, Id: chart.Id, Name: chart.Title, Key: chart.PermKey })
+    }
+
+    opts = options.Find().SetProjection(bson.M{ "_id": 1, "name": 1, "perm_key": 1 })
+    cur, err = conns.Db.Collection(COLL_NAME_CHART_VIEW).Find(ctx, filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    views := make([]ChartView, 0)
+    if err := cur.All(ctx, &views); err != nil {
+        return nil, err
+    }
+    for _, view := range views {
+        resources = append(resources, PermissionKeyResource{ Type: AUDIT_TARGET_CHART_VIEW, Id: view.Id, Name: view.Name, Key: view.PermKey })
+    }
+
+    return resources, nil
+}
+
+// Registered keys and those somebody holds without being registered, sorted
+func allPermKeys(conns *HandlerConns) ([]string, error) {
+    held, err := heldPermKeys(conns)
+    if err != nil {
+        return nil, err
+    }
+
+    registered, err := conns.Db.Collection(COLL_NAME_PERMISSION_KEY).Distinct(context.Background(), "_id", bson.M{})
+    if err != nil {
+        return nil, err
+    }
+
+    seen := make(map[string]bool)
+    keys := make([]string, 0, len(held) + len(registered))
+    for _, key := range held {
+        seen[key] = true
+        keys = append(keys, key)
+    }
+    for _, value := range registered {
+        if key, ok := value.(string); ok && !seen[key] {
+            seen[key] = true
+            keys = append(keys, key)
+        }
+    }
+
+    sort.Strings(keys)
+    return keys, nil
+}
+
+// Keys somebody holds, found from their Redis sets
+func heldPermKeys(conns *HandlerConns) ([]string, error) {
+    ctx := context.Background()
+
+    keys := make([]string, 0)
+    var cursor uint64 = 0
+    for {
+        result, next, err := conns.Redis.Scan(ctx, cursor, PERM_SET_KEY_PREFIX + "*", 0).Result()
+        if err != nil {
+            return nil, err
+        }
+        for _, key := range result {
+            keys = append(keys, strings.TrimPrefix(key, PERM_SET_KEY_PREFIX))
+        }
+        if cursor = next; cursor == 0 {
+            break
+        }
+    }
+
+    sort.Strings(keys)
+    return keys, nil
+}
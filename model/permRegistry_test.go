@@ -0,0 +1,51 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPermKeyCandidates(t *testing.T) {
+    tests := []struct {
+        key  string
+        want []string
+    }{
+        { "a", []string{ "a" } },
+        { "a:b", []string{ "a:b", "a:*" } },
+        { "a:b:c", []string{ "a:b:c", "a:b:*", "a:*" } },
+        { "a:*", []string{ "a:*" } },
+        { "a:b:*", []string{ "a:b:*", "a:*" } },
+    }
+
+    for _, test := range tests {
+        if got := permKeyCandidates(test.key); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("permKeyCandidates(%q) = %q, want %q", test.key, got, test.want)
+        }
+    }
+}
+
+func TestPermKeyCovers(t *testing.T) {
+    tests := []struct {
+        granted string
+        key     string
+        want    bool
+    }{
+        { "a:b", "a:b", true },
+        { "a:b", "a:c", false },
+        { "a:*", "a:b", true },
+        { "a:*", "a:b:c", true },
+        { "a:*", "a:*", true },
+        { "a:b:*", "a:b:c", true },
+        { "a:b:*", "a:c", false },
+        { "a:b:*", "a:*", false },
+        { "a:*", "ab:c", false },
+        { "a:*", "a", false },
+        { "a:b", "a:b:c", false },
+    }
+
+    for _, test := range tests {
+        if got := permKeyCovers(test.granted, test.key); got != test.want {
+            t.Errorf("permKeyCovers(%q, %q) = %v, want %v", test.granted, test.key, got, test.want)
+        }
+    }
+}
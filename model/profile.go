@@ -0,0 +1,341 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fields left out are kept, empty strings clear them
+type UpdateProfileBody struct {
+    DisplayName *string `json:"display_name" validate:"omitempty,max=100"`
+    Email       *string `json:"email"        validate:"omitempty,max=254"`
+    Department  *string `json:"department"   validate:"omitempty,max=100"`
+}
+
+type VerifyEmailBody struct {
+    Token string `json:"token" validate:"required"`
+}
+
+// IDs of disabled users, checked on every authenticated request
+const DISABLED_USERS_KEY = "ec:users:disabled"
+
+// Rebuilds the set of disabled users from Mongo, so it survives Redis being
+// flushed or restored from an older snapshot.
+func InitDisabledUsers(conns *HandlerConns) error {
+    ctx := context.Background()
+    opts := options.Find().SetProjection(bson.M{ "_id": 1 })
+    cur, err := conns.Db.Collection(COLL_NAME_USER).Find(ctx, bson.M{ "disabled": true }, opts)
+    if err != nil {
+        return err
+    }
+
+    users := make([]User, 0)
+    if err := cur.All(ctx, &users); err != nil {
+        return err
+    }
+
+    pipe := conns.Redis.TxPipeline()
+    pipe.Del(ctx, DISABLED_USERS_KEY)
+    for _, user := range users {
+        pipe.SAdd(ctx, DISABLED_USERS_KEY, user.Id.Hex())
+    }
+    _, err = pipe.Exec(ctx)
+    return err
+}
+
+// Edits the profile of the user making the request. A new email is only
+// saved once the user follows the link sent to it, see VerifyEmail.
+func (handler *UserHandler) UpdateProfile(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(GetJwtClaims(c).UserId)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    return handler.updateProfile(c, id, true)
+}
+
+// Edits someone else's profile, for super users. Emails set here count as
+// verified.
+func (handler *UserHandler) UpdateUserProfile(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+    return handler.updateProfile(c, id, false)
+}
+
+// Saves the email from the link sent by UpdateProfile
+func (handler *UserHandler) VerifyEmail(c echo.Context) error {
+    body := new(VerifyEmailBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    var token emailToken
+    if err := useOneTimeToken(handler.HandlerConns.Redis, TOKEN_KIND_EMAIL, body.Token, &token); err == redis.Nil {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Link is invalid or has expired" })
+    } else if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    id, err := primitive.ObjectIDFromHex(token.UserId)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+
+    // Someone else may have taken it since the link was sent
+    if taken, err := emailTaken(coll, token.Email, id); err != nil {
+        return handleMongoErr(c, err)
+    } else if taken {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Email is used by another user" })
+    }
+
+    var before User
+    update := bson.M{ "$set": bson.M{ "email": token.Email, "email_verified": true } }
+    if err := coll.FindOneAndUpdate(ctx, bson.M{ "_id": id }, update).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    after := before
+    after.Email = token.Email
+    after.EmailVerified = true
+
+    c.Logger().Infof("User %s verified their email", before.Username)
+
+    if err := insertAudit(handler.HandlerConns, AuditActor{ UserId: id.Hex(), Ip: c.RealIP(), UserAgent: c.Request().UserAgent() }, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, id.Hex(), before, after); err != nil {
+        c.Logger().Error(err)
+    }
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_UPDATE, Id: id, UserId: id.Hex() })
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Email verified", Data: after.Public() })
+}
+
+func (handler *UserHandler) DisableUser(c echo.Context) error {
+    return handler.setUserDisabled(c, true)
+}
+
+func (handler *UserHandler) EnableUser(c echo.Context) error {
+    return handler.setUserDisabled(c, false)
+}
+
+// Rejects requests from disabled users, whether they use a token issued
+// before they were disabled or an API key
+func ActiveUserGuard(conns *HandlerConns) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            disabled, err := conns.Redis.SIsMember(context.Background(), DISABLED_USERS_KEY, GetJwtClaims(c).UserId).Result()
+            if err != nil {
+                c.Logger().Error(err)
+                return echo.NewHTTPError(http.StatusInternalServerError, "Server error")
+            }
+            if disabled {
+                return echo.NewHTTPError(http.StatusUnauthorized, "Account is disabled")
+            }
+            return next(c)
+        }
+    }
+}
+
+func (handler *UserHandler) updateProfile(c echo.Context, id primitive.ObjectID, verifyEmail bool) error {
+    body := new(UpdateProfileBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+
+    set := bson.M{}
+    unset := bson.M{}
+    for field, value := range map[string]*string{
+        "display_name": body.DisplayName,
+        "email": body.Email,
+        "department": body.Department,
+    } {
+        if value == nil {
+            continue
+        }
+        if trimmed := strings.TrimSpace(*value); trimmed != "" {
+            set[field] = trimmed
+        } else {
+            unset[field] = ""
+        }
+    }
+
+    pendingEmail := ""
+    if email, ok := set["email"].(string); ok {
+        if err := checkMailHeader(email); err != nil || !strings.Contains(email, "@") {
+            return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Invalid email" })
+        }
+        // Emails link SSO identities to users, so no two users may share one
+        if taken, err := emailTaken(coll, email, id); err != nil {
+            return handleMongoErr(c, err)
+        } else if taken {
+            return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Email is used by another user" })
+        }
+
+        if verifyEmail {
+            delete(set, "email")
+            pendingEmail = email
+        } else {
+            set["email_verified"] = true
+        }
+    }
+    if _, ok := unset["email"]; ok {
+        unset["email_verified"] = ""
+    }
+
+    update := bson.M{}
+    if len(set) > 0 {
+        update["$set"] = set
+    }
+    if len(unset) > 0 {
+        update["$unset"] = unset
+    }
+    if len(update) == 0 && pendingEmail == "" {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Nothing to update" })
+    }
+
+    var before User
+    if len(update) == 0 {
+        if err := coll.FindOne(ctx, bson.M{ "_id": id }).Decode(&before); err != nil {
+            return handleMongoErr(c, err)
+        }
+    } else {
+        opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+        if err := coll.FindOneAndUpdate(ctx, bson.M{ "_id": id }, update, opts).Decode(&before); err != nil {
+            return handleMongoErr(c, err)
+        }
+    }
+
+    after := before
+    if body.DisplayName != nil {
+        after.DisplayName = strings.TrimSpace(*body.DisplayName)
+    }
+    if body.Email != nil && pendingEmail == "" {
+        after.Email = strings.TrimSpace(*body.Email)
+        after.EmailVerified = after.Email != ""
+    }
+    if body.Department != nil {
+        after.Department = strings.TrimSpace(*body.Department)
+    }
+
+    if len(update) > 0 {
+        recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, id.Hex(), before, after)
+
+        publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_UPDATE, Id: id, UserId: GetJwtClaims(c).UserId })
+    }
+
+    message := "Profile updated"
+    if pendingEmail != "" {
+        if err := handler.sendEmailVerification(&before, pendingEmail); err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error sending verification email" })
+        }
+        message = "Verification email sent to " + pendingEmail
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: message, Data: after.Public() })
+}
+
+func (handler *UserHandler) sendEmailVerification(user *User, email string) error {
+    token, err := createOneTimeToken(handler.HandlerConns.Redis, TOKEN_KIND_EMAIL, emailToken{ UserId: user.Id.Hex(), Email: email }, EMAIL_TOKEN_TTL)
+    if err != nil {
+        return err
+    }
+
+    link := appLink("/verify_email", token)
+    text := fmt.Sprintf("Confirm %s as the email of %s on the EC admin dashboard within %s:\n%s\n\nIf this was not you, ignore this email.\n", email, user.Username, EMAIL_TOKEN_TTL, link)
+    return handler.HandlerConns.Mailer.Send(email, "Confirm your EC admin dashboard email", text)
+}
+
+func emailTaken(coll *mongo.Collection, email string, userId primitive.ObjectID) (bool, error) {
+    err := coll.FindOne(context.Background(), bson.M{ "email": email, "_id": bson.M{ "$ne": userId } }).Err()
+    if err == mongo.ErrNoDocuments {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+// Disabling signs the user out everywhere; their API keys stop working too
+func (handler *UserHandler) setUserDisabled(c echo.Context, disabled bool) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+    if disabled && claims.UserId == id.Hex() {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Cannot disable yourself" })
+    }
+
+    ctx := context.Background()
+    rdb := handler.HandlerConns.Redis
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+
+    var update bson.M
+    if disabled {
+        update = bson.M{ "$set": bson.M{ "disabled": true } }
+    } else {
+        update = bson.M{ "$unset": bson.M{ "disabled": "" } }
+    }
+
+    var before User
+    if err := coll.FindOneAndUpdate(ctx, bson.M{ "_id": id }, update).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    if disabled {
+        if err := rdb.SAdd(ctx, DISABLED_USERS_KEY, id.Hex()).Err(); err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+        }
+        if err := revokeUserSessions(rdb, id.Hex()); err != nil {
+            c.Logger().Error(err)
+        }
+        c.Logger().Infof("User %s disabled", before.Username)
+    } else {
+        if err := rdb.SRem(ctx, DISABLED_USERS_KEY, id.Hex()).Err(); err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+        }
+        c.Logger().Infof("User %s enabled", before.Username)
+    }
+
+    after := before
+    after.Disabled = disabled
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, id.Hex(), before, after)
+
+    publishEvent(rdb, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_UPDATE, Id: id, UserId: claims.UserId })
+
+    message := "User enabled"
+    if disabled {
+        message = "User disabled"
+    }
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: message })
+}
+
+func recordLogin(conns *HandlerConns, user *User) error {
+    user.LastLoginAt = time.Now()
+    _, err := conns.Db.Collection(COLL_NAME_USER).UpdateByID(context.Background(), user.Id, bson.M{ "$set": bson.M{ "last_login_at": user.LastLoginAt } })
+    return err
+}
@@ -0,0 +1,245 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type RateLimitConfig struct {
+    // Kept in the Redis key so limiters on the same client do not share counts
+    Name    string
+    Limit   int
+    Window  time.Duration
+    // Overrides Limit and Window when set, given as "<limit>/<window>" e.g. "100/1m"
+    Env     string
+    KeyFunc func(c echo.Context) string
+}
+
+const RATE_LIMIT_PREFIX = "ec:ratelimit:"
+
+const (
+    LOGIN_FAIL_PREFIX = "ec:login:fail:"
+    LOGIN_LOCK_PREFIX = "ec:login:lock:"
+    LOGIN_LOCK_COUNT_PREFIX = "ec:login:lockcount:"
+)
+
+const (
+    DEFAULT_LOGIN_MAX_ATTEMPTS = 5
+    DEFAULT_LOGIN_LOCKOUT = time.Minute
+    LOGIN_FAIL_WINDOW = 15 * time.Minute
+    LOGIN_MAX_LOCKOUT = 24 * time.Hour
+    // Lockouts keep doubling while the account keeps getting locked within this
+    LOGIN_LOCK_COUNT_TTL = 24 * time.Hour
+)
+
+// Sliding window log: one sorted set member per request scored by its time in
+// ms. Runs as a script so that checking and adding is atomic across replicas.
+var rateLimitScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+local count = redis.call('ZCARD', key)
+if count < limit then
+    redis.call('ZADD', key, now, ARGV[4])
+    redis.call('PEXPIRE', key, window)
+    return {1, count + 1, 0}
+end
+
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+return {0, count, tonumber(oldest[2]) + window - now}
+`)
+
+func NewRateLimiter(conns *HandlerConns, config RateLimitConfig) echo.MiddlewareFunc {
+    if env := os.Getenv(config.Env); config.Env != "" && env != "" {
+        if limit, window, err := parseRateLimit(env); err == nil {
+            config.Limit = limit
+            config.Window = window
+        }
+    }
+    if config.KeyFunc == nil {
+        config.KeyFunc = RateLimitByIp
+    }
+
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            // A limit of 0 turns the limiter off
+            if config.Limit <= 0 || config.Window <= 0 {
+                return next(c)
+            }
+
+            key := RATE_LIMIT_PREFIX + config.Name + ":" + config.KeyFunc(c)
+            now := time.Now().UnixMilli()
+            args := []interface{}{ now, config.Window.Milliseconds(), config.Limit, fmt.Sprintf("%d-%s", now, primitive.NewObjectID().Hex()) }
+
+            res, err := rateLimitScript.Run(context.Background(), conns.Redis, []string{ key }, args...).Int64Slice()
+            if err != nil {
+                // Rather let requests through than take the API down with Redis
+                c.Logger().Error(err)
+                return next(c)
+            }
+
+            header := c.Response().Header()
+            header.Set("X-RateLimit-Limit", strconv.Itoa(config.Limit))
+            header.Set("X-RateLimit-Remaining", strconv.FormatInt(int64(config.Limit) - res[1], 10))
+
+            if res[0] == 0 {
+                retryAfter := time.Duration(res[2]) * time.Millisecond
+                header.Set("X-RateLimit-Remaining", "0")
+                header.Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+                return c.JSON(http.StatusTooManyRequests, HttpResponseBody{ Success: false, Message: "Too many requests, try again later" })
+            }
+
+            return next(c)
+        }
+    }
+}
+
+func RateLimitByIp(c echo.Context) string {
+    return "ip:" + c.RealIP()
+}
+
+// How c.RealIP finds the client. X-Forwarded-For is only read when the
+// request comes from one of the proxies in TRUSTED_PROXIES (comma separated
+// CIDRs), otherwise clients could pick their own IP and dodge rate limits.
+func IpExtractor(logger echo.Logger) echo.IPExtractor {
+    options := make([]echo.TrustOption, 0)
+    for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+        value = strings.TrimSpace(value)
+        if value == "" {
+            continue
+        }
+        _, ipRange, err := net.ParseCIDR(value)
+        if err != nil {
+            logger.Errorf("Ignoring trusted proxy %s: %v", value, err)
+            continue
+        }
+        options = append(options, echo.TrustIPRange(ipRange))
+    }
+
+    if len(options) == 0 {
+        return echo.ExtractIPDirect()
+    }
+    // Only the ranges given are trusted, not every private address
+    options = append(options, echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false))
+    return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// Falls back to the IP for requests that are not logged in, so it has to run
+// after the JWT middleware to see the user
+func RateLimitByUser(c echo.Context) string {
+    if _, ok := c.Get("user").(*jwt.Token); ok {
+        return "user:" + GetJwtClaims(c).UserId
+    }
+    return RateLimitByIp(c)
+}
+
+func parseRateLimit(value string) (int, time.Duration, error) {
+    parts := strings.SplitN(value, "/", 2)
+    if len(parts) != 2 {
+        return 0, 0, fmt.Errorf("Invalid rate limit '%s', expected <limit>/<window>", value)
+    }
+
+    limit, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+    if err != nil {
+        return 0, 0, err
+    }
+    window, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+    if err != nil {
+        return 0, 0, err
+    }
+    return limit, window, nil
+}
+
+func retryAfterSeconds(d time.Duration) int {
+    seconds := int((d + time.Second - 1) / time.Second)
+    if seconds < 1 {
+        return 1
+    }
+    return seconds
+}
+
+// Returns how much longer logins for the username are locked, 0 if they are not
+func loginLockRemaining(rdb *redis.Client, username string) (time.Duration, error) {
+    ttl, err := rdb.PTTL(context.Background(), LOGIN_LOCK_PREFIX + username).Result()
+    if err != nil {
+        return 0, err
+    }
+    if ttl < 0 {
+        return 0, nil
+    }
+    return ttl, nil
+}
+
+// Counts a failed login, locking the username once it reaches the maximum
+// attempts. Each lockout within a day lasts twice as long as the previous one.
+// Unknown usernames are counted too so that lockouts do not reveal which exist.
+func recordLoginFailure(rdb *redis.Client, username string) (time.Duration, error) {
+    ctx := context.Background()
+    failKey := LOGIN_FAIL_PREFIX + username
+
+    fails, err := rdb.Incr(ctx, failKey).Result()
+    if err != nil {
+        return 0, err
+    }
+    if fails == 1 {
+        rdb.Expire(ctx, failKey, LOGIN_FAIL_WINDOW)
+    }
+    if fails < int64(loginMaxAttempts()) {
+        return 0, nil
+    }
+
+    countKey := LOGIN_LOCK_COUNT_PREFIX + username
+    locks, err := rdb.Incr(ctx, countKey).Result()
+    if err != nil {
+        return 0, err
+    }
+    rdb.Expire(ctx, countKey, LOGIN_LOCK_COUNT_TTL)
+
+    lockout := loginLockout()
+    for i := int64(1); i < locks && lockout < LOGIN_MAX_LOCKOUT; i++ {
+        lockout *= 2
+    }
+    if lockout > LOGIN_MAX_LOCKOUT {
+        lockout = LOGIN_MAX_LOCKOUT
+    }
+
+    pipe := rdb.TxPipeline()
+    pipe.Set(ctx, LOGIN_LOCK_PREFIX + username, 1, lockout)
+    pipe.Del(ctx, failKey)
+    if _, err := pipe.Exec(ctx); err != nil {
+        return 0, err
+    }
+    return lockout, nil
+}
+
+func clearLoginFailures(rdb *redis.Client, username string) error {
+    return rdb.Del(context.Background(), LOGIN_FAIL_PREFIX + username, LOGIN_LOCK_COUNT_PREFIX + username).Err()
+}
+
+func loginMaxAttempts() int {
+    if n, err := strconv.Atoi(os.Getenv("LOGIN_MAX_ATTEMPTS")); err == nil && n > 0 {
+        return n
+    }
+    return DEFAULT_LOGIN_MAX_ATTEMPTS
+}
+
+func loginLockout() time.Duration {
+    if d, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT")); err == nil && d > 0 {
+        return d
+    }
+    return DEFAULT_LOGIN_LOCKOUT
+}
@@ -0,0 +1,205 @@
+package model
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Fields tagged `redact:"true"` never leave the server: Redact masks them, and
+// RedactingJSONSerializer does so for every JSON response. Strings become
+// REDACTED_VALUE, anything else its zero value. Tagged fields should be
+// `json:"-"` as well, the serializer only catches what is missed.
+const REDACT_TAG = "redact"
+const REDACTED_VALUE = AUDIT_REDACTED
+
+// Registered as echo's JSON serializer so handlers cannot leak tagged fields
+// by returning a struct as is
+type RedactingJSONSerializer struct {
+    echo.DefaultJSONSerializer
+}
+
+func (serializer RedactingJSONSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+    return serializer.DefaultJSONSerializer.Serialize(c, Redact(i), indent)
+}
+
+// Returns a copy of the value with its tagged fields masked, at any depth. Use
+// it when logging values that may hold secrets.
+func Redact(value interface{}) interface{} {
+    if value == nil {
+        return nil
+    }
+    v := reflect.ValueOf(value)
+    if !valueMayRedact(v) {
+        return value
+    }
+    return redactValue(v).Interface()
+}
+
+func redactValue(v reflect.Value) reflect.Value {
+    if !valueMayRedact(v) {
+        return v
+    }
+    t := v.Type()
+
+    switch v.Kind() {
+    case reflect.Interface:
+        if v.IsNil() {
+            return v
+        }
+        out := reflect.New(t).Elem()
+        out.Set(redactValue(v.Elem()))
+        return out
+
+    case reflect.Ptr:
+        if v.IsNil() {
+            return v
+        }
+        out := reflect.New(t.Elem())
+        out.Elem().Set(redactValue(v.Elem()))
+        return out
+
+    case reflect.Struct:
+        out := reflect.New(t).Elem()
+        out.Set(v)
+        for i := 0; i < t.NumField(); i++ {
+            field := t.Field(i)
+            if !field.IsExported() {
+                continue
+            }
+            if field.Tag.Get(REDACT_TAG) == "true" {
+                out.Field(i).Set(redactedZero(field.Type))
+            } else {
+                out.Field(i).Set(redactValue(v.Field(i)))
+            }
+        }
+        return out
+
+    case reflect.Slice:
+        if v.IsNil() {
+            return v
+        }
+        out := reflect.MakeSlice(t, v.Len(), v.Len())
+        for i := 0; i < v.Len(); i++ {
+            out.Index(i).Set(redactValue(v.Index(i)))
+        }
+        return out
+
+    case reflect.Array:
+        out := reflect.New(t).Elem()
+        for i := 0; i < v.Len(); i++ {
+            out.Index(i).Set(redactValue(v.Index(i)))
+        }
+        return out
+
+    case reflect.Map:
+        if v.IsNil() {
+            return v
+        }
+        out := reflect.MakeMapWithSize(t, v.Len())
+        iter := v.MapRange()
+        for iter.Next() {
+            out.SetMapIndex(iter.Key(), redactValue(iter.Value()))
+        }
+        return out
+    }
+
+    return v
+}
+
+func redactedZero(t reflect.Type) reflect.Value {
+    if t.Kind() == reflect.String {
+        return reflect.ValueOf(REDACTED_VALUE).Convert(t)
+    }
+    return reflect.Zero(t)
+}
+
+// Whether the value holds a tagged field, so that the common case of nothing
+// to redact is left alone without copying. Only values behind interfaces,
+// e.g. HttpResponseBody.Data, are looked into; the rest is decided by type.
+func valueMayRedact(v reflect.Value) bool {
+    kinds := redactKindsOf(v.Type())
+    if kinds.tagged {
+        return true
+    }
+    if !kinds.dynamic {
+        return false
+    }
+
+    switch v.Kind() {
+    case reflect.Interface, reflect.Ptr:
+        return !v.IsNil() && valueMayRedact(v.Elem())
+    case reflect.Struct:
+        for i := 0; i < v.NumField(); i++ {
+            if v.Type().Field(i).IsExported() && valueMayRedact(v.Field(i)) {
+                return true
+            }
+        }
+    case reflect.Slice, reflect.Array:
+        for i := 0; i < v.Len(); i++ {
+            if valueMayRedact(v.Index(i)) {
+                return true
+            }
+        }
+    case reflect.Map:
+        iter := v.MapRange()
+        for iter.Next() {
+            if valueMayRedact(iter.Value()) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+type redactKinds struct {
+    // Has a tagged field whatever the value
+    tagged  bool
+    // Has interfaces, whose values may hold tagged fields
+    dynamic bool
+}
+
+var redactTypeCache sync.Map
+
+func redactKindsOf(t reflect.Type) redactKinds {
+    if cached, ok := redactTypeCache.Load(t); ok {
+        return cached.(redactKinds)
+    }
+    result := typeRedactKinds(t, make(map[reflect.Type]bool))
+    redactTypeCache.Store(t, result)
+    return result
+}
+
+func typeRedactKinds(t reflect.Type, visiting map[reflect.Type]bool) redactKinds {
+    // Types referring to themselves are decided by their other fields
+    if visiting[t] {
+        return redactKinds{}
+    }
+    visiting[t] = true
+    defer delete(visiting, t)
+
+    switch t.Kind() {
+    case reflect.Interface:
+        return redactKinds{ dynamic: true }
+    case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+        return typeRedactKinds(t.Elem(), visiting)
+    case reflect.Struct:
+        result := redactKinds{}
+        for i := 0; i < t.NumField(); i++ {
+            field := t.Field(i)
+            if !field.IsExported() {
+                continue
+            }
+            if field.Tag.Get(REDACT_TAG) == "true" {
+                result.tagged = true
+                continue
+            }
+            kinds := typeRedactKinds(field.Type, visiting)
+            result.tagged = result.tagged || kinds.tagged
+            result.dynamic = result.dynamic || kinds.dynamic
+        }
+        return result
+    }
+    return redactKinds{}
+}
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+type redactTestSecret struct {
+    Name  string
+    Token string   `redact:"true"`
+    Codes []string `redact:"true"`
+    Count int      `redact:"true"`
+}
+
+type redactTestNested struct {
+    Secret  redactTestSecret
+    Pointer *redactTestSecret
+    List    []redactTestSecret
+    Map     map[string]redactTestSecret
+    Any     interface{}
+}
+
+func redactTestValue() redactTestSecret {
+    return redactTestSecret{ Name: "name", Token: "token", Codes: []string{ "a", "b" }, Count: 2 }
+}
+
+func TestRedact(t *testing.T) {
+    redacted := redactTestSecret{ Name: "name", Token: REDACTED_VALUE }
+
+    tests := []struct {
+        name  string
+        value interface{}
+        want  interface{}
+    }{
+        { "nil", nil, nil },
+        { "untagged", HttpResponseBody{ Success: true, Message: "ok" }, HttpResponseBody{ Success: true, Message: "ok" } },
+        { "struct", redactTestValue(), redacted },
+        {
+            "pointer",
+            func() interface{} { v := redactTestValue(); return &v }(),
+            &redacted,
+        },
+        {
+            "nested",
+            redactTestNested{
+                Secret: redactTestValue(),
+                Pointer: func() *redactTestSecret { v := redactTestValue(); return &v }(),
+                List: []redactTestSecret{ redactTestValue() },
+                Map: map[string]redactTestSecret{ "k": redactTestValue() },
+                Any: redactTestValue(),
+            },
+            redactTestNested{
+                Secret: redacted,
+                Pointer: &redacted,
+                List: []redactTestSecret{ redacted },
+                Map: map[string]redactTestSecret{ "k": redacted },
+                Any: redacted,
+            },
+        },
+        {
+            "interface",
+            HttpResponseBody{ Success: true, Data: []interface{}{ redactTestValue(), "plain" } },
+            HttpResponseBody{ Success: true, Data: []interface{}{ redacted, "plain" } },
+        },
+        {
+            "map of interfaces",
+            map[string]interface{}{ "user": redactTestValue(), "count": 1 },
+            map[string]interface{}{ "user": redacted, "count": 1 },
+        },
+    }
+
+    for _, test := range tests {
+        if got := Redact(test.value); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%s: Redact = %#v, want %#v", test.name, got, test.want)
+        }
+    }
+}
+
+func TestRedactLeavesOriginal(t *testing.T) {
+    value := redactTestNested{
+        Pointer: func() *redactTestSecret { v := redactTestValue(); return &v }(),
+        List: []redactTestSecret{ redactTestValue() },
+        Any: redactTestValue(),
+    }
+
+    Redact(value)
+
+    if !reflect.DeepEqual(*value.Pointer, redactTestValue()) || !reflect.DeepEqual(value.List[0], redactTestValue()) || !reflect.DeepEqual(value.Any, redactTestValue()) {
+        t.Errorf("Redact changed its argument: %#v", value)
+    }
+}
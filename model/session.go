@@ -0,0 +1,389 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/DavidTan0527/EC-admin-dashboard/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A signed JWT, tracked so it can be listed and revoked before it expires
+type Session struct {
+    Id             string    `json:"id"`
+    UserId         string    `json:"userId"`
+    ImpersonatorId string    `json:"impersonatorId,omitempty"`
+    Ip             string    `json:"ip"`
+    UserAgent      string    `json:"userAgent"`
+    CreatedAt      time.Time `json:"createdAt"`
+    LastSeenAt     time.Time `json:"lastSeenAt"`
+    ExpiresAt      time.Time `json:"expiresAt"`
+    // Whether this is the session making the request
+    Current        bool      `json:"current"`
+}
+
+type ImpersonationResponse struct {
+    Token     string    `json:"token"`
+    UserId    string    `json:"userId"`
+    Username  string    `json:"username"`
+    ExpiresAt time.Time `json:"expiresAt"`
+}
+
+const (
+    // Hash of a session's details, expiring with its token
+    SESSION_PREFIX = "ec:session:"
+    // Set of session IDs owned by a user, stale members are dropped on listing
+    SESSION_USER_PREFIX = "ec:sessions:user:"
+    SESSION_ID_SIZE = 16
+    DEFAULT_IMPERSONATION_TTL = 30 * time.Minute
+    // Marks responses to impersonation tokens so the frontend can show it
+    IMPERSONATED_BY_HEADER = "X-Impersonated-By"
+)
+
+func (handler *UserHandler) GetSessionList(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    if claims.ImpersonatorId != "" {
+        return c.JSON(http.StatusForbidden, HttpResponseBody{ Success: false, Message: "Not available while impersonating" })
+    }
+
+    sessions, err := userSessions(handler.HandlerConns.Redis, claims.UserId)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    for i := range sessions {
+        sessions[i].Current = sessions[i].Id == claims.ID
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Success", Data: sessions })
+}
+
+func (handler *UserHandler) RevokeSession(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    if claims.ImpersonatorId != "" {
+        return c.JSON(http.StatusForbidden, HttpResponseBody{ Success: false, Message: "Not available while impersonating" })
+    }
+
+    ctx := context.Background()
+    rdb := handler.HandlerConns.Redis
+    id := c.Param("id")
+
+    // Only sessions the user owns, which includes their impersonations
+    owned, err := rdb.SIsMember(ctx, SESSION_USER_PREFIX + claims.UserId, id).Result()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    if !owned {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "ID does not exist" })
+    }
+
+    if err := revokeSessions(rdb, claims.UserId, id); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Session revoked" })
+}
+
+// Signs out everywhere except the session making the request
+func (handler *UserHandler) RevokeOtherSessions(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    if claims.ImpersonatorId != "" {
+        return c.JSON(http.StatusForbidden, HttpResponseBody{ Success: false, Message: "Not available while impersonating" })
+    }
+
+    rdb := handler.HandlerConns.Redis
+    ids, err := rdb.SMembers(context.Background(), SESSION_USER_PREFIX + claims.UserId).Result()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    others := make([]string, 0, len(ids))
+    for _, id := range ids {
+        if id != claims.ID {
+            others = append(others, id)
+        }
+    }
+
+    if err := revokeSessions(rdb, claims.UserId, others...); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Other sessions revoked" })
+}
+
+// Revokes the session making the request, which also ends an impersonation
+func (handler *UserHandler) Logout(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    if claims.ID != "" {
+        owner := claims.UserId
+        if claims.ImpersonatorId != "" {
+            owner = claims.ImpersonatorId
+        }
+        if err := revokeSessions(handler.HandlerConns.Redis, owner, claims.ID); err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+        }
+    }
+
+    if claims.ImpersonatorId == "" {
+        c.SetCookie(&http.Cookie{ Name: "ec-t", Value: "", MaxAge: -1 })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Logged out" })
+}
+
+// Issues a short-lived token acting as another user, for seeing the dashboard
+// the way they do. It is returned rather than set as the cookie so the super
+// user's own login is kept.
+func (handler *UserHandler) Impersonate(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+    if claims.UserId == id.Hex() {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Cannot impersonate yourself" })
+    }
+
+    user, err := handler.fetchUser(id.Hex())
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    if user.IsSuper {
+        return c.JSON(http.StatusForbidden, HttpResponseBody{ Success: false, Message: "Super users cannot be impersonated" })
+    }
+    if user.Disabled {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "User is disabled" })
+    }
+
+    validity := impersonationTtl()
+    impersonation := auth.NewJwtClaims()
+    impersonation.UserId = user.Id.Hex()
+    impersonation.ImpersonatorId = claims.UserId
+
+    t, err := signSessionToken(c, handler.HandlerConns, impersonation, validity, claims.UserId)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error generating JWT token" })
+    }
+
+    c.Logger().Warnf("User %s is impersonating %s", claims.UserId, user.Username)
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_IMPERSONATE, AUDIT_TARGET_USER, user.Id.Hex(), nil, nil)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Impersonating " + user.Username,
+        Data: ImpersonationResponse{
+            Token: t,
+            UserId: user.Id.Hex(),
+            Username: user.Username,
+            ExpiresAt: impersonation.ExpiresAt.Time,
+        },
+    })
+}
+
+// Updates when the session was last seen, only if it still exists. Checking
+// and writing separately could recreate a session revoked in between, without
+// its TTL.
+var sessionTouchScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+    return 0
+end
+redis.call('HSET', KEYS[1], 'last_seen_at', ARGV[1])
+return 1
+`)
+
+// Rejects tokens whose session was revoked. API keys have no session and are
+// let through; tokens without a session ID, issued before sessions were
+// tracked, are rejected as they cannot be revoked.
+func SessionGuard(conns *HandlerConns) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            claims := GetJwtClaims(c)
+            if claims.ApiKeyId != "" {
+                return next(c)
+            }
+            if claims.ID == "" {
+                return echo.NewHTTPError(http.StatusUnauthorized, "Session expired or revoked")
+            }
+
+            key := SESSION_PREFIX + claims.ID
+            touched, err := sessionTouchScript.Run(context.Background(), conns.Redis, []string{ key }, time.Now().Format(time.RFC3339)).Int()
+            if err != nil {
+                c.Logger().Error(err)
+                return echo.NewHTTPError(http.StatusInternalServerError, "Server error")
+            }
+            if touched == 0 {
+                return echo.NewHTTPError(http.StatusUnauthorized, "Session expired or revoked")
+            }
+
+            return next(c)
+        }
+    }
+}
+
+// Audits every request made with an impersonation token, reads included, and
+// marks the response as impersonated
+func ImpersonationAudit(conns *HandlerConns) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        return func(c echo.Context) error {
+            claims := GetJwtClaims(c)
+            if claims.ImpersonatorId == "" {
+                return next(c)
+            }
+
+            c.Response().Header().Set(IMPERSONATED_BY_HEADER, claims.ImpersonatorId)
+
+            // Recorded up front, as streaming requests only return once closed
+            request := c.Request().Method + " " + c.Request().URL.RequestURI()
+            if err := insertAudit(conns, newAuditActor(c), AUDIT_ACTION_REQUEST, AUDIT_TARGET_REQUEST, request, nil, nil); err != nil {
+                c.Logger().Error(err)
+            }
+
+            return next(c)
+        }
+    }
+}
+
+// Gives the claims a session ID, records the session under its owner (the
+// impersonator for impersonation tokens) and signs the token
+func signSessionToken(c echo.Context, conns *HandlerConns, claims *auth.JwtClaims, validity time.Duration, ownerId string) (string, error) {
+    id, err := randomUrlString(SESSION_ID_SIZE)
+    if err != nil {
+        return "", err
+    }
+
+    now := time.Now()
+    claims.ID = id
+    claims.IssuedAt = jwt.NewNumericDate(now)
+    claims.ExpiresAt = jwt.NewNumericDate(now.Add(validity))
+
+    t, err := signJwt(claims)
+    if err != nil {
+        return "", err
+    }
+
+    ctx := context.Background()
+    key := SESSION_PREFIX + id
+    userKey := SESSION_USER_PREFIX + ownerId
+    pipe := conns.Redis.TxPipeline()
+    pipe.HSet(ctx, key, map[string]interface{}{
+        "user_id": claims.UserId,
+        "impersonator_id": claims.ImpersonatorId,
+        "ip": c.RealIP(),
+        "user_agent": c.Request().UserAgent(),
+        "created_at": now.Format(time.RFC3339),
+        "last_seen_at": now.Format(time.RFC3339),
+        "expires_at": claims.ExpiresAt.Time.Format(time.RFC3339),
+    })
+    pipe.Expire(ctx, key, validity)
+    pipe.SAdd(ctx, userKey, id)
+    // The set lives as long as the longest session, which is at most a login
+    pipe.Expire(ctx, userKey, auth.TokenValidity)
+    if _, err := pipe.Exec(ctx); err != nil {
+        return "", err
+    }
+
+    return t, nil
+}
+
+// Newest first, forgetting sessions that already expired
+func userSessions(rdb *redis.Client, userId string) ([]Session, error) {
+    ctx := context.Background()
+    userKey := SESSION_USER_PREFIX + userId
+
+    ids, err := rdb.SMembers(ctx, userKey).Result()
+    if err != nil {
+        return nil, err
+    }
+
+    pipe := rdb.Pipeline()
+    cmds := make([]*redis.MapStringStringCmd, len(ids))
+    for i, id := range ids {
+        cmds[i] = pipe.HGetAll(ctx, SESSION_PREFIX + id)
+    }
+    if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+        return nil, err
+    }
+
+    sessions := make([]Session, 0, len(ids))
+    stale := make([]interface{}, 0)
+    for i, cmd := range cmds {
+        fields := cmd.Val()
+        if len(fields) == 0 {
+            stale = append(stale, ids[i])
+            continue
+        }
+
+        session := Session{
+            Id: ids[i],
+            UserId: fields["user_id"],
+            ImpersonatorId: fields["impersonator_id"],
+            Ip: fields["ip"],
+            UserAgent: fields["user_agent"],
+        }
+        session.CreatedAt, _ = time.Parse(time.RFC3339, fields["created_at"])
+        session.LastSeenAt, _ = time.Parse(time.RFC3339, fields["last_seen_at"])
+        session.ExpiresAt, _ = time.Parse(time.RFC3339, fields["expires_at"])
+        sessions = append(sessions, session)
+    }
+
+    if len(stale) > 0 {
+        rdb.SRem(ctx, userKey, stale...)
+    }
+
+    sort.Slice(sessions, func(i, j int) bool {
+        return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+    })
+    return sessions, nil
+}
+
+func revokeSessions(rdb *redis.Client, ownerId string, ids ...string) error {
+    if len(ids) == 0 {
+        return nil
+    }
+
+    ctx := context.Background()
+    keys := make([]string, len(ids))
+    members := make([]interface{}, len(ids))
+    for i, id := range ids {
+        keys[i] = SESSION_PREFIX + id
+        members[i] = id
+    }
+
+    pipe := rdb.TxPipeline()
+    pipe.Del(ctx, keys...)
+    pipe.SRem(ctx, SESSION_USER_PREFIX + ownerId, members...)
+    _, err := pipe.Exec(ctx)
+    return err
+}
+
+// Signs the user out everywhere, e.g. once they are deleted
+func revokeUserSessions(rdb *redis.Client, userId string) error {
+    ids, err := rdb.SMembers(context.Background(), SESSION_USER_PREFIX + userId).Result()
+    if err != nil {
+        return err
+    }
+    return revokeSessions(rdb, userId, ids...)
+}
+
+func impersonationTtl() time.Duration {
+    if d, err := time.ParseDuration(os.Getenv("IMPERSONATION_TTL")); err == nil && d > 0 {
+        return d
+    }
+    return DEFAULT_IMPERSONATION_TTL
+}
@@ -0,0 +1,492 @@
+package model
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DavidTan0527/EC-admin-dashboard/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Key pair that signs our JWTs. Keys are published in the JWKS as soon as
+// they are created but only sign from ActiveAt, so that services caching the
+// JWKS know a key before seeing tokens signed with it.
+type SigningKey struct {
+    Id         string     `bson:"_id"                  json:"kid"`
+    Algorithm  string     `bson:"algorithm"            json:"alg"`
+    // PKIX, DER encoded
+    PublicKey  []byte     `bson:"public_key"           json:"-"`
+    // PKCS #8, DER encoded and sealed with the key derived from JWT_SECRET
+    PrivateKey []byte     `bson:"private_key"          json:"-" redact:"true"`
+    CreatedAt  time.Time  `bson:"created_at"           json:"createdAt"`
+    ActiveAt   time.Time  `bson:"active_at"            json:"activeAt"`
+    // Set once a newer key takes over, leaving time for the tokens it signed
+    // to run out
+    ExpiresAt  *time.Time `bson:"expires_at,omitempty" json:"expiresAt,omitempty"`
+}
+
+type Jwk struct {
+    Kid string `json:"kid"`
+    Kty string `json:"kty"`
+    Alg string `json:"alg"`
+    Use string `json:"use"`
+    Crv string `json:"crv,omitempty"`
+    X   string `json:"x,omitempty"`
+    N   string `json:"n,omitempty"`
+    E   string `json:"e,omitempty"`
+}
+
+type JwkSet struct {
+    Keys []Jwk `json:"keys"`
+}
+
+const (
+    SIGNING_ALG_EDDSA = "EdDSA"
+    SIGNING_ALG_RS256 = "RS256"
+    DEFAULT_SIGNING_ALG = SIGNING_ALG_EDDSA
+    SIGNING_RSA_BITS = 2048
+    DEFAULT_SIGNING_KEY_MAX_AGE = 30 * 24 * time.Hour
+    DEFAULT_SIGNING_KEY_PREPUBLISH = time.Hour
+    // How often keys are reloaded, which is how long replicas take to notice
+    // a rotation
+    SIGNING_KEY_REFRESH = time.Minute
+    // Unknown key IDs reload early, but not more often than this
+    SIGNING_KEY_MIN_RELOAD = 10 * time.Second
+    JWKS_MAX_AGE = 5 * time.Minute
+)
+
+// Keys loaded from the DB, shared by every handler and the JWT middleware
+type keyring struct {
+    lock    sync.Mutex
+    coll    *mongo.Collection
+    keys    map[string]*loadedKey
+    signing *loadedKey
+    loaded  time.Time
+}
+
+type loadedKey struct {
+    SigningKey
+    method     jwt.SigningMethod
+    public     crypto.PublicKey
+    private    crypto.PrivateKey
+}
+
+var signingKeys = &keyring{}
+
+// Loads the signing keys, creating the first one if there are none yet
+func InitSigningKeys(conns *HandlerConns) error {
+    signingKeys.lock.Lock()
+    signingKeys.coll = conns.Db.Collection(COLL_NAME_SIGNING_KEY)
+    signingKeys.lock.Unlock()
+
+    count, err := signingKeys.coll.CountDocuments(context.Background(), bson.M{})
+    if err != nil {
+        return err
+    }
+    if count == 0 {
+        if _, err := createSigningKey(signingKeys.coll, time.Now()); err != nil {
+            return err
+        }
+    }
+
+    signingKeys.lock.Lock()
+    defer signingKeys.lock.Unlock()
+    return signingKeys.reload()
+}
+
+// Adds a key that takes over signing after JWT_KEY_PREPUBLISH, expiring the
+// older ones once the tokens they signed have run out. Unless forced, only
+// rotates when the newest key is older than JWT_KEY_MAX_AGE, so it is meant
+// to be run on a schedule, e.g. daily from cron.
+func RotateSigningKeys(conns *HandlerConns, force bool) (*SigningKey, error) {
+    ctx := context.Background()
+    coll := conns.Db.Collection(COLL_NAME_SIGNING_KEY)
+    now := time.Now()
+
+    if !force {
+        var newest SigningKey
+        err := coll.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{ "created_at": -1 })).Decode(&newest)
+        if err == nil && now.Sub(newest.CreatedAt) < signingKeyMaxAge() {
+            return nil, nil
+        } else if err != nil && err != mongo.ErrNoDocuments {
+            return nil, err
+        }
+    }
+
+    activeAt := now.Add(signingKeyPrepublish())
+    key, err := createSigningKey(coll, activeAt)
+    if err != nil {
+        return nil, err
+    }
+
+    // Only keys older than this one, so that two rotations running at once
+    // cannot expire each other's keys and leave none to sign with
+    expiresAt := activeAt.Add(auth.TokenValidity)
+    filter := bson.M{ "_id": bson.M{ "$ne": key.Id }, "expires_at": nil, "created_at": bson.M{ "$lt": key.CreatedAt } }
+    if _, err := coll.UpdateMany(ctx, filter, bson.M{ "$set": bson.M{ "expires_at": expiresAt } }); err != nil {
+        return nil, err
+    }
+
+    if _, err := coll.DeleteMany(ctx, bson.M{ "expires_at": bson.M{ "$lt": now } }); err != nil {
+        return nil, err
+    }
+
+    return key, nil
+}
+
+// Serves the public keys that verify our tokens, for other services
+func GetJwks(c echo.Context) error {
+    keys, err := signingKeys.all()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    set := JwkSet{ Keys: make([]Jwk, 0, len(keys)) }
+    for _, key := range keys {
+        jwk, err := key.jwk()
+        if err != nil {
+            c.Logger().Error(err)
+            continue
+        }
+        set.Keys = append(set.Keys, jwk)
+    }
+
+    c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(JWKS_MAX_AGE.Seconds())))
+    return c.JSON(http.StatusOK, set)
+}
+
+// For the JWT middleware. Tokens must name one of our keys and use its
+// algorithm, so a public key can never be taken for an HMAC secret.
+func JwtKeyFunc(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    if kid == "" {
+        return legacyJwtKey(token)
+    }
+
+    key, err := signingKeys.find(kid)
+    if err != nil {
+        return nil, err
+    }
+    if token.Method.Alg() != key.method.Alg() {
+        return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+    }
+    return key.public, nil
+}
+
+// Tokens from before asymmetric signing carry no kid and were signed with
+// JWT_SECRET. They are only accepted while JWT_ACCEPT_HS256 is on, which is
+// meant for the few days after switching over.
+func legacyJwtKey(token *jwt.Token) (interface{}, error) {
+    if os.Getenv("JWT_ACCEPT_HS256") != "true" || token.Method != jwt.SigningMethodHS256 {
+        return nil, fmt.Errorf("Token has no key ID")
+    }
+    return hex.DecodeString(os.Getenv("JWT_SECRET"))
+}
+
+func signJwt(claims jwt.Claims) (string, error) {
+    key, err := signingKeys.current()
+    if err != nil {
+        return "", err
+    }
+
+    token := jwt.NewWithClaims(key.method, claims)
+    token.Header["kid"] = key.Id
+    return token.SignedString(key.private)
+}
+
+func (ring *keyring) current() (*loadedKey, error) {
+    ring.lock.Lock()
+    defer ring.lock.Unlock()
+
+    if time.Since(ring.loaded) > SIGNING_KEY_REFRESH {
+        if err := ring.reload(); err != nil {
+            return nil, err
+        }
+    }
+    if ring.signing == nil {
+        return nil, fmt.Errorf("No active signing key")
+    }
+    return ring.signing, nil
+}
+
+// Reloads early for an unknown key, which may have just been created
+func (ring *keyring) find(kid string) (*loadedKey, error) {
+    ring.lock.Lock()
+    defer ring.lock.Unlock()
+
+    if time.Since(ring.loaded) > SIGNING_KEY_REFRESH {
+        if err := ring.reload(); err != nil {
+            return nil, err
+        }
+    }
+    key, ok := ring.keys[kid]
+    if !ok && time.Since(ring.loaded) > SIGNING_KEY_MIN_RELOAD {
+        if err := ring.reload(); err != nil {
+            return nil, err
+        }
+        key, ok = ring.keys[kid]
+    }
+    if !ok {
+        return nil, fmt.Errorf("Unknown signing key %s", kid)
+    }
+    if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+        return nil, fmt.Errorf("Signing key %s expired", kid)
+    }
+    return key, nil
+}
+
+// Keys still verifying tokens, newest first
+func (ring *keyring) all() ([]*loadedKey, error) {
+    ring.lock.Lock()
+    defer ring.lock.Unlock()
+
+    if time.Since(ring.loaded) > SIGNING_KEY_REFRESH {
+        if err := ring.reload(); err != nil {
+            return nil, err
+        }
+    }
+
+    now := time.Now()
+    keys := make([]*loadedKey, 0, len(ring.keys))
+    for _, key := range ring.keys {
+        if key.ExpiresAt == nil || key.ExpiresAt.After(now) {
+            keys = append(keys, key)
+        }
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        return keys[i].CreatedAt.After(keys[j].CreatedAt)
+    })
+    return keys, nil
+}
+
+// Must be called with the lock held
+func (ring *keyring) reload() error {
+    if ring.coll == nil {
+        return fmt.Errorf("Signing keys are not initialised")
+    }
+
+    ctx := context.Background()
+    now := time.Now()
+    filter := bson.M{
+        "$or": bson.A{
+            bson.M{ "expires_at": nil },
+            bson.M{ "expires_at": bson.M{ "$gt": now } },
+        },
+    }
+    cur, err := ring.coll.Find(ctx, filter)
+    if err != nil {
+        return err
+    }
+    stored := make([]SigningKey, 0)
+    if err := cur.All(ctx, &stored); err != nil {
+        return err
+    }
+
+    keys := make(map[string]*loadedKey, len(stored))
+    var signing *loadedKey
+    for _, key := range stored {
+        loaded, err := loadSigningKey(key)
+        if err != nil {
+            // e.g. sealed with another JWT_SECRET; the others still work
+            log.Errorf("Cannot load signing key %s: %s", key.Id, err)
+            continue
+        }
+        keys[key.Id] = loaded
+        // The newest key that is already active signs
+        if !key.ActiveAt.After(now) && (signing == nil || key.ActiveAt.After(signing.ActiveAt)) {
+            signing = loaded
+        }
+    }
+
+    ring.keys = keys
+    ring.signing = signing
+    ring.loaded = now
+    return nil
+}
+
+func loadSigningKey(key SigningKey) (*loadedKey, error) {
+    loaded := &loadedKey{ SigningKey: key }
+
+    switch key.Algorithm {
+    case SIGNING_ALG_EDDSA:
+        loaded.method = jwt.SigningMethodEdDSA
+    case SIGNING_ALG_RS256:
+        loaded.method = jwt.SigningMethodRS256
+    default:
+        return nil, fmt.Errorf("Unsupported algorithm %s", key.Algorithm)
+    }
+
+    public, err := x509.ParsePKIXPublicKey(key.PublicKey)
+    if err != nil {
+        return nil, err
+    }
+    loaded.public = public
+
+    der, err := openSigningKey(key.PrivateKey)
+    if err != nil {
+        return nil, err
+    }
+    private, err := x509.ParsePKCS8PrivateKey(der)
+    if err != nil {
+        return nil, err
+    }
+    loaded.private = private
+
+    return loaded, nil
+}
+
+func createSigningKey(coll *mongo.Collection, activeAt time.Time) (*SigningKey, error) {
+    algorithm := signingAlgorithm()
+
+    var public crypto.PublicKey
+    var private crypto.PrivateKey
+    switch algorithm {
+    case SIGNING_ALG_EDDSA:
+        pub, priv, err := ed25519.GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+        public, private = pub, priv
+    case SIGNING_ALG_RS256:
+        priv, err := rsa.GenerateKey(rand.Reader, SIGNING_RSA_BITS)
+        if err != nil {
+            return nil, err
+        }
+        public, private = &priv.PublicKey, priv
+    }
+
+    publicDer, err := x509.MarshalPKIXPublicKey(public)
+    if err != nil {
+        return nil, err
+    }
+    privateDer, err := x509.MarshalPKCS8PrivateKey(private)
+    if err != nil {
+        return nil, err
+    }
+    sealed, err := sealSigningKey(privateDer)
+    if err != nil {
+        return nil, err
+    }
+
+    kid, err := randomUrlString(12)
+    if err != nil {
+        return nil, err
+    }
+
+    key := &SigningKey{
+        Id: kid,
+        Algorithm: algorithm,
+        PublicKey: publicDer,
+        PrivateKey: sealed,
+        CreatedAt: time.Now(),
+        ActiveAt: activeAt,
+    }
+    if _, err := coll.InsertOne(context.Background(), key); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+func (key *loadedKey) jwk() (Jwk, error) {
+    jwk := Jwk{ Kid: key.Id, Alg: key.Algorithm, Use: "sig" }
+
+    switch public := key.public.(type) {
+    case ed25519.PublicKey:
+        jwk.Kty = "OKP"
+        jwk.Crv = "Ed25519"
+        jwk.X = base64.RawURLEncoding.EncodeToString(public)
+    case *rsa.PublicKey:
+        jwk.Kty = "RSA"
+        jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+        jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+    default:
+        return jwk, fmt.Errorf("Unsupported public key %T", key.public)
+    }
+    return jwk, nil
+}
+
+// Private keys are stored encrypted with AES-GCM, so reading the DB alone is
+// not enough to forge tokens
+func sealSigningKey(plain []byte) ([]byte, error) {
+    gcm, err := signingKeyCipher()
+    if err != nil {
+        return nil, err
+    }
+    nonce := make([]byte, gcm.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func openSigningKey(sealed []byte) ([]byte, error) {
+    gcm, err := signingKeyCipher()
+    if err != nil {
+        return nil, err
+    }
+    if len(sealed) < gcm.NonceSize() {
+        return nil, fmt.Errorf("Sealed key too short")
+    }
+    return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func signingKeyCipher() (cipher.AEAD, error) {
+    secret, err := hex.DecodeString(os.Getenv("JWT_SECRET"))
+    if err != nil || len(secret) == 0 {
+        return nil, fmt.Errorf("Invalid JWT secret")
+    }
+    derived := sha256.Sum256(secret)
+    block, err := aes.NewCipher(derived[:])
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// JWT_ALGORITHM picks the algorithm of new keys, EdDSA or RS256. Existing
+// keys keep theirs, so changing it takes effect at the next rotation.
+func signingAlgorithm() string {
+    switch strings.TrimSpace(os.Getenv("JWT_ALGORITHM")) {
+    case SIGNING_ALG_RS256:
+        return SIGNING_ALG_RS256
+    default:
+        return DEFAULT_SIGNING_ALG
+    }
+}
+
+func signingKeyMaxAge() time.Duration {
+    if d, err := time.ParseDuration(os.Getenv("JWT_KEY_MAX_AGE")); err == nil && d > 0 {
+        return d
+    }
+    return DEFAULT_SIGNING_KEY_MAX_AGE
+}
+
+func signingKeyPrepublish() time.Duration {
+    if d, err := time.ParseDuration(os.Getenv("JWT_KEY_PREPUBLISH")); err == nil && d >= 0 {
+        return d
+    }
+    return DEFAULT_SIGNING_KEY_PREPUBLISH
+}
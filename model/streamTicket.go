@@ -0,0 +1,117 @@
+package model
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DavidTan0527/EC-admin-dashboard/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/websocket"
+)
+
+type StreamTicketHandler struct {
+    *HandlerConns
+}
+
+type StreamTicket struct {
+    Ticket    string    `json:"ticket"`
+    ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Browsers cannot set headers on WebSocket and EventSource requests, so they
+// trade their token for a ticket first and pass it in the query string. A
+// ticket is short lived and works once, so it is no use when found in logs.
+const (
+    TOKEN_KIND_STREAM = "stream"
+    STREAM_TICKET_TTL = 30 * time.Second
+    STREAM_TICKET_PARAM = "ticket"
+)
+
+// Pages on these origins may open WebSockets, besides APP_URL and the API's
+// own host. Comma separated, e.g. https://admin.example.com
+const ALLOWED_ORIGINS_ENV = "ALLOWED_ORIGINS"
+
+func (handler *StreamTicketHandler) CreateStreamTicket(c echo.Context) error {
+    claims := GetJwtClaims(c)
+
+    ticket, err := createOneTimeToken(handler.HandlerConns.Redis, TOKEN_KIND_STREAM, claims, STREAM_TICKET_TTL)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error creating ticket" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: StreamTicket{ Ticket: ticket, ExpiresAt: time.Now().Add(STREAM_TICKET_TTL) },
+    })
+}
+
+// Takes the claims from a ticket when one is given, otherwise authenticates
+// with the fallback. The claims are checked by the session and user guards
+// as for any token.
+func StreamTicketAuth(conns *HandlerConns, fallback echo.MiddlewareFunc) echo.MiddlewareFunc {
+    return func(next echo.HandlerFunc) echo.HandlerFunc {
+        withFallback := fallback(next)
+
+        return func(c echo.Context) error {
+            ticket := c.QueryParam(STREAM_TICKET_PARAM)
+            if ticket == "" {
+                return withFallback(c)
+            }
+
+            claims := new(auth.JwtClaims)
+            if err := useOneTimeToken(conns.Redis, TOKEN_KIND_STREAM, ticket, claims); err == redis.Nil {
+                return echo.NewHTTPError(http.StatusUnauthorized, "Invalid or expired ticket")
+            } else if err != nil {
+                c.Logger().Error(err)
+                return echo.NewHTTPError(http.StatusInternalServerError, "Server error")
+            }
+            c.Set("user", &jwt.Token{ Claims: claims, Valid: true })
+
+            return next(c)
+        }
+    }
+}
+
+// Handshake for websocket.Server. Clients without an Origin header are not
+// browsers, so cannot be used for cross-site requests and are let through.
+func checkWebSocketOrigin(config *websocket.Config, req *http.Request) error {
+    origin, err := websocket.Origin(config, req)
+    if err != nil {
+        return err
+    }
+    config.Origin = origin
+    if origin == nil {
+        return nil
+    }
+
+    if strings.EqualFold(origin.Host, req.Host) {
+        return nil
+    }
+    for _, allowed := range allowedOrigins() {
+        if strings.EqualFold(origin.Scheme, allowed.Scheme) && strings.EqualFold(origin.Host, allowed.Host) {
+            return nil
+        }
+    }
+    return websocket.ErrBadWebSocketOrigin
+}
+
+func allowedOrigins() []*url.URL {
+    origins := make([]*url.URL, 0)
+    for _, value := range append([]string{ os.Getenv("APP_URL") }, strings.Split(os.Getenv(ALLOWED_ORIGINS_ENV), ",")...) {
+        value = strings.TrimSpace(value)
+        if value == "" {
+            continue
+        }
+        if origin, err := url.Parse(value); err == nil && origin.Host != "" {
+            origins = append(origins, origin)
+        }
+    }
+    return origins
+}
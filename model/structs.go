@@ -11,11 +11,21 @@ const (
     COLL_NAME_TABLE_DATA = "TableData"
     COLL_NAME_CHART = "Chart"
     COLL_NAME_CHART_VIEW = "ChartView"
+    COLL_NAME_ATTACHMENT = "Attachment"
+    COLL_NAME_COMMENT = "Comment"
+    COLL_NAME_WEBHOOK = "Webhook"
+    COLL_NAME_WEBHOOK_DELIVERY = "WebhookDelivery"
+    COLL_NAME_AUDIT = "AuditLog"
+    COLL_NAME_API_KEY = "ApiKey"
+    COLL_NAME_SIGNING_KEY = "SigningKey"
+    COLL_NAME_PERMISSION_GRANT = "PermissionGrant"
+    COLL_NAME_PERMISSION_KEY = "PermissionKey"
 )
 
 type HandlerConns struct {
-    Db    *mongo.Database
-    Redis *redis.Client
+    Db     *mongo.Database
+    Redis  *redis.Client
+    Mailer Mailer
 }
 
 type HttpResponseBody struct {
@@ -77,7 +77,7 @@ func (handler *TableHandler) GetTableList(c echo.Context) error {
             return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
         }
 
-        isAllowed, err := handler.checkTablePerm(table, userId)
+        isAllowed, err := handler.checkTablePerm(table, userId, claims.Scope)
         if err != nil {
             c.Logger().Error(err)
             return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
@@ -122,7 +122,7 @@ func (handler *TableHandler) GetTable(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
-    isAllowed, err := handler.checkTablePerm(table, userId)
+    isAllowed, err := handler.checkTablePerm(table, userId, claims.Scope)
     if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: err.Error() })
@@ -172,7 +172,7 @@ func (handler *TableHandler) GetTableFull(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
-    isAllowed, err := handler.checkTablePerm(table, userId)
+    isAllowed, err := handler.checkTablePerm(table, userId, claims.Scope)
     if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: err.Error() })
@@ -240,6 +240,12 @@ func (handler *TableHandler) CreateTable(c echo.Context) error {
         return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
     }
 
+    if message, err := validateResourcePermKey(handler.HandlerConns, body.PermKey); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+
     body.Id = primitive.NewObjectID()
     if body.Fields == nil {
         body.Fields = make([]map[string]interface{}, 0)
@@ -260,6 +266,11 @@ func (handler *TableHandler) CreateTable(c echo.Context) error {
     message := fmt.Sprintf("Table %s created", body.Name)
     c.Logger().Info(message)
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_TABLE, body.Id.Hex(), nil, body)
+
+    claims := GetJwtClaims(c)
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_TABLE, Action: EVENT_ACTION_CREATE, Id: body.Id, UserId: claims.UserId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: message,
@@ -293,19 +304,32 @@ func (handler *TableHandler) EditTableData(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
-    if perm, err := handler.checkTablePerm(table, userId); err != nil {
+    if perm, err := handler.checkTablePerm(table, userId, claims.Scope); err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: err.Error() })
     } else if !perm {
         return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "No permission" })
     }
 
+    beforeRows, _, err := handler.fetchTableRows(table, year, month)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    before := HttpTable{ Fields: table.Fields, Rows: beforeRows }
+
     if err := handler.updateTableData(table, year, month, body); err != nil {
         return handleMongoErr(c, err)
     }
 
     c.Logger().Infof("Updating table %s", id)
 
+    after := HttpTable{ Fields: body.Fields, Rows: body.Rows }
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_TABLE_DATA, collabRoomKey(id, year, month), before, after)
+
+    // Let anyone with the month open over the socket know to refetch it
+    publishCollab(handler.HandlerConns.Redis, collabRoomKey(id, year, month), CollabMessage{ Type: COLLAB_MSG_RELOAD, UserId: userId })
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_TABLE_DATA, Action: EVENT_ACTION_UPDATE, Id: id, Year: year, Month: month, UserId: userId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: "Changes saved",
@@ -326,6 +350,12 @@ func (handler *TableHandler) EditTableMetadata(c echo.Context) error {
         return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
     }
 
+    if message, err := validateResourcePermKey(handler.HandlerConns, body.PermKey); err != nil {
+        return handleMongoErr(c, err)
+    } else if message != "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: message })
+    }
+
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_TABLE)
 
@@ -339,9 +369,15 @@ func (handler *TableHandler) EditTableMetadata(c echo.Context) error {
 
     c.Logger().Infof("Editing table %s metadata", id)
 
+    var before Table
+    opt := options.FindOne().SetProjection(TABLE_BASIC_PROJECTION)
+    if err := coll.FindOne(ctx, filter, opt).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
     claims := GetJwtClaims(c)
     userId := claims.UserId
-    if perm, err := handler.fetchCheckTablePerm(id, userId); err != nil {
+    if perm, err := handler.checkTablePerm(before, userId, claims.Scope); err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: err.Error() })
     } else if !perm {
@@ -352,6 +388,12 @@ func (handler *TableHandler) EditTableMetadata(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_TABLE, id.Hex(),
+        HttpTable{ Id: id, Name: before.Name, PermKey: before.PermKey },
+        HttpTable{ Id: id, Name: body.Name, PermKey: body.PermKey })
+
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_TABLE, Action: EVENT_ACTION_UPDATE, Id: id, UserId: userId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: "Edited",
@@ -387,9 +429,15 @@ func (handler *TableHandler) EditTableSort(c echo.Context) error {
 
     c.Logger().Infof("Editing table %s sort to %d", id, body.SortKey)
 
+    var before Table
+    opt := options.FindOne().SetProjection(bson.M{ "perm_key": 1, "sort_key": 1 })
+    if err := coll.FindOne(ctx, filter, opt).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
     claims := GetJwtClaims(c)
     userId := claims.UserId
-    if perm, err := handler.fetchCheckTablePerm(id, userId); err != nil {
+    if perm, err := handler.checkTablePerm(before, userId, claims.Scope); err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: err.Error() })
     } else if !perm {
@@ -400,6 +448,10 @@ func (handler *TableHandler) EditTableSort(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_TABLE, id.Hex(), EditTableSortBody{ SortKey: before.SortKey }, body)
+
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_TABLE, Action: EVENT_ACTION_UPDATE, Id: id, UserId: userId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: "Edited",
@@ -419,7 +471,13 @@ func (handler *TableHandler) DeleteTable(c echo.Context) error {
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_TABLE)
 
-    if perm, err := handler.fetchCheckTablePerm(id, userId); err != nil {
+    var before Table
+    opt := options.FindOne().SetProjection(TABLE_METADATA_PROJECTION)
+    if err := coll.FindOne(ctx, bson.M{ "_id": id }, opt).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    if perm, err := handler.checkTablePerm(before, userId, claims.Scope); err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
     } else if !perm {
@@ -430,8 +488,19 @@ func (handler *TableHandler) DeleteTable(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_DELETE, AUDIT_TARGET_TABLE, id.Hex(), before, nil)
+
+    if err := deleteTableAttachments(handler.HandlerConns.Db, id); err != nil {
+        c.Logger().Error(err)
+    }
+    if err := deleteTargetComments(handler.HandlerConns.Db, COMMENT_TARGET_TABLE, id); err != nil {
+        c.Logger().Error(err)
+    }
+
     c.Logger().Infof("Table %s deleted", id)
 
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_TABLE, Action: EVENT_ACTION_DELETE, Id: id, UserId: userId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{
         Success: true,
         Message: "Successfully deleted table",
@@ -460,7 +529,7 @@ func (handler *TableHandler) GetAllTableSchema(c echo.Context) error {
             return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
         }
 
-        isAllowed, err := handler.checkTablePerm(table, userId)
+        isAllowed, err := handler.checkTablePerm(table, userId, claims.Scope)
         if err != nil {
             c.Logger().Error(err)
             return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
@@ -498,7 +567,7 @@ func (handler *TableHandler) GetTableSchema(c echo.Context) error {
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_TABLE)
 
-    if perm, err := handler.fetchCheckTablePerm(id, userId); err != nil {
+    if perm, err := handler.fetchCheckTablePerm(id, userId, claims.Scope); err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
     } else if !perm {
@@ -529,7 +598,7 @@ func (handler *TableHandler) GetTableSchema(c echo.Context) error {
     })
 }
 
-func (handler *TableHandler) fetchCheckTablePerm(id primitive.ObjectID, userId string) (bool, error) {
+func (handler *TableHandler) fetchCheckTablePerm(id primitive.ObjectID, userId string, scope []string) (bool, error) {
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_TABLE)
 
@@ -541,14 +610,14 @@ func (handler *TableHandler) fetchCheckTablePerm(id primitive.ObjectID, userId s
         return false, err
     }
     
-    return handler.checkTablePerm(table, userId)
+    return handler.checkTablePerm(table, userId, scope)
 }
 
-func (handler *TableHandler) checkTablePerm(table Table, userId string) (bool, error) {
+func (handler *TableHandler) checkTablePerm(table Table, userId string, scope []string) (bool, error) {
     if table.PermKey == "" {
         return true, nil
     }
-    return checkPerm(handler.HandlerConns, userId, table.PermKey)
+    return checkPerm(handler.HandlerConns, userId, scope, table.PermKey)
 }
 
 func (handler *TableHandler) fetchTableRows(table Table, year string, month string) (ObjArray, bool, error) {
@@ -0,0 +1,258 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    SEARCH_DEFAULT_LIMIT = 50
+    SEARCH_MAX_LIMIT = 200
+    SEARCH_SNIPPET_RADIUS = 30
+)
+
+var TABLE_SEARCH_PROJECTION = bson.M{ "_id": 1, "name": 1, "perm_key": 1, "data": 1 }
+
+// Text index over every string in the rows. Without a language, values are
+// matched as written rather than stemmed or dropped as stop words.
+const TABLE_SEARCH_INDEX = "rows_text"
+
+type TableSearchMatch struct {
+    TableId    primitive.ObjectID     `json:"tableId"`
+    TableName  string                 `json:"tableName"`
+    Year       string                 `json:"year"`
+    Month      string                 `json:"month"`
+    RowIndex   int                    `json:"rowIndex"`
+    Row        map[string]interface{} `json:"row"`
+    Highlights []SearchHighlight      `json:"highlights"`
+}
+
+// Snippet is a window of the matched value; Start and End are rune offsets of
+// the match inside Snippet so the frontend can highlight it.
+type SearchHighlight struct {
+    Field   string `json:"field"`
+    Snippet string `json:"snippet"`
+    Start   int    `json:"start"`
+    End     int    `json:"end"`
+}
+
+type tablePeriod struct {
+    table *Table
+    year  string
+    month string
+    // Position of the table in the table list, for ordering matches
+    order int
+}
+
+// Creates the text index SearchTable narrows data documents down with. Does
+// nothing if it already exists.
+func InitTableSearchIndex(conns *HandlerConns) error {
+    model := mongo.IndexModel{
+        Keys: bson.D{ { Key: "$**", Value: "text" } },
+        Options: options.Index().SetName(TABLE_SEARCH_INDEX).SetDefaultLanguage("none"),
+    }
+    _, err := conns.Db.Collection(COLL_NAME_TABLE_DATA).Indexes().CreateOne(context.Background(), model)
+    return err
+}
+
+// Matches come in the order of the table list, then oldest period first and
+// by row, so a limit always cuts off the same ones
+func (handler *TableHandler) SearchTable(c echo.Context) error {
+    claims := GetJwtClaims(c)
+    userId := claims.UserId
+
+    query := strings.TrimSpace(c.QueryParam("q"))
+    if query == "" {
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Search query is required" })
+    }
+
+    limit := SEARCH_DEFAULT_LIMIT
+    if l := c.QueryParam("limit"); l != "" {
+        n, err := strconv.Atoi(l)
+        if err != nil || n <= 0 {
+            return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: "Invalid limit" })
+        }
+        if n < SEARCH_MAX_LIMIT {
+            limit = n
+        } else {
+            limit = SEARCH_MAX_LIMIT
+        }
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_TABLE)
+
+    opts := options.Find().SetProjection(TABLE_SEARCH_PROJECTION).SetSort(SORT_FIELDS)
+    cur, err := coll.Find(ctx, bson.M{}, opts)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    tables := make([]Table, 0)
+    if err := cur.All(ctx, &tables); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    // Only look into data documents of tables the user is allowed to see
+    periods := make(map[primitive.ObjectID]tablePeriod)
+    dataIds := make([]primitive.ObjectID, 0)
+    for i := range tables {
+        isAllowed, err := handler.checkTablePerm(tables[i], userId, claims.Scope)
+        if err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error checking permission key" })
+        }
+        if !isAllowed {
+            continue
+        }
+
+        for year, yearIds := range tables[i].Data {
+            for month, dataId := range yearIds {
+                periods[dataId] = tablePeriod{ table: &tables[i], year: year, month: month, order: i }
+                dataIds = append(dataIds, dataId)
+            }
+        }
+    }
+
+    result := make([]TableSearchMatch, 0)
+    if len(dataIds) == 0 {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Success", Data: result })
+    }
+
+    // The index finds the documents holding every word of the query as a
+    // phrase, the rows in them are matched below for highlighting
+    filter := bson.M{
+        "_id": bson.M{ "$in": dataIds },
+        "$text": bson.M{ "$search": "\"" + strings.ReplaceAll(query, "\"", " ") + "\"" },
+    }
+    dataColl := handler.HandlerConns.Db.Collection(COLL_NAME_TABLE_DATA)
+    dataCur, err := dataColl.Find(ctx, filter)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    tableData := make([]TableData, 0)
+    if err := dataCur.All(ctx, &tableData); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    sort.Slice(tableData, func(i, j int) bool {
+        a, b := periods[tableData[i].Id], periods[tableData[j].Id]
+        if a.order != b.order {
+            return a.order < b.order
+        }
+        if keyA, keyB := periodKey(a.year, a.month), periodKey(b.year, b.month); keyA != keyB {
+            return keyA < keyB
+        }
+        if a.year != b.year {
+            return a.year < b.year
+        }
+        return a.month < b.month
+    })
+
+    needle := []rune(strings.ToLower(query))
+
+    for _, data := range tableData {
+        period := periods[data.Id]
+        for i, row := range data.Rows {
+            highlights := searchRow(row, needle)
+            if len(highlights) == 0 {
+                continue
+            }
+
+            result = append(result, TableSearchMatch{
+                TableId: period.table.Id,
+                TableName: period.table.Name,
+                Year: period.year,
+                Month: period.month,
+                RowIndex: i,
+                Row: row,
+                Highlights: highlights,
+            })
+
+            if len(result) >= limit {
+                break
+            }
+        }
+        if len(result) >= limit {
+            break
+        }
+    }
+
+    c.Logger().Infof("Search for '%s' returned %d rows", query, len(result))
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: result,
+    })
+}
+
+func searchRow(row map[string]interface{}, needle []rune) []SearchHighlight {
+    fields := make([]string, 0, len(row))
+    for field := range row {
+        fields = append(fields, field)
+    }
+    sort.Strings(fields)
+
+    highlights := make([]SearchHighlight, 0)
+    for _, field := range fields {
+        str, ok := row[field].(string)
+        if !ok {
+            continue
+        }
+
+        if highlight, ok := highlightMatch(str, needle); ok {
+            highlight.Field = field
+            highlights = append(highlights, highlight)
+        }
+    }
+    return highlights
+}
+
+// Case-insensitive substring match, done on runes so offsets stay valid for
+// non-ASCII values.
+func highlightMatch(value string, needle []rune) (SearchHighlight, bool) {
+    haystack := []rune(value)
+    idx := -1
+    for i := 0; i + len(needle) <= len(haystack); i++ {
+        matched := true
+        for j, r := range needle {
+            if unicode.ToLower(haystack[i + j]) != r {
+                matched = false
+                break
+            }
+        }
+        if matched {
+            idx = i
+            break
+        }
+    }
+    if idx < 0 {
+        return SearchHighlight{}, false
+    }
+
+    start := idx - SEARCH_SNIPPET_RADIUS
+    if start < 0 {
+        start = 0
+    }
+    end := idx + len(needle) + SEARCH_SNIPPET_RADIUS
+    if end > len(haystack) {
+        end = len(haystack)
+    }
+
+    return SearchHighlight{
+        Snippet: string(haystack[start:end]),
+        Start: idx - start,
+        End: idx - start + len(needle),
+    }, true
+}
@@ -0,0 +1,742 @@
+package model
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RFC 6238 with the parameters authenticator apps assume by default
+const (
+    TOTP_PERIOD = 30
+    TOTP_DIGITS = 6
+    // Number of periods either side of now still accepted, for clock drift
+    TOTP_SKEW = 1
+    TOTP_SECRET_SIZE = 20
+    TOTP_RECOVERY_CODE_COUNT = 10
+    DEFAULT_TOTP_ISSUER = "EC Admin Dashboard"
+)
+
+const (
+    TOTP_ENROLL_PREFIX = "ec:totp:enroll:"
+    TOTP_ENROLL_TTL = 10 * time.Minute
+    TOTP_CHALLENGE_PREFIX = "ec:login:2fa:"
+    TOTP_CHALLENGE_TTL = 5 * time.Minute
+    TOTP_CHALLENGE_MAX_ATTEMPTS = 5
+    // Challenge field with the single sign-on groups to sync once answered
+    TOTP_CHALLENGE_OIDC_GROUPS = "oidc_groups"
+    // Challenge field with the hash of TOTP_CHALLENGE_COOKIE, see
+    // bindTwoFactorChallenge
+    TOTP_CHALLENGE_BINDING = "binding"
+    // Challenge field marking a bound challenge whose user has to enroll
+    TOTP_CHALLENGE_ENROLL = "enroll"
+    TOTP_CHALLENGE_COOKIE = "ec-2fa"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Stores the secret on a challenge unless it has one, and returns the one it
+// has. Nil once the challenge expired, so it is not recreated without a TTL.
+var totpEnrollScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return false
+end
+redis.call("HSETNX", KEYS[1], "secret", ARGV[1])
+return redis.call("HGET", KEYS[1], "secret")
+`)
+
+type TotpEnrollResponse struct {
+    Secret string `json:"secret"`
+    // otpauth:// URI to render as a QR code
+    Url    string `json:"url"`
+}
+
+// Returned by LoginUser instead of a token when a second step is needed.
+// Enroll is set when the user has to set up 2FA before they can log in.
+type TotpLoginChallenge struct {
+    Challenge string              `json:"challenge"`
+    Enroll    *TotpEnrollResponse `json:"enroll,omitempty"`
+    // Set instead of Enroll for single sign-on, whose secret is fetched with
+    // POST /login/2fa/enroll
+    MustEnroll bool `json:"must_enroll,omitempty"`
+}
+
+type TotpLoginEnrollResponse struct {
+    Token         string   `json:"token"`
+    RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TotpLoginBody struct {
+    Challenge string `json:"challenge" validate:"required"`
+    Code      string `json:"code"      validate:"required"`
+}
+
+type TotpChallengeBody struct {
+    Challenge string `json:"challenge" validate:"required"`
+}
+
+type TotpCodeBody struct {
+    Code string `json:"code" validate:"required"`
+}
+
+type DisableTotpBody struct {
+    Password string `json:"password" validate:"required"`
+    Code     string `json:"code"     validate:"required"`
+}
+
+// Second login step, taking either a TOTP code or a recovery code
+func (handler *UserHandler) LoginTwoFactor(c echo.Context) error {
+    body := new(TotpLoginBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    ctx := context.Background()
+    rdb := handler.HandlerConns.Redis
+    key := TOTP_CHALLENGE_PREFIX + body.Challenge
+
+    challenge, err := rdb.HGetAll(ctx, key).Result()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    if len(challenge) == 0 {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Login expired, please log in again" })
+    }
+    if !twoFactorChallengeBound(c, challenge) {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Finish logging in from the browser that started it" })
+    }
+
+    user, err := handler.fetchUser(challenge["user_id"])
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    if remaining, err := loginLockRemaining(rdb, user.Username); err != nil {
+        c.Logger().Error(err)
+    } else if remaining > 0 {
+        rdb.Del(ctx, key)
+        c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(remaining)))
+        return c.JSON(http.StatusTooManyRequests, HttpResponseBody{ Success: false, Message: "Too many failed attempts, try again later" })
+    }
+
+    var recoveryCodes []string
+    var correct bool
+
+    if secret := challenge["secret"]; secret != "" {
+        // Enrolling as part of logging in
+        if step, ok := verifyTotp(secret, body.Code, 0); ok {
+            before := *user
+            if recoveryCodes, err = handler.enableTotp(user, secret, step); err != nil {
+                c.Logger().Error(err)
+                return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+            }
+            recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, user.Id.Hex(), before, user)
+            correct = true
+        }
+    } else if correct, err = handler.useTotpCode(user, body.Code); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    if !correct {
+        if lockout, err := recordLoginFailure(rdb, user.Username); err != nil {
+            c.Logger().Error(err)
+        } else if lockout > 0 {
+            c.Logger().Warnf("Logins for %s locked for %s after too many failed attempts", user.Username, lockout)
+        }
+        if attempts, err := rdb.HIncrBy(ctx, key, "attempts", 1).Result(); err == nil && attempts >= TOTP_CHALLENGE_MAX_ATTEMPTS {
+            rdb.Del(ctx, key)
+        }
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Invalid two-factor code" })
+    }
+
+    rdb.Del(ctx, key)
+    if err := clearLoginFailures(rdb, user.Username); err != nil {
+        c.Logger().Error(err)
+    }
+    if challenge[TOTP_CHALLENGE_BINDING] != "" {
+        c.SetCookie(&http.Cookie{ Name: TOTP_CHALLENGE_COOKIE, Value: "", Path: "/", MaxAge: -1 })
+    }
+
+    if groups, ok := challenge[TOTP_CHALLENGE_OIDC_GROUPS]; ok {
+        if err := syncChallengeGroups(c, handler.HandlerConns, user, groups); err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+        }
+    }
+
+    return handler.finishLogin(c, user, recoveryCodes)
+}
+
+// Starts enrolling the logged in user, which ConfirmTotp completes
+func (handler *UserHandler) EnrollTotp(c echo.Context) error {
+    claims := GetJwtClaims(c)
+
+    user, err := handler.fetchUser(claims.UserId)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    if user.TotpEnabled {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Two-factor authentication is already enabled" })
+    }
+
+    secret, err := newTotpSecret()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error generating secret" })
+    }
+
+    if err := handler.HandlerConns.Redis.Set(context.Background(), TOTP_ENROLL_PREFIX + claims.UserId, secret, TOTP_ENROLL_TTL).Err(); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Scan the code and confirm with a generated code",
+        Data: TotpEnrollResponse{ Secret: secret, Url: totpUrl(user.Username, secret) },
+    })
+}
+
+func (handler *UserHandler) ConfirmTotp(c echo.Context) error {
+    body := new(TotpCodeBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+    ctx := context.Background()
+    rdb := handler.HandlerConns.Redis
+
+    secret, err := rdb.Get(ctx, TOTP_ENROLL_PREFIX + claims.UserId).Result()
+    if err == redis.Nil {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "No enrollment in progress" })
+    } else if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    step, ok := verifyTotp(secret, body.Code, 0)
+    if !ok {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Invalid two-factor code" })
+    }
+
+    user, err := handler.fetchUser(claims.UserId)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    before := *user
+
+    recoveryCodes, err := handler.enableTotp(user, secret, step)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    rdb.Del(ctx, TOTP_ENROLL_PREFIX + claims.UserId)
+
+    c.Logger().Infof("User %s enabled two-factor authentication", user.Username)
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, user.Id.Hex(), before, user)
+
+    // The recovery codes are only ever shown here
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Two-factor authentication enabled",
+        Data: recoveryCodes,
+    })
+}
+
+func (handler *UserHandler) DisableTotp(c echo.Context) error {
+    body := new(DisableTotpBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+
+    user, err := handler.fetchUser(claims.UserId)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    if !user.TotpEnabled {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Two-factor authentication is not enabled" })
+    }
+    if user.IsSuper && superRequiresTotp() {
+        return c.JSON(http.StatusForbidden, HttpResponseBody{ Success: false, Message: "Two-factor authentication is required for super users" })
+    }
+
+    correct, err := verifyPassword(body.Password, user.Salt, user.Password)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    if correct {
+        correct, err = handler.useTotpCode(user, body.Code)
+        if err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+        }
+    }
+    if !correct {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Incorrect password or two-factor code" })
+    }
+
+    before := *user
+    if err := handler.disableTotp(user); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    c.Logger().Infof("User %s disabled two-factor authentication", user.Username)
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, user.Id.Hex(), before, user)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Two-factor authentication disabled" })
+}
+
+// Replaces all recovery codes, e.g. when running low or some were exposed
+func (handler *UserHandler) RegenerateRecoveryCodes(c echo.Context) error {
+    body := new(TotpCodeBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    claims := GetJwtClaims(c)
+
+    user, err := handler.fetchUser(claims.UserId)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+    if !user.TotpEnabled {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Two-factor authentication is not enabled" })
+    }
+
+    if correct, err := handler.useTotpCode(user, body.Code); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    } else if !correct {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Invalid two-factor code" })
+    }
+
+    codes, hashes, err := newRecoveryCodes()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    before := *user
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    if _, err := coll.UpdateByID(context.Background(), user.Id, bson.M{ "$set": bson.M{ "recovery_codes": hashes } }); err != nil {
+        return handleMongoErr(c, err)
+    }
+    user.RecoveryCodes = hashes
+
+    c.Logger().Infof("User %s regenerated recovery codes", user.Username)
+
+    // Recovery codes are redacted from both sides of the entry
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, user.Id.Hex(), before, user)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Recovery codes regenerated",
+        Data: codes,
+    })
+}
+
+// Lets a super user turn 2FA off for someone who lost their device and their
+// recovery codes
+func (handler *UserHandler) ResetTotp(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    user, err := handler.fetchUser(id.Hex())
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    before := *user
+    if err := handler.disableTotp(user); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    c.Logger().Infof("Two-factor authentication reset for user %s", user.Username)
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, user.Id.Hex(), before, user)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Two-factor authentication reset" })
+}
+
+// The challenge of a login started elsewhere, i.e. single sign-on, which
+// hands its ID to the frontend in the redirect. The ID can leak from there
+// through history or logs, so the enrollment secret is never returned here,
+// see EnrollTwoFactorLogin.
+func (handler *UserHandler) GetTwoFactorChallenge(c echo.Context) error {
+    challenge, err := handler.HandlerConns.Redis.HGetAll(context.Background(), TOTP_CHALLENGE_PREFIX + c.Param("challenge")).Result()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    if len(challenge) == 0 {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Login expired, please log in again" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: TotpLoginChallenge{ Challenge: c.Param("challenge"), MustEnroll: challenge[TOTP_CHALLENGE_ENROLL] != "" },
+    })
+}
+
+// Starts enrolling for a single sign-on login that needs 2FA set up, which
+// LoginTwoFactor completes. Needs the cookie the login was bound to as well
+// as the challenge. Asking again returns the same secret.
+func (handler *UserHandler) EnrollTwoFactorLogin(c echo.Context) error {
+    body := new(TotpChallengeBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    ctx := context.Background()
+    rdb := handler.HandlerConns.Redis
+    key := TOTP_CHALLENGE_PREFIX + body.Challenge
+
+    challenge, err := rdb.HGetAll(ctx, key).Result()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+    if len(challenge) == 0 {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Login expired, please log in again" })
+    }
+    if challenge[TOTP_CHALLENGE_BINDING] == "" || !twoFactorChallengeBound(c, challenge) {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Finish logging in from the browser that started it" })
+    }
+
+    if challenge[TOTP_CHALLENGE_ENROLL] == "" {
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Two-factor authentication is already enabled" })
+    }
+
+    secret, err := newTotpSecret()
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error generating secret" })
+    }
+    secret, err = totpEnrollScript.Run(ctx, rdb, []string{ key }, secret).Text()
+    if err == redis.Nil {
+        return c.JSON(http.StatusUnauthorized, HttpResponseBody{ Success: false, Message: "Login expired, please log in again" })
+    } else if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    user, err := handler.fetchUser(challenge["user_id"])
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Scan the code and log in with a generated code",
+        Data: TotpEnrollResponse{ Secret: secret, Url: totpUrl(user.Username, secret) },
+    })
+}
+
+func (handler *UserHandler) startTwoFactorLogin(c echo.Context, user *User) error {
+    response, err := createTwoFactorChallenge(handler.HandlerConns, user, nil)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    }
+
+    message := "Two-factor code required"
+    if response.Enroll != nil {
+        message = "Two-factor authentication must be set up before logging in"
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: message,
+        Data: response,
+    })
+}
+
+// Stores the second login step for LoginTwoFactor, with any extra fields the
+// login needs once answered. Users without 2FA, who need it as super users,
+// get a secret to enroll with.
+func createTwoFactorChallenge(conns *HandlerConns, user *User, extra map[string]interface{}) (*TotpLoginChallenge, error) {
+    challengeBytes := make([]byte, 32)
+    if _, err := rand.Read(challengeBytes); err != nil {
+        return nil, err
+    }
+
+    response := &TotpLoginChallenge{ Challenge: hex.EncodeToString(challengeBytes) }
+    fields := map[string]interface{}{ "user_id": user.Id.Hex() }
+    for field, value := range extra {
+        fields[field] = value
+    }
+
+    if !user.TotpEnabled {
+        // Bound challenges get their secret from EnrollTwoFactorLogin
+        if _, ok := fields[TOTP_CHALLENGE_BINDING]; ok {
+            fields[TOTP_CHALLENGE_ENROLL] = "1"
+        } else {
+            secret, err := newTotpSecret()
+            if err != nil {
+                return nil, err
+            }
+            fields["secret"] = secret
+            response.Enroll = &TotpEnrollResponse{ Secret: secret, Url: totpUrl(user.Username, secret) }
+        }
+    }
+
+    ctx := context.Background()
+    key := TOTP_CHALLENGE_PREFIX + response.Challenge
+
+    pipe := conns.Redis.TxPipeline()
+    pipe.HSet(ctx, key, fields)
+    pipe.Expire(ctx, key, TOTP_CHALLENGE_TTL)
+    if _, err := pipe.Exec(ctx); err != nil {
+        return nil, err
+    }
+    return response, nil
+}
+
+// Checks a TOTP code, falling back to the recovery codes. Codes cannot be used
+// twice: the TOTP step is remembered and recovery codes are removed.
+func (handler *UserHandler) useTotpCode(user *User, code string) (bool, error) {
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+
+    if step, ok := verifyTotp(user.TotpSecret, code, user.TotpLastStep); ok {
+        // Conditional on the step so two requests cannot both use the code
+        filter := bson.M{ "_id": user.Id, "totp_last_step": bson.M{ "$not": bson.M{ "$gte": step } } }
+        res, err := coll.UpdateOne(ctx, filter, bson.M{ "$set": bson.M{ "totp_last_step": step } })
+        if err != nil {
+            return false, err
+        }
+        return res.ModifiedCount == 1, nil
+    }
+
+    hash := hashRecoveryCode(code)
+    filter := bson.M{ "_id": user.Id, "recovery_codes": hash }
+    res, err := coll.UpdateOne(ctx, filter, bson.M{ "$pull": bson.M{ "recovery_codes": hash } })
+    if err != nil {
+        return false, err
+    }
+    return res.ModifiedCount == 1, nil
+}
+
+// Saves the secret on the user and returns fresh recovery codes
+func (handler *UserHandler) enableTotp(user *User, secret string, step int64) ([]string, error) {
+    codes, hashes, err := newRecoveryCodes()
+    if err != nil {
+        return nil, err
+    }
+
+    update := bson.M{
+        "$set": bson.M{
+            "totp_enabled": true,
+            "totp_secret": secret,
+            "totp_last_step": step,
+            "recovery_codes": hashes,
+        },
+    }
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    if _, err := coll.UpdateByID(context.Background(), user.Id, update); err != nil {
+        return nil, err
+    }
+
+    user.TotpEnabled = true
+    user.TotpSecret = secret
+    user.TotpLastStep = step
+    user.RecoveryCodes = hashes
+    return codes, nil
+}
+
+func (handler *UserHandler) disableTotp(user *User) error {
+    update := bson.M{
+        "$set": bson.M{ "totp_enabled": false },
+        "$unset": bson.M{ "totp_secret": "", "totp_last_step": "", "recovery_codes": "" },
+    }
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    if _, err := coll.UpdateByID(context.Background(), user.Id, update); err != nil {
+        return err
+    }
+
+    user.TotpEnabled = false
+    user.TotpSecret = ""
+    user.TotpLastStep = 0
+    user.RecoveryCodes = nil
+    return nil
+}
+
+func (handler *UserHandler) fetchUser(userId string) (*User, error) {
+    id, err := primitive.ObjectIDFromHex(userId)
+    if err != nil {
+        return nil, err
+    }
+
+    user := new(User)
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
+    if err := coll.FindOne(context.Background(), bson.M{ "_id": id }).Decode(user); err != nil {
+        return nil, err
+    }
+    return user, nil
+}
+
+// Returns the time step the code is valid for. Steps up to lastStep are
+// rejected so that a code cannot be replayed.
+func verifyTotp(secret string, code string, lastStep int64) (int64, bool) {
+    key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+    if err != nil || secret == "" {
+        return 0, false
+    }
+
+    code = strings.ReplaceAll(code, " ", "")
+    if len(code) != TOTP_DIGITS {
+        return 0, false
+    }
+
+    now := time.Now().Unix() / TOTP_PERIOD
+    for step := now - TOTP_SKEW; step <= now + TOTP_SKEW; step++ {
+        if step <= lastStep {
+            continue
+        }
+        if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+            return step, true
+        }
+    }
+    return 0, false
+}
+
+// HOTP (RFC 4226) of the time step
+func totpCode(key []byte, step int64) string {
+    counter := make([]byte, 8)
+    binary.BigEndian.PutUint64(counter, uint64(step))
+
+    mac := hmac.New(sha1.New, key)
+    mac.Write(counter)
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum) - 1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff
+
+    mod := uint32(1)
+    for i := 0; i < TOTP_DIGITS; i++ {
+        mod *= 10
+    }
+    return fmt.Sprintf("%0*d", TOTP_DIGITS, value % mod)
+}
+
+func newTotpSecret() (string, error) {
+    secretBytes := make([]byte, TOTP_SECRET_SIZE)
+    if _, err := rand.Read(secretBytes); err != nil {
+        return "", err
+    }
+    return totpEncoding.EncodeToString(secretBytes), nil
+}
+
+func totpUrl(username string, secret string) string {
+    issuer := os.Getenv("TOTP_ISSUER")
+    if issuer == "" {
+        issuer = DEFAULT_TOTP_ISSUER
+    }
+
+    query := url.Values{}
+    query.Set("secret", secret)
+    query.Set("issuer", issuer)
+    query.Set("algorithm", "SHA1")
+    query.Set("digits", strconv.Itoa(TOTP_DIGITS))
+    query.Set("period", strconv.Itoa(TOTP_PERIOD))
+
+    label := url.PathEscape(issuer + ":" + username)
+    return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Returns the codes to show the user and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+    codes := make([]string, TOTP_RECOVERY_CODE_COUNT)
+    hashes := make([]string, TOTP_RECOVERY_CODE_COUNT)
+
+    for i := range codes {
+        codeBytes := make([]byte, 5)
+        if _, err := rand.Read(codeBytes); err != nil {
+            return nil, nil, err
+        }
+        code := hex.EncodeToString(codeBytes)
+        codes[i] = code[:5] + "-" + code[5:]
+        hashes[i] = hashRecoveryCode(code)
+    }
+    return codes, hashes, nil
+}
+
+// Sets a cookie binding a challenge to this browser, for challenges whose ID
+// goes into a URL. Returns the challenge field to store with it.
+func bindTwoFactorChallenge(c echo.Context) (map[string]interface{}, error) {
+    binding, err := randomUrlString(32)
+    if err != nil {
+        return nil, err
+    }
+
+    c.SetCookie(&http.Cookie{
+        Name: TOTP_CHALLENGE_COOKIE,
+        Value: binding,
+        Path: "/",
+        MaxAge: int(TOTP_CHALLENGE_TTL / time.Second),
+        HttpOnly: true,
+        Secure: c.Scheme() == "https",
+        SameSite: http.SameSiteLaxMode,
+    })
+    return map[string]interface{}{ TOTP_CHALLENGE_BINDING: hashChallengeBinding(binding) }, nil
+}
+
+// Challenges without a binding are returned only to whoever gave the password
+func twoFactorChallengeBound(c echo.Context, challenge map[string]string) bool {
+    binding := challenge[TOTP_CHALLENGE_BINDING]
+    if binding == "" {
+        return true
+    }
+    cookie, err := c.Cookie(TOTP_CHALLENGE_COOKIE)
+    return err == nil && subtle.ConstantTimeCompare([]byte(hashChallengeBinding(cookie.Value)), []byte(binding)) == 1
+}
+
+func hashChallengeBinding(binding string) string {
+    hash, _ := sha256Hash([]byte(binding))
+    return hex.EncodeToString(hash)
+}
+
+func hashRecoveryCode(code string) string {
+    code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+    hash, _ := sha256Hash([]byte(code))
+    return hex.EncodeToString(hash)
+}
+
+func superRequiresTotp() bool {
+    required, _ := strconv.ParseBool(os.Getenv("REQUIRE_SUPER_2FA"))
+    return required
+}
@@ -0,0 +1,60 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1, cut down to the last TOTP_DIGITS digits
+func TestTotpCode(t *testing.T) {
+    key := []byte("12345678901234567890")
+    tests := []struct {
+        time int64
+        want string
+    }{
+        { 59, "287082" },
+        { 1111111109, "081804" },
+        { 1111111111, "050471" },
+        { 1234567890, "005924" },
+        { 2000000000, "279037" },
+        { 20000000000, "353130" },
+    }
+
+    for _, test := range tests {
+        if got := totpCode(key, test.time / TOTP_PERIOD); got != test.want {
+            t.Errorf("totpCode at %d = %s, want %s", test.time, got, test.want)
+        }
+    }
+}
+
+func TestVerifyTotp(t *testing.T) {
+    key := []byte("12345678901234567890")
+    secret := totpEncoding.EncodeToString(key)
+    now := time.Now().Unix() / TOTP_PERIOD
+    code := totpCode(key, now)
+
+    tests := []struct {
+        name     string
+        secret   string
+        code     string
+        lastStep int64
+        want     bool
+    }{
+        { "current code", secret, code, 0, true },
+        { "with spaces", secret, code[:3] + " " + code[3:], 0, true },
+        { "replayed", secret, code, now, false },
+        { "wrong length", secret, code[:TOTP_DIGITS - 1], 0, false },
+        { "no secret", "", code, 0, false },
+        { "invalid secret", "!!", code, 0, false },
+    }
+
+    for _, test := range tests {
+        step, ok := verifyTotp(test.secret, test.code, test.lastStep)
+        if ok != test.want {
+            t.Errorf("%s: verifyTotp = %v, want %v", test.name, ok, test.want)
+        }
+        if ok && step <= test.lastStep {
+            t.Errorf("%s: verifyTotp step %d not after %d", test.name, step, test.lastStep)
+        }
+    }
+}
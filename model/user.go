@@ -5,11 +5,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/DavidTan0527/EC-admin-dashboard/auth"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -23,11 +22,99 @@ type UserHandler struct {
 type User struct {
     Id       primitive.ObjectID `bson:"_id" json:"id"`
     Username string             `bson:"username" json:"username"`
-    Password string             `bson:"password" json:"password"`
-    Salt     string             `bson:"salt" json:"salt"`
+    Password string             `bson:"password" json:"-" redact:"true"`
+    Salt     string             `bson:"salt" json:"-" redact:"true"`
     IsSuper  bool               `bson:"is_super" json:"is_super"`
+    // Service accounts have no password and only authenticate with API keys
+    IsService bool              `bson:"is_service,omitempty" json:"is_service"`
+
+    DisplayName string    `bson:"display_name,omitempty"  json:"display_name,omitempty"`
+    Email       string    `bson:"email,omitempty"         json:"email,omitempty"`
+    // Set once the user has shown they own Email by following a link sent
+    // to it, or when a super user or the identity provider gave it. Only
+    // verified emails link SSO identities to users.
+    EmailVerified bool    `bson:"email_verified,omitempty" json:"email_verified"`
+    Department  string    `bson:"department,omitempty"    json:"department,omitempty"`
+    CreatedAt   time.Time `bson:"created_at,omitempty"    json:"created_at"`
+    LastLoginAt time.Time `bson:"last_login_at,omitempty" json:"last_login_at"`
+    // Disabled users keep their history but can no longer log in or use
+    // their tokens and API keys
+    Disabled    bool      `bson:"disabled,omitempty"      json:"disabled"`
+
+    // Set for users signing in through the identity provider
+    OidcSubject string   `bson:"oidc_subject,omitempty"   json:"oidc_subject,omitempty"`
+    // Permission keys granted from the user's IdP groups, revoked once the
+    // groups no longer map to them
+    OidcPermKeys []string `bson:"oidc_perm_keys,omitempty" json:"-"`
+
+    // Previous passwords, newest first
+    PasswordHistory    []PasswordHistoryEntry `bson:"password_history,omitempty"     json:"-" redact:"true"`
+    MustChangePassword bool                   `bson:"must_change_password,omitempty" json:"must_change_password"`
+
+    TotpEnabled   bool     `bson:"totp_enabled"             json:"totp_enabled"`
+    TotpSecret    string   `bson:"totp_secret,omitempty"    json:"-" redact:"true"`
+    TotpLastStep  int64    `bson:"totp_last_step,omitempty" json:"-"`
+    // SHA-256 hashes, each removed once used
+    RecoveryCodes []string `bson:"recovery_codes,omitempty" json:"-" redact:"true"`
 }
 
+// What the API shows of a user; handlers return this rather than User
+type PublicUser struct {
+    Id                 primitive.ObjectID `json:"id"`
+    Username           string             `json:"username"`
+    DisplayName        string             `json:"display_name,omitempty"`
+    Email              string             `json:"email,omitempty"`
+    EmailVerified      bool               `json:"email_verified"`
+    Department         string             `json:"department,omitempty"`
+    IsSuper            bool               `json:"is_super"`
+    IsService          bool               `json:"is_service"`
+    Disabled           bool               `json:"disabled"`
+    TotpEnabled        bool               `json:"totp_enabled"`
+    MustChangePassword bool               `json:"must_change_password"`
+    // Whether the user signs in through the identity provider
+    Sso                bool               `json:"sso"`
+    CreatedAt          time.Time          `json:"created_at"`
+    LastLoginAt        *time.Time         `json:"last_login_at,omitempty"`
+}
+
+func (user *User) Public() PublicUser {
+    public := PublicUser{
+        Id: user.Id,
+        Username: user.Username,
+        DisplayName: user.DisplayName,
+        Email: user.Email,
+        EmailVerified: user.EmailVerified,
+        Department: user.Department,
+        IsSuper: user.IsSuper,
+        IsService: user.IsService,
+        Disabled: user.Disabled,
+        TotpEnabled: user.TotpEnabled,
+        MustChangePassword: user.MustChangePassword,
+        Sso: user.OidcSubject != "",
+        CreatedAt: user.CreatedAt,
+    }
+    // Users from before creation times were kept still have their ID's
+    if public.CreatedAt.IsZero() {
+        public.CreatedAt = user.Id.Timestamp()
+    }
+    if !user.LastLoginAt.IsZero() {
+        lastLogin := user.LastLoginAt
+        public.LastLoginAt = &lastLogin
+    }
+    return public
+}
+
+func publicUsers(users []User) []PublicUser {
+    result := make([]PublicUser, len(users))
+    for i := range users {
+        result[i] = users[i].Public()
+    }
+    return result
+}
+
+// Used in place of a real salt when the username does not exist
+const LOGIN_DUMMY_SALT = "0000000000000000000000000000000000000000000000000000000000000000"
+
 type LoginUserBody struct {
     Username string `json:"username" validate:"required"`
     Password string `json:"password" validate:"required"`
@@ -40,37 +127,95 @@ func (handler *UserHandler) LoginUser(c echo.Context) error {
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
     }
 
+    rdb := handler.HandlerConns.Redis
+    if remaining, err := loginLockRemaining(rdb, body.Username); err != nil {
+        c.Logger().Error(err)
+    } else if remaining > 0 {
+        c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(remaining)))
+        return c.JSON(http.StatusTooManyRequests, HttpResponseBody{ Success: false, Message: "Too many failed attempts, try again later" })
+    }
+
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
 
     user := new(User)
-    if err := coll.FindOne(context.Background(), bson.M{"username": body.Username}).Decode(user); err != nil {
+    err := coll.FindOne(context.Background(), bson.M{"username": body.Username}).Decode(user)
+    if err != nil && err != mongo.ErrNoDocuments {
         return handleMongoErr(c, err)
     }
+    found := err == nil
+    if !found {
+        // Still hash the password so unknown usernames take as long to reject
+        user.Salt = LOGIN_DUMMY_SALT
+    }
 
     correct, err := verifyPassword(body.Password, user.Salt, user.Password)
     if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
     }
-    if !correct {
+    if !found || !correct || user.IsService {
+        if lockout, err := recordLoginFailure(rdb, body.Username); err != nil {
+            c.Logger().Error(err)
+        } else if lockout > 0 {
+            c.Logger().Warnf("Logins for %s locked for %s after too many failed attempts", body.Username, lockout)
+        }
         return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Username or password incorrect" })
     }
 
-    claims := auth.NewJwtClaims()
-    claims.UserId = user.Id.Hex()
-    claims.IsSuper = user.IsSuper
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims) 
+    if err := clearLoginFailures(rdb, body.Username); err != nil {
+        c.Logger().Error(err)
+    }
 
-    jwtKey, err := hex.DecodeString(os.Getenv("JWT_SECRET"))
+    // Only said once the password is known to be right
+    if user.Disabled {
+        return c.JSON(http.StatusForbidden, HttpResponseBody{ Success: false, Message: "Account is disabled" })
+    }
+
+    if user.TotpEnabled || (user.IsSuper && superRequiresTotp()) {
+        return handler.startTwoFactorLogin(c, user)
+    }
+
+    return handler.finishLogin(c, user, nil)
+}
+
+// Issues the JWT once every login step passed. Recovery codes are only given
+// when 2FA was just enrolled as part of logging in.
+func (handler *UserHandler) finishLogin(c echo.Context, user *User, recoveryCodes []string) error {
+    t, err := issueLoginToken(c, handler.HandlerConns, user)
     if err != nil {
         c.Logger().Error(err)
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error generating JWT token" })
     }
 
-    t, err := token.SignedString(jwtKey)
-    if err != nil {
+    if err := recordLogin(handler.HandlerConns, user); err != nil {
         c.Logger().Error(err)
-        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error generating JWT token" })
+    }
+
+    if recoveryCodes != nil {
+        return c.JSON(http.StatusOK, HttpResponseBody{
+            Success: true,
+            Message: "Login successful, two-factor authentication enabled",
+            Data: TotpLoginEnrollResponse{ Token: t, RecoveryCodes: recoveryCodes },
+        })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Login successful",
+        Data: t,
+    })
+}
+
+// Signs the JWT for a new session of the user and sets it as the login cookie
+func issueLoginToken(c echo.Context, conns *HandlerConns, user *User) (string, error) {
+    claims := auth.NewJwtClaims()
+    claims.UserId = user.Id.Hex()
+    claims.IsSuper = user.IsSuper
+    claims.MustChangePassword = user.MustChangePassword
+
+    t, err := signSessionToken(c, conns, claims, auth.TokenValidity, claims.UserId)
+    if err != nil {
+        return "", err
     }
 
     c.Logger().Info("User " + user.Username + " logged in")
@@ -81,17 +226,15 @@ func (handler *UserHandler) LoginUser(c echo.Context) error {
         Expires: time.Now().Add(auth.TokenValidity),
     })
 
-    return c.JSON(http.StatusOK, HttpResponseBody{
-        Success: true,
-        Message: "Login successful",
-        Data: t,
-    })
+    return t, nil
 }
 
 type CreateUserBody struct {
     Username string `json:"username" validate:"required"`
     Password string `json:"password" validate:"required"`
     IsSuper  bool   `json:"is_super" validate:"boolean"`
+    // For passwords chosen by someone else, e.g. a temporary one
+    MustChangePassword bool `json:"must_change_password"`
 }
 
 func (handler *UserHandler) CreateUser(c echo.Context) error {
@@ -110,14 +253,12 @@ func (handler *UserHandler) CreateUser(c echo.Context) error {
     user.Id = primitive.NewObjectID()
     user.Username = body.Username
     user.IsSuper = body.IsSuper
+    user.CreatedAt = time.Now()
 
-    password, salt, err := generateSaltAndPasswordHash(body.Password)
-    if err != nil {
-        c.Logger().Error(err)
-        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    if err := setUserPassword(user, body.Password); err != nil {
+        return handlePasswordErr(c, err)
     }
-    user.Password = password
-    user.Salt = salt
+    user.MustChangePassword = body.MustChangePassword
 
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
     if err := coll.FindOne(context.Background(), bson.M{"username": user.Username}).Decode(new(User)); err == nil {
@@ -126,7 +267,7 @@ func (handler *UserHandler) CreateUser(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
-    c.Logger().Info("Creating user " + user.Username + " with password hash " + user.Password)
+    c.Logger().Info("Creating user " + user.Username)
 
     if res, err := coll.InsertOne(context.Background(), user); err != nil {
         c.Logger().Info(res)
@@ -134,6 +275,10 @@ func (handler *UserHandler) CreateUser(c echo.Context) error {
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Cannot save user into DB" })
     }
     
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_USER, user.Id.Hex(), nil, user)
+
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_CREATE, Id: user.Id, UserId: claims.UserId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "User " + user.Username + " created"})
 }
 
@@ -156,9 +301,7 @@ func (handler *UserHandler) GetUser(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
-    c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Data: user })
-
-    return nil
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Data: user.Public() })
 }
 
 func (handler *UserHandler) GetAllUsers(c echo.Context) error {
@@ -181,7 +324,7 @@ func (handler *UserHandler) GetAllUsers(c echo.Context) error {
         return handleMongoErr(c, err)
     }
 
-    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Data: data })
+    return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Data: publicUsers(data) })
 }
 
 type UpdateUserPasswordBody struct {
@@ -220,13 +363,11 @@ func (handler *UserHandler) UpdateUserPassword(c echo.Context) error {
         return c.JSON(http.StatusOK, HttpResponseBody{ Success: false, Message: "Incorrect old password" })
     }
 
-    password, salt, err := generateSaltAndPasswordHash(body.NewPassword)
-    if err != nil {
-        c.Logger().Error(err)
-        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Server error" })
+    before := *user
+
+    if err := setUserPassword(user, body.NewPassword); err != nil {
+        return handlePasswordErr(c, err)
     }
-    user.Password = password
-    user.Salt = salt
 
     if result, err := coll.ReplaceOne(ctx, bson.M{"_id": id}, user); err != nil {
         c.Logger().Error(err)
@@ -235,6 +376,20 @@ func (handler *UserHandler) UpdateUserPassword(c echo.Context) error {
         return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error updating password into DB" })
     }
 
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_USER, id.Hex(), before, user)
+
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_UPDATE, Id: id, UserId: claims.UserId })
+
+    // The old token still says a change is needed, so hand out a new one
+    if claims.MustChangePassword {
+        t, err := issueLoginToken(c, handler.HandlerConns, user)
+        if err != nil {
+            c.Logger().Error(err)
+            return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error generating JWT token" })
+        }
+        return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Password changed successfully", Data: t })
+    }
+
     return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Password changed successfully" })
 }
 
@@ -253,13 +408,28 @@ func (handler *UserHandler) DeleteUser(c echo.Context) error {
     ctx := context.Background()
     coll := handler.HandlerConns.Db.Collection(COLL_NAME_USER)
 
-    _, err = coll.DeleteOne(ctx, bson.M{"_id": id })
-    if err != nil {
+    var before User
+    if err := coll.FindOneAndDelete(ctx, bson.M{"_id": id }).Decode(&before); err != nil {
         return handleMongoErr(c, err)
     }
 
     c.Logger().Info("User with ID " + id.Hex() + " deleted")
 
+    if err := revokeUserSessions(handler.HandlerConns.Redis, id.Hex()); err != nil {
+        c.Logger().Error(err)
+    }
+    handler.HandlerConns.Redis.SRem(ctx, DISABLED_USERS_KEY, id.Hex())
+    if err := removeUserPerms(handler.HandlerConns, id.Hex(), claims.UserId); err != nil {
+        c.Logger().Error(err)
+    }
+    if err := revokeUserApiKeys(handler.HandlerConns, id); err != nil {
+        c.Logger().Error(err)
+    }
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_DELETE, AUDIT_TARGET_USER, id.Hex(), before, nil)
+
+    publishEvent(handler.HandlerConns.Redis, ChangeEvent{ Type: EVENT_TYPE_USER, Action: EVENT_ACTION_DELETE, Id: id, UserId: claims.UserId })
+
     return c.JSON(http.StatusOK, HttpResponseBody{ Success: true, Message: "Successfully deleted user" })
 }
 
@@ -0,0 +1,731 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type WebhookHandler struct {
+    *HandlerConns
+}
+
+type Webhook struct {
+    Id        primitive.ObjectID `bson:"_id"        json:"id"`
+    Url       string             `bson:"url"        json:"url"`
+    Events    []string           `bson:"events"     json:"events"`
+    Secret    string             `bson:"secret"     json:"-" redact:"true"`
+    Active    bool               `bson:"active"     json:"active"`
+    CreatedBy string             `bson:"created_by" json:"createdBy"`
+    CreatedAt time.Time          `bson:"created_at" json:"createdAt"`
+}
+
+type WebhookDelivery struct {
+    Id          primitive.ObjectID `bson:"_id"               json:"id"`
+    WebhookId   primitive.ObjectID `bson:"webhook_id"        json:"webhookId"`
+    Event       string             `bson:"event"             json:"event"`
+    Payload     string             `bson:"payload"           json:"payload"`
+    Status      string             `bson:"status"            json:"status"`
+    Attempts    int                `bson:"attempts"          json:"attempts"`
+    StatusCode  int                `bson:"status_code"       json:"statusCode"`
+    Error       string             `bson:"error,omitempty"   json:"error,omitempty"`
+    NextAttempt time.Time          `bson:"next_attempt"      json:"nextAttempt"`
+    CreatedAt   time.Time          `bson:"created_at"        json:"createdAt"`
+    UpdatedAt   time.Time          `bson:"updated_at"        json:"updatedAt"`
+}
+
+// Body POSTed to webhook endpoints
+type WebhookPayload struct {
+    DeliveryId primitive.ObjectID `json:"deliveryId"`
+    Event      string             `json:"event"`
+    Data       ChangeEvent        `json:"data"`
+}
+
+type WebhookBody struct {
+    Url    string   `json:"url"    validate:"required,url"`
+    Events []string `json:"events" validate:"required,min=1,dive,required"`
+    Active *bool    `json:"active"`
+}
+
+type CreateWebhookResponse struct {
+    Webhook
+    Secret string `json:"secret"`
+}
+
+const (
+    WEBHOOK_EVENT_QUEUE = "ec:webhook:events"
+    WEBHOOK_RETRY_SET = "ec:webhook:retry"
+    WEBHOOK_EVENT_PING = "ping"
+)
+
+// Jobs being worked on stay in Redis until acknowledged, so a crashed
+// instance's jobs are picked up again once their claim is older than
+// WebhookDispatcher.ClaimTimeout
+const (
+    // Events moved off WEBHOOK_EVENT_QUEUE, with their claim times in
+    // WEBHOOK_EVENT_CLAIMS
+    WEBHOOK_EVENT_PROCESSING = "ec:webhook:events:processing"
+    WEBHOOK_EVENT_CLAIMS = "ec:webhook:events:claims"
+    // Deliveries taken off WEBHOOK_RETRY_SET, scored by when their claim runs out
+    WEBHOOK_DELIVERY_PROCESSING = "ec:webhook:processing"
+)
+
+// Moves a member from one sorted set to another if it is still in the
+// first, so only one instance can claim it
+var webhookMoveScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+    redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+    return 1
+end
+return 0
+`)
+
+// Puts an event back on the queue if it is still being processed
+var webhookRequeueScript = redis.NewScript(`
+redis.call('ZREM', KEYS[3], ARGV[1])
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 1 then
+    redis.call('RPUSH', KEYS[2], ARGV[1])
+    return 1
+end
+return 0
+`)
+
+const (
+    WEBHOOK_STATUS_PENDING = "pending"
+    WEBHOOK_STATUS_SUCCESS = "success"
+    WEBHOOK_STATUS_FAILED = "failed"
+)
+
+const (
+    WEBHOOK_HEADER_EVENT = "X-EC-Event"
+    WEBHOOK_HEADER_DELIVERY = "X-EC-Delivery"
+    WEBHOOK_HEADER_TIMESTAMP = "X-EC-Timestamp"
+    WEBHOOK_HEADER_SIGNATURE = "X-EC-Signature"
+)
+
+const WEBHOOK_DELIVERY_LIMIT = 100
+
+func (handler *WebhookHandler) GetWebhookList(c echo.Context) error {
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK)
+
+    cur, err := coll.Find(ctx, bson.M{})
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    result := make([]Webhook, 0)
+    if err := cur.All(ctx, &result); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: result,
+    })
+}
+
+func (handler *WebhookHandler) CreateWebhook(c echo.Context) error {
+    claims := GetJwtClaims(c)
+
+    body := new(WebhookBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    secretBytes := make([]byte, 32)
+    if _, err := rand.Read(secretBytes); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error generating secret" })
+    }
+
+    webhook := Webhook{
+        Id: primitive.NewObjectID(),
+        Url: body.Url,
+        Events: body.Events,
+        Secret: hex.EncodeToString(secretBytes),
+        Active: body.Active == nil || *body.Active,
+        CreatedBy: claims.UserId,
+        CreatedAt: time.Now(),
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK)
+    if res, err := coll.InsertOne(context.Background(), webhook); err != nil {
+        c.Logger().Info(res)
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Cannot save webhook into DB" })
+    }
+
+    c.Logger().Infof("Webhook %s created for %s", webhook.Id.Hex(), webhook.Url)
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_CREATE, AUDIT_TARGET_WEBHOOK, webhook.Id.Hex(), nil, webhook)
+
+    // The secret is only ever returned here
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Webhook created",
+        Data: CreateWebhookResponse{ Webhook: webhook, Secret: webhook.Secret },
+    })
+}
+
+func (handler *WebhookHandler) EditWebhook(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    body := new(WebhookBody)
+    if err := GetRequestBody(c, body); err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    set := bson.M{
+        "url": body.Url,
+        "events": body.Events,
+    }
+    if body.Active != nil {
+        set["active"] = *body.Active
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK)
+    var before Webhook
+    if err := coll.FindOneAndUpdate(context.Background(), bson.M{ "_id": id }, bson.M{ "$set": set }).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    after := before
+    after.Url = body.Url
+    after.Events = body.Events
+    if body.Active != nil {
+        after.Active = *body.Active
+    }
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_UPDATE, AUDIT_TARGET_WEBHOOK, id.Hex(), before, after)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Edited",
+    })
+}
+
+func (handler *WebhookHandler) DeleteWebhook(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK)
+    var before Webhook
+    if err := coll.FindOneAndDelete(context.Background(), bson.M{ "_id": id }).Decode(&before); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    c.Logger().Infof("Webhook %s deleted", id.Hex())
+
+    recordAudit(c, handler.HandlerConns, AUDIT_ACTION_DELETE, AUDIT_TARGET_WEBHOOK, id.Hex(), before, nil)
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Successfully deleted webhook",
+    })
+}
+
+// Queues a ping delivery, handy for checking an endpoint and its signature
+// verification against a local stand-in server
+func (handler *WebhookHandler) TestWebhook(c echo.Context) error {
+    claims := GetJwtClaims(c)
+
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    var webhook Webhook
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK)
+    if err := coll.FindOne(context.Background(), bson.M{ "_id": id }).Decode(&webhook); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    event := ChangeEvent{ Type: WEBHOOK_EVENT_PING, Id: webhook.Id, UserId: claims.UserId, Time: time.Now() }
+    delivery, err := createWebhookDelivery(handler.HandlerConns, primitive.NewObjectID(), webhook, WEBHOOK_EVENT_PING, event)
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusInternalServerError, HttpResponseBody{ Success: false, Message: "Error queueing delivery" })
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Ping queued",
+        Data: delivery,
+    })
+}
+
+func (handler *WebhookHandler) GetWebhookDeliveryList(c echo.Context) error {
+    id, err := primitive.ObjectIDFromHex(c.Param("id"))
+    if err != nil {
+        c.Logger().Error(err)
+        return c.JSON(http.StatusBadRequest, HttpResponseBody{ Success: false, Message: err.Error() })
+    }
+
+    filter := bson.M{ "webhook_id": id }
+    if status := c.QueryParam("status"); status != "" {
+        filter["status"] = status
+    }
+
+    ctx := context.Background()
+    coll := handler.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK_DELIVERY)
+
+    opts := options.Find().SetSort(bson.M{ "created_at": -1 }).SetLimit(WEBHOOK_DELIVERY_LIMIT)
+    cur, err := coll.Find(ctx, filter, opts)
+    if err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    result := make([]WebhookDelivery, 0)
+    if err := cur.All(ctx, &result); err != nil {
+        return handleMongoErr(c, err)
+    }
+
+    return c.JSON(http.StatusOK, HttpResponseBody{
+        Success: true,
+        Message: "Success",
+        Data: result,
+    })
+}
+
+// Moves events from the queue filled by publishEvent into per-webhook
+// deliveries, then sends due deliveries with exponential backoff. Every
+// instance can run one; jobs are claimed atomically in Redis so each is
+// taken once, and only dropped from Redis once done.
+type WebhookDispatcher struct {
+    *HandlerConns
+    Client       *http.Client
+    Logger       echo.Logger
+    MaxAttempts  int
+    BaseBackoff  time.Duration
+    MaxBackoff   time.Duration
+    PollInterval time.Duration
+    // Claims older than this are taken to belong to a crashed instance
+    ClaimTimeout time.Duration
+}
+
+func NewWebhookDispatcher(conns *HandlerConns) *WebhookDispatcher {
+    return &WebhookDispatcher{
+        HandlerConns: conns,
+        Client: &http.Client{ Timeout: 10 * time.Second },
+        Logger: log.New("webhook"),
+        MaxAttempts: 8,
+        BaseBackoff: 10 * time.Second,
+        MaxBackoff: 1 * time.Hour,
+        PollInterval: 1 * time.Second,
+        ClaimTimeout: 5 * time.Minute,
+    }
+}
+
+func (dispatcher *WebhookDispatcher) Run(ctx context.Context) {
+    go dispatcher.runFanOut(ctx)
+
+    ticker := time.NewTicker(dispatcher.PollInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if err := dispatcher.ProcessDue(ctx); err != nil {
+                dispatcher.Logger.Error(err)
+            }
+            if err := dispatcher.ReclaimStale(ctx); err != nil {
+                dispatcher.Logger.Error(err)
+            }
+        }
+    }
+}
+
+func (dispatcher *WebhookDispatcher) runFanOut(ctx context.Context) {
+    rdb := dispatcher.HandlerConns.Redis
+
+    for ctx.Err() == nil {
+        payload, err := rdb.BLMove(ctx, WEBHOOK_EVENT_QUEUE, WEBHOOK_EVENT_PROCESSING, "LEFT", "RIGHT", 5 * time.Second).Result()
+        if err == redis.Nil {
+            continue
+        } else if err != nil {
+            dispatcher.Logger.Error(err)
+            time.Sleep(dispatcher.PollInterval)
+            continue
+        }
+        if err := rdb.ZAdd(ctx, WEBHOOK_EVENT_CLAIMS, redis.Z{ Score: float64(time.Now().Unix()), Member: payload }).Err(); err != nil {
+            dispatcher.Logger.Error(err)
+        }
+
+        var event ChangeEvent
+        if err := json.Unmarshal([]byte(payload), &event); err != nil {
+            // Would never succeed, so it is dropped
+            dispatcher.Logger.Error(err)
+            dispatcher.ackEvent(ctx, payload)
+            continue
+        }
+
+        if err := dispatcher.FanOut(ctx, event); err != nil {
+            dispatcher.Logger.Error(err)
+            if _, err := webhookRequeueScript.Run(ctx, rdb, []string{ WEBHOOK_EVENT_PROCESSING, WEBHOOK_EVENT_QUEUE, WEBHOOK_EVENT_CLAIMS }, payload).Result(); err != nil {
+                dispatcher.Logger.Error(err)
+            }
+            time.Sleep(dispatcher.PollInterval)
+            continue
+        }
+        dispatcher.ackEvent(ctx, payload)
+    }
+}
+
+func (dispatcher *WebhookDispatcher) ackEvent(ctx context.Context, payload string) {
+    pipe := dispatcher.HandlerConns.Redis.TxPipeline()
+    pipe.LRem(ctx, WEBHOOK_EVENT_PROCESSING, 1, payload)
+    pipe.ZRem(ctx, WEBHOOK_EVENT_CLAIMS, payload)
+    if _, err := pipe.Exec(ctx); err != nil {
+        dispatcher.Logger.Error(err)
+    }
+}
+
+// Puts back events and deliveries claimed by an instance that stopped before
+// finishing them
+func (dispatcher *WebhookDispatcher) ReclaimStale(ctx context.Context) error {
+    rdb := dispatcher.HandlerConns.Redis
+    now := time.Now()
+    stale := now.Add(-dispatcher.ClaimTimeout).Unix()
+
+    payloads, err := rdb.LRange(ctx, WEBHOOK_EVENT_PROCESSING, 0, -1).Result()
+    if err != nil {
+        return err
+    }
+    for _, payload := range payloads {
+        claimedAt, err := rdb.ZScore(ctx, WEBHOOK_EVENT_CLAIMS, payload).Result()
+        if err == redis.Nil {
+            // Moved but not yet given a claim time, or the instance died in
+            // between; either way it gets a full timeout from now
+            if err := rdb.ZAddNX(ctx, WEBHOOK_EVENT_CLAIMS, redis.Z{ Score: float64(now.Unix()), Member: payload }).Err(); err != nil {
+                return err
+            }
+            continue
+        } else if err != nil {
+            return err
+        }
+        if int64(claimedAt) > stale {
+            continue
+        }
+
+        if requeued, err := webhookRequeueScript.Run(ctx, rdb, []string{ WEBHOOK_EVENT_PROCESSING, WEBHOOK_EVENT_QUEUE, WEBHOOK_EVENT_CLAIMS }, payload).Int(); err != nil {
+            return err
+        } else if requeued == 1 {
+            dispatcher.Logger.Warnf("Requeued webhook event abandoned since %s", time.Unix(int64(claimedAt), 0).Format(time.RFC3339))
+        }
+    }
+
+    expired, err := rdb.ZRangeByScore(ctx, WEBHOOK_DELIVERY_PROCESSING, &redis.ZRangeBy{
+        Min: "-inf",
+        Max: strconv.FormatInt(now.Unix(), 10),
+    }).Result()
+    if err != nil {
+        return err
+    }
+    for _, deliveryId := range expired {
+        if moved, err := webhookMoveScript.Run(ctx, rdb, []string{ WEBHOOK_DELIVERY_PROCESSING, WEBHOOK_RETRY_SET }, deliveryId, now.Unix()).Int(); err != nil {
+            return err
+        } else if moved == 1 {
+            dispatcher.Logger.Warnf("Requeued webhook delivery %s abandoned mid attempt", deliveryId)
+        }
+    }
+
+    return nil
+}
+
+// Creates a delivery for every active webhook subscribed to the event. Events
+// are requeued when this fails, so delivery IDs come from the event and the
+// webhook, and webhooks done by an earlier try are not delivered to again.
+func (dispatcher *WebhookDispatcher) FanOut(ctx context.Context, event ChangeEvent) error {
+    coll := dispatcher.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK)
+    cur, err := coll.Find(ctx, bson.M{ "active": true })
+    if err != nil {
+        return err
+    }
+
+    webhooks := make([]Webhook, 0)
+    if err := cur.All(ctx, &webhooks); err != nil {
+        return err
+    }
+
+    name := webhookEventName(event)
+    for _, webhook := range webhooks {
+        if !matchWebhookEvent(webhook.Events, name) {
+            continue
+        }
+        id, err := webhookDeliveryId(webhook, event)
+        if err != nil {
+            return err
+        }
+        if _, err := createWebhookDelivery(dispatcher.HandlerConns, id, webhook, name, event); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Sends every delivery whose next attempt is due
+func (dispatcher *WebhookDispatcher) ProcessDue(ctx context.Context) error {
+    rdb := dispatcher.HandlerConns.Redis
+
+    due, err := rdb.ZRangeByScore(ctx, WEBHOOK_RETRY_SET, &redis.ZRangeBy{
+        Min: "-inf",
+        Max: strconv.FormatInt(time.Now().Unix(), 10),
+        Count: 20,
+    }).Result()
+    if err != nil {
+        return err
+    }
+
+    for _, deliveryId := range due {
+        // Whoever moves it to the processing set owns this attempt. It stays
+        // there until the attempt is recorded, see ReclaimStale.
+        claimedUntil := time.Now().Add(dispatcher.ClaimTimeout).Unix()
+        if moved, err := webhookMoveScript.Run(ctx, rdb, []string{ WEBHOOK_RETRY_SET, WEBHOOK_DELIVERY_PROCESSING }, deliveryId, claimedUntil).Int(); err != nil {
+            return err
+        } else if moved == 0 {
+            continue
+        }
+
+        if err := dispatcher.deliver(ctx, deliveryId); err != nil {
+            dispatcher.Logger.Error(err)
+            // Deliveries that no longer exist are dropped, others are tried
+            // again once the claim runs out
+            if err != mongo.ErrNoDocuments && err != primitive.ErrInvalidHex {
+                continue
+            }
+        }
+        if err := rdb.ZRem(ctx, WEBHOOK_DELIVERY_PROCESSING, deliveryId).Err(); err != nil {
+            dispatcher.Logger.Error(err)
+        }
+    }
+
+    return nil
+}
+
+func (dispatcher *WebhookDispatcher) deliver(ctx context.Context, deliveryId string) error {
+    id, err := primitive.ObjectIDFromHex(deliveryId)
+    if err != nil {
+        return err
+    }
+
+    deliveryColl := dispatcher.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK_DELIVERY)
+    var delivery WebhookDelivery
+    if err := deliveryColl.FindOne(ctx, bson.M{ "_id": id }).Decode(&delivery); err != nil {
+        return err
+    }
+    // Scheduled twice, and the other attempt already finished it
+    if delivery.Status != WEBHOOK_STATUS_PENDING {
+        return nil
+    }
+
+    var webhook Webhook
+    webhookColl := dispatcher.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK)
+    if err := webhookColl.FindOne(ctx, bson.M{ "_id": delivery.WebhookId }).Decode(&webhook); err != nil {
+        // Webhook deleted since, nothing left to deliver to
+        return dispatcher.finish(ctx, &delivery, WEBHOOK_STATUS_FAILED, 0, "Webhook no longer exists")
+    }
+
+    delivery.Attempts++
+    statusCode, sendErr := dispatcher.send(ctx, webhook, delivery)
+    if sendErr == nil {
+        return dispatcher.finish(ctx, &delivery, WEBHOOK_STATUS_SUCCESS, statusCode, "")
+    }
+
+    if delivery.Attempts >= dispatcher.MaxAttempts {
+        return dispatcher.finish(ctx, &delivery, WEBHOOK_STATUS_FAILED, statusCode, sendErr.Error())
+    }
+
+    backoff := dispatcher.BaseBackoff << (delivery.Attempts - 1)
+    if backoff > dispatcher.MaxBackoff || backoff <= 0 {
+        backoff = dispatcher.MaxBackoff
+    }
+    next := time.Now().Add(backoff)
+
+    update := bson.M{
+        "$set": bson.M{
+            "attempts": delivery.Attempts,
+            "status_code": statusCode,
+            "error": sendErr.Error(),
+            "next_attempt": next,
+            "updated_at": time.Now(),
+        },
+    }
+    if _, err := deliveryColl.UpdateByID(ctx, delivery.Id, update); err != nil {
+        return err
+    }
+
+    pipe := dispatcher.HandlerConns.Redis.TxPipeline()
+    pipe.ZAdd(ctx, WEBHOOK_RETRY_SET, redis.Z{ Score: float64(next.Unix()), Member: delivery.Id.Hex() })
+    pipe.ZRem(ctx, WEBHOOK_DELIVERY_PROCESSING, delivery.Id.Hex())
+    _, err = pipe.Exec(ctx)
+    return err
+}
+
+func (dispatcher *WebhookDispatcher) send(ctx context.Context, webhook Webhook, delivery WebhookDelivery) (int, error) {
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewBufferString(delivery.Payload))
+    if err != nil {
+        return 0, err
+    }
+    req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+    req.Header.Set(WEBHOOK_HEADER_EVENT, delivery.Event)
+    req.Header.Set(WEBHOOK_HEADER_DELIVERY, delivery.Id.Hex())
+    req.Header.Set(WEBHOOK_HEADER_TIMESTAMP, timestamp)
+    req.Header.Set(WEBHOOK_HEADER_SIGNATURE, "sha256=" + SignWebhookPayload(webhook.Secret, timestamp, []byte(delivery.Payload)))
+
+    res, err := dispatcher.Client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer res.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(res.Body, 1 << 16))
+
+    if res.StatusCode < 200 || res.StatusCode >= 300 {
+        return res.StatusCode, fmt.Errorf("Endpoint responded with %s", res.Status)
+    }
+    return res.StatusCode, nil
+}
+
+func (dispatcher *WebhookDispatcher) finish(ctx context.Context, delivery *WebhookDelivery, status string, statusCode int, message string) error {
+    coll := dispatcher.HandlerConns.Db.Collection(COLL_NAME_WEBHOOK_DELIVERY)
+    update := bson.M{
+        "$set": bson.M{
+            "status": status,
+            "attempts": delivery.Attempts,
+            "status_code": statusCode,
+            "error": message,
+            "updated_at": time.Now(),
+        },
+    }
+    _, err := coll.UpdateByID(ctx, delivery.Id, update)
+    return err
+}
+
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook secret, hex
+// encoded. Receivers should recompute it and reject stale timestamps.
+func SignWebhookPayload(secret string, timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp))
+    mac.Write([]byte("."))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Creates the delivery and schedules it. A delivery that already exists is
+// left as it is, unless an earlier try created it but failed to schedule it.
+func createWebhookDelivery(conns *HandlerConns, id primitive.ObjectID, webhook Webhook, name string, event ChangeEvent) (*WebhookDelivery, error) {
+    now := time.Now()
+    delivery := &WebhookDelivery{
+        Id: id,
+        WebhookId: webhook.Id,
+        Event: name,
+        Status: WEBHOOK_STATUS_PENDING,
+        NextAttempt: now,
+        CreatedAt: now,
+        UpdatedAt: now,
+    }
+
+    payload, err := json.Marshal(WebhookPayload{ DeliveryId: delivery.Id, Event: name, Data: event })
+    if err != nil {
+        return nil, err
+    }
+    delivery.Payload = string(payload)
+
+    ctx := context.Background()
+    coll := conns.Db.Collection(COLL_NAME_WEBHOOK_DELIVERY)
+    if _, err := coll.InsertOne(ctx, delivery); mongo.IsDuplicateKeyError(err) {
+        if err := coll.FindOne(ctx, bson.M{ "_id": id }).Decode(delivery); err != nil {
+            return nil, err
+        }
+        if delivery.Status != WEBHOOK_STATUS_PENDING || delivery.Attempts > 0 {
+            return delivery, nil
+        }
+        // Being sent right now
+        if err := conns.Redis.ZScore(ctx, WEBHOOK_DELIVERY_PROCESSING, id.Hex()).Err(); err != redis.Nil {
+            return delivery, err
+        }
+        err = conns.Redis.ZAddNX(ctx, WEBHOOK_RETRY_SET, redis.Z{ Score: float64(now.Unix()), Member: id.Hex() }).Err()
+        return delivery, err
+    } else if err != nil {
+        return nil, err
+    }
+
+    err = conns.Redis.ZAdd(ctx, WEBHOOK_RETRY_SET, redis.Z{
+        Score: float64(now.Unix()),
+        Member: delivery.Id.Hex(),
+    }).Err()
+    return delivery, err
+}
+
+// The same for every try at fanning out the event to the webhook
+func webhookDeliveryId(webhook Webhook, event ChangeEvent) (primitive.ObjectID, error) {
+    payload, err := json.Marshal(event)
+    if err != nil {
+        return primitive.NilObjectID, err
+    }
+
+    hash := sha256.New()
+    hash.Write(webhook.Id[:])
+    hash.Write(payload)
+
+    var id primitive.ObjectID
+    copy(id[:], hash.Sum(nil))
+    return id, nil
+}
+
+func enqueueWebhookEvent(rdb *redis.Client, payload []byte) {
+    rdb.RPush(context.Background(), WEBHOOK_EVENT_QUEUE, payload)
+}
+
+func webhookEventName(event ChangeEvent) string {
+    if event.Action == "" {
+        return event.Type
+    }
+    return event.Type + "." + event.Action
+}
+
+// Filters are "*", "<type>.*" or an exact "<type>.<action>"
+func matchWebhookEvent(filters []string, name string) bool {
+    for _, filter := range filters {
+        if filter == "*" || filter == name {
+            return true
+        }
+        if prefix := strings.TrimSuffix(filter, "*"); prefix != filter && strings.HasPrefix(name, prefix) {
+            return true
+        }
+    }
+    return false
+}
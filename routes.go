@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/hex"
 	"net/http"
 	"os"
 	"os/signal"
@@ -20,23 +19,46 @@ import (
 
 // Middlewares for handlers
 type Middlewares struct {
-    Jwt     echo.MiddlewareFunc
-    IsSuper echo.MiddlewareFunc
+    Jwt       echo.MiddlewareFunc
+    JwtStream echo.MiddlewareFunc
+    IsSuper   echo.MiddlewareFunc
+    // Tighter limit for endpoints taking passwords
+    RateLimitLogin echo.MiddlewareFunc
 }
 
 func initRoutes(conns *model.HandlerConns) *echo.Echo {
     e := echo.New()
     setupMiddlewares(e)
 
-    middlewares := initCustomMiddlewares()
+    // Every request counts against its IP, logged in requests against the
+    // user as well (see Middlewares.Jwt)
+    e.Use(model.NewRateLimiter(conns, model.RateLimitConfig{
+        Name: "ip",
+        Limit: 600,
+        Window: time.Minute,
+        Env: "RATE_LIMIT_IP",
+        KeyFunc: model.RateLimitByIp,
+    }))
+
+    middlewares := initCustomMiddlewares(conns)
 
 	e.GET("/ping", model.Ping)
+    e.GET("/.well-known/jwks.json", model.GetJwks)
     e.GET("/checkToken", model.Ping, middlewares.Jwt)
     initUserRoutes(e, conns, middlewares)
     initPermRoutes(e, conns, middlewares)
     initTableRoutes(e, conns, middlewares)
     initChartRoutes(e, conns, middlewares)
     initChartViewRoutes(e, conns, middlewares)
+    initAttachmentRoutes(e, conns, middlewares)
+    initCommentRoutes(e, conns, middlewares)
+    initCollabRoutes(e, conns, middlewares)
+    initEventRoutes(e, conns, middlewares)
+    initStreamTicketRoutes(e, conns, middlewares)
+    initWebhookRoutes(e, conns, middlewares)
+    initAuditRoutes(e, conns, middlewares)
+    initApiKeyRoutes(e, conns, middlewares)
+    initOidcRoutes(e, conns)
 
     // Graceful shutdown
     ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
@@ -66,12 +88,41 @@ func initRoutes(conns *model.HandlerConns) *echo.Echo {
 func initUserRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
     handler := model.UserHandler{ HandlerConns: httpHandler }
     e.POST("/register", handler.CreateUser, middlewares.Jwt)
-    e.POST("/login", handler.LoginUser)
+    e.POST("/login", handler.LoginUser, middlewares.RateLimitLogin)
+    e.POST("/login/2fa", handler.LoginTwoFactor, middlewares.RateLimitLogin)
+    e.GET("/login/2fa/:challenge", handler.GetTwoFactorChallenge, middlewares.RateLimitLogin)
+    e.POST("/login/2fa/enroll", handler.EnrollTwoFactorLogin, middlewares.RateLimitLogin)
     e.POST("/change_pwd", handler.UpdateUserPassword, middlewares.Jwt)
+    e.GET("/password/policy", handler.GetPasswordPolicy)
+    e.POST("/user/:id/force_password_change", handler.ForcePasswordChange, middlewares.Jwt, middlewares.IsSuper)
+
+    e.POST("/invite", handler.InviteUser, middlewares.Jwt)
+    e.GET("/invite", handler.GetInvite, middlewares.RateLimitLogin)
+    e.POST("/invite/accept", handler.AcceptInvite, middlewares.RateLimitLogin)
+    e.POST("/password/forgot", handler.ForgotPassword, middlewares.RateLimitLogin)
+    e.POST("/password/reset", handler.ResetPassword, middlewares.RateLimitLogin)
+    e.POST("/user/:id/reset_password", handler.SendPasswordReset, middlewares.Jwt, middlewares.IsSuper)
 
     e.GET("/user/:id", handler.GetUser, middlewares.Jwt)
+    e.PUT("/user/:id", handler.UpdateUserProfile, middlewares.Jwt, middlewares.IsSuper)
+    e.PUT("/profile", handler.UpdateProfile, middlewares.Jwt)
+    e.POST("/profile/email/verify", handler.VerifyEmail, middlewares.RateLimitLogin)
+    e.POST("/user/:id/disable", handler.DisableUser, middlewares.Jwt, middlewares.IsSuper)
+    e.POST("/user/:id/enable", handler.EnableUser, middlewares.Jwt, middlewares.IsSuper)
     e.DELETE("/user/:id", handler.DeleteUser, middlewares.Jwt, middlewares.IsSuper)
     e.GET("/users", handler.GetAllUsers, middlewares.Jwt, middlewares.IsSuper)
+
+    e.POST("/2fa/enroll", handler.EnrollTotp, middlewares.Jwt)
+    e.POST("/2fa/confirm", handler.ConfirmTotp, middlewares.Jwt)
+    e.POST("/2fa/disable", handler.DisableTotp, middlewares.Jwt, middlewares.RateLimitLogin)
+    e.POST("/2fa/recovery_codes", handler.RegenerateRecoveryCodes, middlewares.Jwt, middlewares.RateLimitLogin)
+    e.DELETE("/user/:id/2fa", handler.ResetTotp, middlewares.Jwt, middlewares.IsSuper)
+
+    e.POST("/logout", handler.Logout, middlewares.Jwt)
+    e.GET("/session", handler.GetSessionList, middlewares.Jwt)
+    e.DELETE("/session/:id", handler.RevokeSession, middlewares.Jwt)
+    e.POST("/session/revoke_others", handler.RevokeOtherSessions, middlewares.Jwt)
+    e.POST("/user/:id/impersonate", handler.Impersonate, middlewares.Jwt, middlewares.IsSuper)
 }
 
 func initPermRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
@@ -80,8 +131,21 @@ func initPermRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *
     e.GET("/permission/:key/list", handler.GetPermUserList, middlewares.Jwt, middlewares.IsSuper)
     e.POST("/permission", handler.SetPerm, middlewares.Jwt, middlewares.IsSuper)
     e.DELETE("/permission", handler.RemovePerm, middlewares.Jwt, middlewares.IsSuper)
+    e.POST("/permission/bulk", handler.BulkGrantPerm, middlewares.Jwt, middlewares.IsSuper)
+    e.DELETE("/permission/bulk", handler.BulkRemovePerm, middlewares.Jwt, middlewares.IsSuper)
+    e.POST("/permission/copy", handler.CopyPerm, middlewares.Jwt, middlewares.IsSuper)
+    e.GET("/permission_matrix", handler.ExportPermMatrix, middlewares.Jwt, middlewares.IsSuper)
+    e.POST("/permission_matrix", handler.ImportPermMatrix, middlewares.Jwt, middlewares.IsSuper)
+    e.GET("/permission_grants", handler.GetPermGrantList, middlewares.Jwt, middlewares.IsSuper)
+    e.GET("/user/:id/permissions", handler.GetEffectivePerms, middlewares.Jwt)
+    e.GET("/user/:id/access/:type/:resource_id", handler.ExplainAccess, middlewares.Jwt)
 
     e.GET("/permission_keys", handler.GetAllPermKey, middlewares.Jwt)
+    e.GET("/permission_registry", handler.GetPermKeyRegistry, middlewares.Jwt)
+    e.GET("/permission_registry/:key", handler.GetPermKeyDetail, middlewares.Jwt)
+    e.POST("/permission_registry", handler.RegisterPermKey, middlewares.Jwt, middlewares.IsSuper)
+    e.PUT("/permission_registry/:key", handler.EditPermKey, middlewares.Jwt, middlewares.IsSuper)
+    e.DELETE("/permission_registry/:key", handler.DeletePermKey, middlewares.Jwt, middlewares.IsSuper)
 }
 
 func initTableRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
@@ -98,6 +162,8 @@ func initTableRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares
 
     e.GET("/table/schema", handler.GetAllTableSchema, middlewares.Jwt)
     e.GET("/table/schema/:id", handler.GetTableSchema, middlewares.Jwt)
+
+    e.GET("/table/search", handler.SearchTable, middlewares.Jwt)
 }
 
 func initChartRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
@@ -113,23 +179,119 @@ func initChartViewRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewa
     handler := model.ChartViewHandler{ HandlerConns: httpHandler }
     e.GET("/chart_view", handler.GetChartViewList, middlewares.Jwt)
     e.GET("/chart_view/:id", handler.LoadChartView, middlewares.Jwt)
+    e.GET("/chart_view/:id/data", handler.GetChartViewData, middlewares.Jwt)
     e.POST("/chart_view", handler.CreateChartView, middlewares.Jwt)
     e.PUT("/chart_view", handler.EditChartView, middlewares.Jwt)
     e.DELETE("/chart_view/:id", handler.DeleteChartView, middlewares.Jwt)
 }
 
-func initCustomMiddlewares() *Middlewares {
-    jwtKey, err := hex.DecodeString(os.Getenv("JWT_SECRET"))
-    if err != nil {
-        panic("Invalid JWT secret")
-    }
+func initAttachmentRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
+    handler := model.AttachmentHandler{ HandlerConns: httpHandler }
+    e.GET("/table/:id/:year/:month/attachment", handler.GetAttachmentList, middlewares.Jwt)
+    e.POST("/table/:id/:year/:month/attachment", handler.UploadAttachment, middlewares.Jwt)
+    e.GET("/attachment/:id", handler.DownloadAttachment, middlewares.Jwt)
+    e.DELETE("/attachment/:id", handler.DeleteAttachment, middlewares.Jwt)
+}
+
+func initCommentRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
+    handler := model.CommentHandler{ HandlerConns: httpHandler }
+    e.GET("/comment", handler.GetCommentList, middlewares.Jwt)
+    e.POST("/comment", handler.CreateComment, middlewares.Jwt)
+    e.PUT("/comment/:id", handler.EditComment, middlewares.Jwt)
+    e.DELETE("/comment/:id", handler.DeleteComment, middlewares.Jwt)
+    e.POST("/comment/:id/resolve", handler.ResolveComment, middlewares.Jwt)
+    e.POST("/comment/:id/unresolve", handler.UnresolveComment, middlewares.Jwt)
+
+    e.GET("/comment/mentions", handler.GetMentionList, middlewares.Jwt)
+}
+
+func initCollabRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
+    handler := model.CollabHandler{ HandlerConns: httpHandler }
+    e.GET("/table/:id/:year/:month/ws", handler.TableSocket, middlewares.JwtStream)
+}
+
+func initEventRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
+    handler := model.EventHandler{ HandlerConns: httpHandler }
+    e.GET("/events", handler.Subscribe, middlewares.JwtStream)
+}
+
+func initStreamTicketRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
+    handler := model.StreamTicketHandler{ HandlerConns: httpHandler }
+    e.POST("/stream_ticket", handler.CreateStreamTicket, middlewares.Jwt)
+}
+
+func initWebhookRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
+    handler := model.WebhookHandler{ HandlerConns: httpHandler }
+    e.GET("/webhook", handler.GetWebhookList, middlewares.Jwt, middlewares.IsSuper)
+    e.POST("/webhook", handler.CreateWebhook, middlewares.Jwt, middlewares.IsSuper)
+    e.PUT("/webhook/:id", handler.EditWebhook, middlewares.Jwt, middlewares.IsSuper)
+    e.DELETE("/webhook/:id", handler.DeleteWebhook, middlewares.Jwt, middlewares.IsSuper)
+    e.POST("/webhook/:id/test", handler.TestWebhook, middlewares.Jwt, middlewares.IsSuper)
+    e.GET("/webhook/:id/deliveries", handler.GetWebhookDeliveryList, middlewares.Jwt, middlewares.IsSuper)
+}
+
+func initAuditRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
+    handler := model.AuditHandler{ HandlerConns: httpHandler }
+    e.GET("/audit", handler.GetAuditLog, middlewares.Jwt, middlewares.IsSuper)
+}
+
+func initApiKeyRoutes(e *echo.Echo, httpHandler *model.HandlerConns, middlewares *Middlewares) {
+    handler := model.ApiKeyHandler{ HandlerConns: httpHandler }
+    e.GET("/service_account", handler.GetServiceAccountList, middlewares.Jwt, middlewares.IsSuper)
+    e.POST("/service_account", handler.CreateServiceAccount, middlewares.Jwt, middlewares.IsSuper)
+    e.DELETE("/service_account/:id", handler.DeleteServiceAccount, middlewares.Jwt, middlewares.IsSuper)
+    e.GET("/service_account/:id/key", handler.GetApiKeyList, middlewares.Jwt, middlewares.IsSuper)
+    e.POST("/service_account/:id/key", handler.CreateApiKey, middlewares.Jwt, middlewares.IsSuper)
+    e.DELETE("/api_key/:id", handler.RevokeApiKey, middlewares.Jwt, middlewares.IsSuper)
+}
+
+func initOidcRoutes(e *echo.Echo, httpHandler *model.HandlerConns) {
+    handler := model.OidcHandler{ HandlerConns: httpHandler }
+    e.GET("/oidc/login", handler.Login)
+    e.GET("/oidc/callback", handler.Callback)
+}
+
+func initCustomMiddlewares(conns *model.HandlerConns) *Middlewares {
+    jwtAuth := echojwt.WithConfig(echojwt.Config{
+        NewClaimsFunc: func(c echo.Context) jwt.Claims {
+            return new(auth.JwtClaims)
+        },
+        KeyFunc: model.JwtKeyFunc,
+    })
+    userRateLimit := model.NewRateLimiter(conns, model.RateLimitConfig{
+        Name: "user",
+        Limit: 300,
+        Window: time.Minute,
+        Env: "RATE_LIMIT_USER",
+        KeyFunc: model.RateLimitByUser,
+    })
+
+    // API keys are accepted wherever a JWT is
+    apiKeyAuth := model.ApiKeyAuth(conns, jwtAuth)
+
+    // Browsers cannot set headers on WebSocket and EventSource requests, so
+    // they pass a single-use ticket instead (see model.StreamTicketAuth)
+    jwtStreamAuth := model.StreamTicketAuth(conns, apiKeyAuth)
+
+    sessionGuard := model.SessionGuard(conns)
+    impersonationAudit := model.ImpersonationAudit(conns)
+    activeUserGuard := model.ActiveUserGuard(conns)
 
     return &Middlewares{
-        Jwt: echojwt.WithConfig(echojwt.Config{
-            NewClaimsFunc: func(c echo.Context) jwt.Claims {
-                return new(auth.JwtClaims)
-            },
-            SigningKey: jwtKey,
+        Jwt: func (next echo.HandlerFunc) echo.HandlerFunc {
+            return apiKeyAuth(sessionGuard(activeUserGuard(impersonationAudit(model.PasswordChangeGuard(userRateLimit(next))))))
+        },
+
+        JwtStream: func (next echo.HandlerFunc) echo.HandlerFunc {
+            return jwtStreamAuth(sessionGuard(activeUserGuard(impersonationAudit(model.PasswordChangeGuard(next)))))
+        },
+
+        RateLimitLogin: model.NewRateLimiter(conns, model.RateLimitConfig{
+            Name: "login",
+            Limit: 10,
+            Window: time.Minute,
+            Env: "RATE_LIMIT_LOGIN",
+            KeyFunc: model.RateLimitByIp,
         }),
 
         IsSuper: func (next echo.HandlerFunc) echo.HandlerFunc {
@@ -153,6 +315,8 @@ func initCustomMiddlewares() *Middlewares {
 func setupMiddlewares(e *echo.Echo) {
     e.Use(middleware.CORS())
     e.Validator = &RequestValidator{ validator: validator.New() }
+    e.JSONSerializer = model.RedactingJSONSerializer{}
+    e.IPExtractor = model.IpExtractor(e.Logger)
 
     e.Logger.SetLevel(log.DEBUG)
     if l, ok := e.Logger.(*log.Logger); ok {